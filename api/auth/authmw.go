@@ -1,18 +1,70 @@
 package auth
 
 import (
+	"context"
 	"net/http"
+	"strings"
+
+	"github.com/larikhide/reguser/app/repos/user"
 )
 
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			if u, p, ok := r.BasicAuth(); !ok || !(u == "admin" && p == "admin") {
-				http.Error(w, "unautorized", http.StatusUnauthorized)
-				return
-			}
-			// r = r.WithContext(context.WithValue(r.Context(), CtxUser{}, User{ID:"",Name:""}))
-			next.ServeHTTP(w, r)
-		},
-	)
+type CtxUser struct{}
+
+type TokenVerifier interface {
+	VerifyToken(ctx context.Context, token string) (*user.User, error)
+}
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, name, password string) (*user.User, error)
+	TokenVerifier
+}
+
+// Credentials разбирает заголовок Authorization, Basic проверяется по хранилищу,
+// Bearer - как JWT
+func Credentials(a Authenticator, r *http.Request) (*user.User, bool) {
+	if tk, ok := bearerToken(r); ok {
+		u, err := a.VerifyToken(r.Context(), tk)
+		return u, err == nil
+	}
+	n, p, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	u, err := a.Authenticate(r.Context(), n, p)
+	return u, err == nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return h[len(prefix):], true
+}
+
+func AuthMiddleware(a Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				au, ok := Credentials(a, r)
+				if !ok {
+					http.Error(w, "unautorized", http.StatusUnauthorized)
+					return
+				}
+				r = r.WithContext(WithUser(r.Context(), *au))
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+func WithUser(ctx context.Context, u user.User) context.Context {
+	return context.WithValue(ctx, CtxUser{}, u)
+}
+
+// UserFromContext возвращает пользователя, прошедшего аутентификацию
+func UserFromContext(ctx context.Context) (user.User, bool) {
+	u, ok := ctx.Value(CtxUser{}).(user.User)
+	return u, ok
 }
@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"net/http"
+)
+
+// RequirePerms пропускает запрос только если у пользователя из контекста
+// есть все биты perms, ставится после AuthMiddleware
+func RequirePerms(perms int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				u, ok := UserFromContext(r.Context())
+				if !ok {
+					http.Error(w, "unautorized", http.StatusUnauthorized)
+					return
+				}
+				if !u.Can(perms) {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
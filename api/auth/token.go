@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+var ErrBadToken = errors.New("bad token")
+
+const (
+	tokenAccess  = "access"
+	tokenRefresh = "refresh"
+)
+
+type TokenConfig struct {
+	Method     string // HS256 или RS256
+	Secret     []byte // ключ для HS256
+	KeyFile    string // PEM с приватным RSA ключом для RS256
+	Issuer     string
+	Audience   string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+type Claims struct {
+	jwt.RegisteredClaims
+	Name  string `json:"name,omitempty"`
+	Perms int    `json:"perms"`
+	Type  string `json:"typ"`
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Tokens выпускает и проверяет JWT.
+// Выданные refresh токены помнит в памяти: каждый можно обменять только один раз,
+// поэтому при нескольких экземплярах сервиса refresh должен идти в тот же экземпляр.
+type Tokens struct {
+	cfg     TokenConfig
+	method  jwt.SigningMethod
+	signKey interface{}
+	verKey  interface{}
+
+	mu      sync.Mutex
+	refresh map[string]time.Time // jti -> exp
+}
+
+func NewTokens(cfg TokenConfig) (*Tokens, error) {
+	if cfg.AccessTTL == 0 {
+		cfg.AccessTTL = 15 * time.Minute
+	}
+	if cfg.RefreshTTL == 0 {
+		cfg.RefreshTTL = 7 * 24 * time.Hour
+	}
+	t := &Tokens{
+		cfg:     cfg,
+		refresh: make(map[string]time.Time),
+	}
+	switch cfg.Method {
+	case "", "HS256":
+		if len(cfg.Secret) == 0 {
+			return nil, fmt.Errorf("HS256 secret is empty")
+		}
+		t.method = jwt.SigningMethodHS256
+		t.signKey = cfg.Secret
+		t.verKey = cfg.Secret
+	case "RS256":
+		b, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read key file error: %w", err)
+		}
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse key file error: %w", err)
+		}
+		t.method = jwt.SigningMethodRS256
+		t.signKey = key
+		t.verKey = key.Public().(*rsa.PublicKey)
+	default:
+		return nil, fmt.Errorf("unknown signing method %q", cfg.Method)
+	}
+	return t, nil
+}
+
+func (t *Tokens) sign(u user.User, typ string, ttl time.Duration) (string, *Claims, error) {
+	now := time.Now()
+	c := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Subject:   u.ID.String(),
+			Issuer:    t.cfg.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Name:  u.Name,
+		Perms: u.Permissions,
+		Type:  typ,
+	}
+	if t.cfg.Audience != "" {
+		c.Audience = jwt.ClaimStrings{t.cfg.Audience}
+	}
+	s, err := jwt.NewWithClaims(t.method, c).SignedString(t.signKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, c, nil
+}
+
+// Issue выдает пару access/refresh токенов для пользователя
+func (t *Tokens) Issue(u user.User) (TokenPair, error) {
+	at, _, err := t.sign(u, tokenAccess, t.cfg.AccessTTL)
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("sign access token error: %w", err)
+	}
+	rt, rc, err := t.sign(u, tokenRefresh, t.cfg.RefreshTTL)
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("sign refresh token error: %w", err)
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	for id, exp := range t.refresh {
+		if now.After(exp) {
+			delete(t.refresh, id)
+		}
+	}
+	t.refresh[rc.ID] = rc.ExpiresAt.Time
+	t.mu.Unlock()
+
+	return TokenPair{
+		AccessToken:  at,
+		RefreshToken: rt,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(t.cfg.AccessTTL / time.Second),
+	}, nil
+}
+
+func (t *Tokens) parse(s, typ string) (*Claims, error) {
+	c := &Claims{}
+	_, err := jwt.ParseWithClaims(s, c, func(tk *jwt.Token) (interface{}, error) {
+		if tk.Method.Alg() != t.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", tk.Method.Alg())
+		}
+		return t.verKey, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadToken, err)
+	}
+	if t.cfg.Audience != "" && !c.VerifyAudience(t.cfg.Audience, true) {
+		return nil, fmt.Errorf("%w: bad audience", ErrBadToken)
+	}
+	if t.cfg.Issuer != "" && !c.VerifyIssuer(t.cfg.Issuer, true) {
+		return nil, fmt.Errorf("%w: bad issuer", ErrBadToken)
+	}
+	if c.Type != typ {
+		return nil, fmt.Errorf("%w: not an %s token", ErrBadToken, typ)
+	}
+	return c, nil
+}
+
+// Verify проверяет access токен, у пользователя заполнены только ID, Name и Permissions
+func (t *Tokens) Verify(s string) (*user.User, error) {
+	c, err := t.parse(s, tokenAccess)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := uuid.Parse(c.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad subject", ErrBadToken)
+	}
+	return &user.User{
+		ID:          uid,
+		Name:        c.Name,
+		Permissions: c.Perms,
+	}, nil
+}
+
+// Rotate гасит refresh токен и возвращает ID пользователя,
+// повторное использование того же токена - ошибка
+func (t *Tokens) Rotate(s string) (uuid.UUID, error) {
+	c, err := t.parse(s, tokenRefresh)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	uid, err := uuid.Parse(c.Subject)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: bad subject", ErrBadToken)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.refresh[c.ID]; !ok {
+		return uuid.Nil, fmt.Errorf("%w: refresh token already used", ErrBadToken)
+	}
+	delete(t.refresh, c.ID)
+	return uid, nil
+}
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+var testSecret = []byte("secret")
+
+func newHS(t *testing.T, cfg TokenConfig) *Tokens {
+	t.Helper()
+	cfg.Method = "HS256"
+	if cfg.Secret == nil {
+		cfg.Secret = testSecret
+	}
+	tk, err := NewTokens(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tk
+}
+
+// writeRSAKey пишет новый RSA ключ в PEM файл и возвращает ключ и путь
+func writeRSAKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "key.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(fn, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return key, fn
+}
+
+func testUser() user.User {
+	return user.User{ID: uuid.New(), Name: "alice", Permissions: user.PermReadUsers | user.PermUpdateUsers}
+}
+
+// signClaims подписывает произвольные claims в обход Tokens
+func signClaims(t *testing.T, m jwt.SigningMethod, key interface{}, c *Claims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(m, c).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func accessClaims(u user.User) *Claims {
+	now := time.Now()
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Subject:   u.ID.String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+		Name:  u.Name,
+		Perms: u.Permissions,
+		Type:  tokenAccess,
+	}
+}
+
+func checkBad(t *testing.T, what string, err error) {
+	t.Helper()
+	if !errors.Is(err, ErrBadToken) {
+		t.Errorf("%s returned %v, want %v", what, err, ErrBadToken)
+	}
+}
+
+func TestNewTokens(t *testing.T) {
+	if _, err := NewTokens(TokenConfig{Method: "HS256"}); err == nil {
+		t.Error("HS256 with empty secret accepted")
+	}
+	if _, err := NewTokens(TokenConfig{Method: "none", Secret: testSecret}); err == nil {
+		t.Error("unknown method accepted")
+	}
+	if _, err := NewTokens(TokenConfig{Method: "RS256", KeyFile: filepath.Join(t.TempDir(), "nokey.pem")}); err == nil {
+		t.Error("RS256 without key file accepted")
+	}
+}
+
+func TestIssueVerify(t *testing.T) {
+	_, keyFile := writeRSAKey(t)
+	for _, cfg := range []TokenConfig{
+		{Method: "HS256", Secret: testSecret, Issuer: "reguser", Audience: "api"},
+		{Method: "RS256", KeyFile: keyFile, Issuer: "reguser", Audience: "api"},
+	} {
+		t.Run(cfg.Method, func(t *testing.T) {
+			tk, err := NewTokens(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := testUser()
+			tp, err := tk.Issue(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tp.TokenType != "Bearer" || tp.ExpiresIn != int64(15*time.Minute/time.Second) {
+				t.Errorf("token pair %+v", tp)
+			}
+			got, err := tk.Verify(tp.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != u.ID || got.Name != u.Name || got.Permissions != u.Permissions {
+				t.Errorf("verified user %+v, want %+v", *got, u)
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	tk := newHS(t, TokenConfig{})
+	u := testUser()
+	tp, err := tk.Issue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid, err := tk.Rotate(tp.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != u.ID {
+		t.Errorf("rotate returned %v, want %v", uid, u.ID)
+	}
+	_, err = tk.Rotate(tp.RefreshToken)
+	checkBad(t, "second rotate", err)
+
+	// refresh токен, выданный другим экземпляром, этот не знает
+	other := newHS(t, TokenConfig{})
+	tp2, err := other.Issue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tk.Rotate(tp2.RefreshToken)
+	checkBad(t, "rotate of foreign token", err)
+}
+
+func TestTokenType(t *testing.T) {
+	tk := newHS(t, TokenConfig{})
+	tp, err := tk.Issue(testUser())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tk.Verify(tp.RefreshToken)
+	checkBad(t, "verify of refresh token", err)
+	_, err = tk.Rotate(tp.AccessToken)
+	checkBad(t, "rotate of access token", err)
+
+	// refresh токен не гасится попыткой предъявить его как access
+	if _, err := tk.Rotate(tp.RefreshToken); err != nil {
+		t.Errorf("rotate after failed verify: %v", err)
+	}
+
+	c := accessClaims(testUser())
+	c.Type = ""
+	_, err = tk.Verify(signClaims(t, jwt.SigningMethodHS256, testSecret, c))
+	checkBad(t, "verify without typ", err)
+}
+
+func TestAlgPinning(t *testing.T) {
+	key, keyFile := writeRSAKey(t)
+	hs := newHS(t, TokenConfig{})
+	rs, err := NewTokens(TokenConfig{Method: "RS256", KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := testUser()
+
+	hp, err := hs.Issue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := rs.Issue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rs.Verify(hp.AccessToken)
+	checkBad(t, "RS256 verify of HS256 token", err)
+	_, err = hs.Verify(rp.AccessToken)
+	checkBad(t, "HS256 verify of RS256 token", err)
+
+	// HS256, подписанный открытым ключом RS256 как секретом
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	_, err = rs.Verify(signClaims(t, jwt.SigningMethodHS256, pubPEM, accessClaims(u)))
+	checkBad(t, "RS256 verify of HS256 token signed with public key", err)
+
+	none := signClaims(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, accessClaims(u))
+	_, err = hs.Verify(none)
+	checkBad(t, "HS256 verify of alg none", err)
+	_, err = rs.Verify(none)
+	checkBad(t, "RS256 verify of alg none", err)
+
+	_, err = hs.Verify(signClaims(t, jwt.SigningMethodHS512, testSecret, accessClaims(u)))
+	checkBad(t, "HS256 verify of HS512 token", err)
+
+	_, err = hs.Verify(signClaims(t, jwt.SigningMethodHS256, []byte("other"), accessClaims(u)))
+	checkBad(t, "verify with wrong secret", err)
+}
+
+func TestAudienceIssuer(t *testing.T) {
+	tk := newHS(t, TokenConfig{Issuer: "reguser", Audience: "api"})
+	u := testUser()
+
+	for _, tc := range []struct {
+		name string
+		cfg  TokenConfig
+	}{
+		{"other audience", TokenConfig{Issuer: "reguser", Audience: "web"}},
+		{"no audience", TokenConfig{Issuer: "reguser"}},
+		{"other issuer", TokenConfig{Issuer: "evil", Audience: "api"}},
+		{"no issuer", TokenConfig{Audience: "api"}},
+	} {
+		tp, err := newHS(t, tc.cfg).Issue(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tk.Verify(tp.AccessToken)
+		checkBad(t, tc.name, err)
+	}
+
+	// без настроенных audience и issuer они не проверяются
+	tp, err := tk.Issue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newHS(t, TokenConfig{}).Verify(tp.AccessToken); err != nil {
+		t.Errorf("verify without audience and issuer: %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	tk := newHS(t, TokenConfig{AccessTTL: -time.Minute, RefreshTTL: -time.Minute})
+	tp, err := tk.Issue(testUser())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tk.Verify(tp.AccessToken)
+	checkBad(t, "verify of expired token", err)
+	_, err = tk.Rotate(tp.RefreshToken)
+	checkBad(t, "rotate of expired token", err)
+
+	c := accessClaims(testUser())
+	c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour))
+	_, err = newHS(t, TokenConfig{}).Verify(signClaims(t, jwt.SigningMethodHS256, testSecret, c))
+	checkBad(t, "verify of not yet valid token", err)
+}
+
+func TestBadSubject(t *testing.T) {
+	tk := newHS(t, TokenConfig{})
+	c := accessClaims(testUser())
+	c.Subject = "alice"
+	_, err := tk.Verify(signClaims(t, jwt.SigningMethodHS256, testSecret, c))
+	checkBad(t, "verify with bad subject", err)
+}
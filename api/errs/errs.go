@@ -0,0 +1,124 @@
+// Package errs - ответы с ошибками для роутеров на chi и render
+package errs
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/larikhide/reguser/api/handler"
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/go-chi/render"
+)
+
+type ErrResponse struct {
+	Err            error `json:"-"` // low-level runtime error
+	HTTPStatusCode int   `json:"-"` // http response status code
+
+	StatusText string `json:"status"`          // user-level status message
+	AppCode    int64  `json:"code,omitempty"`  // application-specific error code
+	ErrorText  string `json:"error,omitempty"` // application-level error message, for debugging
+	Field      string `json:"field,omitempty"` // conflicting field for 409
+}
+
+func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	render.Status(r, e.HTTPStatusCode)
+	return nil
+}
+
+func ErrInvalidRequest(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 400,
+		StatusText:     "Invalid request.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrInternal(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 500,
+		StatusText:     "Internal server error.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrUnauthorized(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 401,
+		StatusText:     "Unauthorized.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrForbidden(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 403,
+		StatusText:     "Forbidden.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrUserNotFound(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 404,
+		StatusText:     "User not found.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrConflict(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 409,
+		StatusText:     "Conflict.",
+		ErrorText:      err.Error(),
+		Field:          user.ConflictField(err),
+	}
+}
+
+func ErrPreconditionFailed(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 412,
+		StatusText:     "Precondition failed.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrPreconditionRequired(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 428,
+		StatusText:     "Precondition required.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrFromHandler подбирает ответ по ошибке из handler.Handlers
+func ErrFromHandler(err error) render.Renderer {
+	switch {
+	case errors.Is(err, handler.ErrBadRequest), errors.Is(err, user.ErrValidation):
+		return ErrInvalidRequest(err)
+	case errors.Is(err, handler.ErrUnauthorized):
+		return ErrUnauthorized(err)
+	case errors.Is(err, handler.ErrForbidden):
+		return ErrForbidden(err)
+	case errors.Is(err, user.ErrNotFound):
+		return ErrUserNotFound(err)
+	case errors.Is(err, user.ErrConflict):
+		return ErrConflict(err)
+	case errors.Is(err, user.ErrVersionMismatch):
+		return ErrPreconditionFailed(err)
+	case errors.Is(err, handler.ErrPreconditionRequired):
+		return ErrPreconditionRequired(err)
+	default:
+		return ErrInternal(err)
+	}
+}
+
+var ErrNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found."}
@@ -0,0 +1,32 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/larikhide/reguser/api/handler"
+	"github.com/larikhide/reguser/app/repos/user"
+)
+
+func TestErrFromHandler(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{handler.ErrBadRequest, 400},
+		{fmt.Errorf("%w: bad name", user.ErrValidation), 400},
+		{handler.ErrUnauthorized, 401},
+		{handler.ErrForbidden, 403},
+		{fmt.Errorf("error when reading: %w", user.ErrNotFound), 404},
+		{&user.ConflictError{Field: "name"}, 409},
+		{user.ErrVersionMismatch, 412},
+		{handler.ErrPreconditionRequired, 428},
+		{errors.New("disk is on fire"), 500},
+	} {
+		er := ErrFromHandler(tc.err).(*ErrResponse)
+		if er.HTTPStatusCode != tc.code {
+			t.Errorf("%v: status %d, want %d", tc.err, er.HTTPStatusCode, tc.code)
+		}
+	}
+}
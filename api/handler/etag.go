@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+// ErrPreconditionRequired - изменение без If-Match. Если If-Match не совпал
+// с версией пользователя, ошибка - user.ErrVersionMismatch.
+var ErrPreconditionRequired = errors.New("precondition required")
+
+// ETag - сильный тег версии пользователя для заголовка ETag
+func ETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// etags разбирает список тегов из If-Match или If-None-Match
+func etags(header string) []string {
+	var ret []string
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// NotModified - совпал ли If-None-Match с версией, тогда на чтение отвечают 304.
+// Теги сравниваются слабо, как требует RFC 7232.
+func NotModified(ifNoneMatch string, version int64) bool {
+	for _, t := range etags(ifNoneMatch) {
+		if t == "*" || strings.TrimPrefix(t, "W/") == ETag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersions разбирает If-Match в версии из тегов, nil для "*".
+// Пустой If-Match - ErrPreconditionRequired, слабые теги не совпадают ни с чем.
+func ifMatchVersions(ifMatch string) ([]int64, error) {
+	if ifMatch == "" {
+		return nil, fmt.Errorf("%w: If-Match is required", ErrPreconditionRequired)
+	}
+	var versions []int64
+	for _, t := range etags(ifMatch) {
+		if t == "*" {
+			return nil, nil
+		}
+		if len(t) < 2 || t[0] != '"' || t[len(t)-1] != '"' {
+			continue
+		}
+		if v, err := strconv.ParseInt(t[1:len(t)-1], 10, 64); err == nil && v > 0 {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: If-Match %s", user.ErrVersionMismatch, ifMatch)
+	}
+	return versions, nil
+}
+
+// eachVersion вызывает f с версиями из If-Match по очереди, пока f
+// возвращает user.ErrVersionMismatch, с 0 для "*". Так меняют удаленного:
+// его не прочитать, а с несовпавшей версией хранилище ничего не меняет.
+func eachVersion(ifMatch string, f func(version int64) error) error {
+	versions, err := ifMatchVersions(ifMatch)
+	if err != nil {
+		return err
+	}
+	if versions == nil {
+		return f(0)
+	}
+	for _, v := range versions {
+		if err = f(v); !errors.Is(err, user.ErrVersionMismatch) {
+			return err
+		}
+	}
+	return err
+}
+
+// ifMatchVersion переводит If-Match в версию для user.Users: 0 для "*",
+// иначе версию из тега. Если тегов несколько, подходит текущая версия
+// пользователя, если она среди них.
+func (rt *Handlers) ifMatchVersion(ctx context.Context, uid uuid.UUID, ifMatch string) (int64, error) {
+	versions, err := ifMatchVersions(ifMatch)
+	switch {
+	case err != nil:
+		return 0, err
+	case versions == nil:
+		return 0, nil
+	case len(versions) == 1:
+		return versions[0], nil
+	}
+
+	u, err := rt.us.Read(ctx, uid)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range versions {
+		if v == u.Version {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: If-Match %s", user.ErrVersionMismatch, ifMatch)
+}
@@ -2,22 +2,26 @@ package handler
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/larikhide/reguser/api/auth"
 	"github.com/larikhide/reguser/app/repos/user"
 
 	"github.com/google/uuid"
 )
 
 type Handlers struct {
-	us *user.Users
+	us     *user.Users
+	tokens *auth.Tokens
 }
 
-func NewHandlers(us *user.Users) *Handlers {
+// NewHandlers, tokens может быть nil - тогда вход по JWT выключен
+func NewHandlers(us *user.Users, tokens *auth.Tokens) *Handlers {
 	r := &Handlers{
-		us: us,
+		us:     us,
+		tokens: tokens,
 	}
 	return r
 }
@@ -27,95 +31,458 @@ type User struct {
 	Name       string    `json:"name"`
 	Data       string    `json:"data"`
 	Permission int       `json:"perms"`
+	Password   string    `json:"password,omitempty"` // только на входе
+	// время только на выходе, в UTC; у записей, сохраненных до того,
+	// как хранилище стало его помнить, created_at и updated_at нет
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Version только на выходе, то же, что в ETag
+	Version int64 `json:"version,omitempty"`
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// userFromDomain - пользователь для ответа, без хеша пароля
+func userFromDomain(u user.User) User {
+	return User{
+		ID:         u.ID,
+		Name:       u.Name,
+		Data:       u.Data,
+		Permission: u.Permissions,
+		CreatedAt:  timePtr(u.CreatedAt),
+		UpdatedAt:  timePtr(u.UpdatedAt),
+		DeletedAt:  timePtr(u.DeletedAt),
+		Version:    u.Version,
+	}
+}
+
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrForbidden  = errors.New("forbidden")
+)
+
+// checkGrant не дает выдать права, которых нет у самого пользователя
+func checkGrant(ctx context.Context, perms int) error {
+	cu, ok := auth.UserFromContext(ctx)
+	if !ok || cu.Can(user.PermAdmin) {
+		return nil
+	}
+	if perms&^cu.Permissions != 0 {
+		return fmt.Errorf("%w: can't grant permissions %b", ErrForbidden, perms&^cu.Permissions)
+	}
+	return nil
+}
+
+// checkTarget не дает менять и удалять пользователя, у которого есть права,
+// которых нет у самого пользователя, в том числе менять ему пароль
+func checkTarget(ctx context.Context, target user.User) error {
+	cu, ok := auth.UserFromContext(ctx)
+	if !ok || cu.Can(user.PermAdmin) {
+		return nil
+	}
+	if target.Permissions&^cu.Permissions != 0 {
+		return fmt.Errorf("%w: user %s has permissions %b", ErrForbidden, target.ID, target.Permissions&^cu.Permissions)
+	}
+	return nil
+}
+
+// readTarget читает пользователя uid и проверяет его через checkTarget
+func (rt *Handlers) readTarget(ctx context.Context, uid uuid.UUID) (*user.User, error) {
+	bu, err := rt.us.Read(ctx, uid)
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("error when reading: %w", err)
+	}
+	if err := checkTarget(ctx, *bu); err != nil {
+		return nil, err
+	}
+	return bu, nil
 }
 
 func (rt *Handlers) CreateUser(ctx context.Context, u User) (User, error) {
+	if err := checkGrant(ctx, u.Permission); err != nil {
+		return User{}, err
+	}
+
 	bu := user.User{
-		Name: u.Name,
-		Data: u.Data,
+		Name:        u.Name,
+		Data:        u.Data,
+		Permissions: u.Permission,
 	}
 
-	nbu, err := rt.us.Create(ctx, bu)
+	nbu, err := rt.us.Create(ctx, bu, u.Password)
 	if err != nil {
 		return User{}, fmt.Errorf("error when creating: %w", err)
 	}
 
-	return User{
-		ID:         nbu.ID,
-		Name:       nbu.Name,
-		Data:       nbu.Data,
-		Permission: nbu.Permissions,
-	}, nil
+	return userFromDomain(*nbu), nil
 }
 
-var ErrUserNotFound = errors.New("user not found")
+// ErrUserNotFound оставлен для совместимости, это user.ErrNotFound
+var ErrUserNotFound = user.ErrNotFound
 
 // read?uid=...
 func (rt *Handlers) ReadUser(ctx context.Context, uid uuid.UUID) (User, error) {
 	if (uid == uuid.UUID{}) {
-		return User{}, fmt.Errorf("bad request: uid is empty")
+		return User{}, fmt.Errorf("%w: uid is empty", ErrBadRequest)
 	}
 
 	nbu, err := rt.us.Read(ctx, uid)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, user.ErrNotFound) {
 			return User{}, ErrUserNotFound
 		}
 		return User{}, fmt.Errorf("error when reading: %w", err)
 	}
 
-	return User{
-		ID:         nbu.ID,
-		Name:       nbu.Name,
-		Data:       nbu.Data,
-		Permission: nbu.Permissions,
-	}, nil
+	return userFromDomain(*nbu), nil
+}
+
+// UserPatch содержит только изменяемые поля, nil - оставить как есть
+type UserPatch struct {
+	Name       *string `json:"name,omitempty"`
+	Data       *string `json:"data,omitempty"`
+	Permission *int    `json:"perms,omitempty"`
+	Password   *string `json:"password,omitempty"`
+}
+
+// update/uid, меняет только версию из ifMatch, без него - ErrPreconditionRequired;
+// менять можно только пользователя с правами не шире своих. С ifMatch "*"
+// меняется прочитанная для проверки прав версия, а не та, что окажется следующей.
+func (rt *Handlers) UpdateUser(ctx context.Context, uid uuid.UUID, u User, ifMatch string) (User, error) {
+	if (uid == uuid.UUID{}) {
+		return User{}, fmt.Errorf("%w: uid is empty", ErrBadRequest)
+	}
+	if err := checkGrant(ctx, u.Permission); err != nil {
+		return User{}, err
+	}
+	target, err := rt.readTarget(ctx, uid)
+	if err != nil {
+		return User{}, err
+	}
+	version, err := rt.ifMatchVersion(ctx, uid, ifMatch)
+	if err != nil {
+		return User{}, err
+	}
+	if version == 0 {
+		version = target.Version
+	}
+
+	bu := user.User{
+		ID:          uid,
+		Name:        u.Name,
+		Data:        u.Data,
+		Permissions: u.Permission,
+		Version:     version,
+	}
+
+	nbu, err := rt.us.Update(ctx, bu, u.Password)
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			return User{}, ErrUserNotFound
+		}
+		return User{}, fmt.Errorf("error when updating: %w", err)
+	}
+
+	return userFromDomain(*nbu), nil
 }
 
-func (rt *Handlers) DeleteUser(ctx context.Context, uid uuid.UUID) (User, error) {
+// PatchUser меняет только прочитанную версию пользователя,
+// ifMatch должен с ней совпасть, без него - ErrPreconditionRequired
+func (rt *Handlers) PatchUser(ctx context.Context, uid uuid.UUID, p UserPatch, ifMatch string) (User, error) {
 	if (uid == uuid.UUID{}) {
-		return User{}, fmt.Errorf("bad request: uid is empty")
+		return User{}, fmt.Errorf("%w: uid is empty", ErrBadRequest)
+	}
+
+	bu, err := rt.readTarget(ctx, uid)
+	if err != nil {
+		return User{}, err
+	}
+	version, err := rt.ifMatchVersion(ctx, uid, ifMatch)
+	if err != nil {
+		return User{}, err
+	}
+	if version != 0 && version != bu.Version {
+		return User{}, fmt.Errorf("%w: If-Match %s", user.ErrVersionMismatch, ifMatch)
 	}
 
-	nbu, err := rt.us.Delete(ctx, uid)
+	if p.Name != nil {
+		bu.Name = *p.Name
+	}
+	if p.Data != nil {
+		bu.Data = *p.Data
+	}
+	if p.Permission != nil {
+		if err := checkGrant(ctx, *p.Permission); err != nil {
+			return User{}, err
+		}
+		bu.Permissions = *p.Permission
+	}
+	password := ""
+	if p.Password != nil {
+		password = *p.Password
+	}
+
+	nbu, err := rt.us.Update(ctx, *bu, password)
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			return User{}, ErrUserNotFound
+		}
+		return User{}, fmt.Errorf("error when updating: %w", err)
+	}
+
+	return userFromDomain(*nbu), nil
+}
+
+// delete/uid, удаляет только версию из ifMatch, без него - ErrPreconditionRequired,
+// с "*" - прочитанную для проверки прав. Возвращает пользователя с версией
+// надгробия, по ней его можно вернуть или стереть.
+func (rt *Handlers) DeleteUser(ctx context.Context, uid uuid.UUID, ifMatch string) (User, error) {
+	if (uid == uuid.UUID{}) {
+		return User{}, fmt.Errorf("%w: uid is empty", ErrBadRequest)
+	}
+	if ifMatch == "" {
+		return User{}, fmt.Errorf("%w: If-Match is required", ErrPreconditionRequired)
+	}
+	target, err := rt.readTarget(ctx, uid)
+	if err != nil {
+		return User{}, err
+	}
+	version, err := rt.ifMatchVersion(ctx, uid, ifMatch)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, user.ErrNotFound) {
+			return User{}, ErrUserNotFound
+		}
+		return User{}, err
+	}
+	if version == 0 {
+		version = target.Version
+	}
+
+	nbu, err := rt.us.Delete(ctx, uid, version)
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) {
 			return User{}, ErrUserNotFound
 		}
 		return User{}, fmt.Errorf("error when reading: %w", err)
 	}
 
-	return User{
-		ID:         nbu.ID,
-		Name:       nbu.Name,
-		Data:       nbu.Data,
-		Permission: nbu.Permissions,
-	}, nil
+	return userFromDomain(*nbu), nil
+}
+
+// Authenticate и VerifyToken нужны для auth.AuthMiddleware
+func (rt *Handlers) Authenticate(ctx context.Context, name, password string) (*user.User, error) {
+	return rt.us.Authenticate(ctx, name, password)
+}
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+var errTokensDisabled = fmt.Errorf("%w: tokens disabled", ErrUnauthorized)
+
+func (rt *Handlers) VerifyToken(ctx context.Context, token string) (*user.User, error) {
+	if rt.tokens == nil {
+		return nil, errTokensDisabled
+	}
+	return rt.tokens.Verify(token)
+}
+
+type LoginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
-// /search?q=...
-func (rt *Handlers) SearchUser(ctx context.Context, q string, f func(User) error) error {
-	ch, err := rt.us.SearchUsers(ctx, q)
+// /login
+func (rt *Handlers) Login(ctx context.Context, lr LoginRequest) (auth.TokenPair, error) {
+	if rt.tokens == nil {
+		return auth.TokenPair{}, errTokensDisabled
+	}
+	u, err := rt.us.Authenticate(ctx, lr.Name, lr.Password)
+	if err != nil {
+		if errors.Is(err, user.ErrBadCredentials) {
+			return auth.TokenPair{}, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		}
+		return auth.TokenPair{}, fmt.Errorf("error when login: %w", err)
+	}
+	return rt.tokens.Issue(*u)
+}
+
+// /refresh, старый refresh токен больше не действует
+func (rt *Handlers) RefreshToken(ctx context.Context, rr RefreshRequest) (auth.TokenPair, error) {
+	if rt.tokens == nil {
+		return auth.TokenPair{}, errTokensDisabled
+	}
+	uid, err := rt.tokens.Rotate(rr.RefreshToken)
+	if err != nil {
+		return auth.TokenPair{}, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	// права могли поменяться, берем пользователя из хранилища
+	u, err := rt.us.Read(ctx, uid)
 	if err != nil {
+		if errors.Is(err, user.ErrNotFound) {
+			return auth.TokenPair{}, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		}
+		return auth.TokenPair{}, fmt.Errorf("error when reading: %w", err)
+	}
+	return rt.tokens.Issue(*u)
+}
+
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// /users?limit=...&cursor=...
+func (rt *Handlers) ListUsers(ctx context.Context, cursor string, limit int) (UserPage, error) {
+	uu, next, err := rt.us.List(ctx, cursor, limit)
+	if err != nil {
+		if errors.Is(err, user.ErrBadCursor) {
+			return UserPage{}, fmt.Errorf("%w: %v", ErrBadRequest, err)
+		}
+		return UserPage{}, fmt.Errorf("error when listing: %w", err)
+	}
+
+	up := UserPage{
+		Users:      make([]User, 0, len(uu)),
+		NextCursor: next,
+	}
+	for _, u := range uu {
+		up.Users = append(up.Users, userFromDomain(u))
+	}
+	return up, nil
+}
+
+// /search/{q}?mode=prefix|substring|fuzzy|fulltext, пустой mode - prefix
+func (rt *Handlers) SearchUser(ctx context.Context, q, mode string, f func(User) error) error {
+	return rt.searchUsers(ctx, user.Query{Name: q, Mode: user.SearchMode(mode)}, f)
+}
+
+// TimeRange - интервал [from, to), пустая граница не ограничивает
+type TimeRange struct {
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+}
+
+func (tr *TimeRange) query() user.TimeRange {
+	ret := user.TimeRange{}
+	if tr == nil {
+		return ret
+	}
+	if tr.From != nil {
+		ret.From = *tr.From
+	}
+	if tr.To != nil {
+		ret.To = *tr.To
+	}
+	return ret
+}
+
+// UserQuery - тело /users/query, пустые поля не ограничивают
+type UserQuery struct {
+	Name           string     `json:"name,omitempty"`
+	Mode           string     `json:"mode,omitempty"`
+	PermsAll       int        `json:"perms_all,omitempty"`
+	PermsAny       int        `json:"perms_any,omitempty"`
+	PermsNone      int        `json:"perms_none,omitempty"`
+	Created        *TimeRange `json:"created,omitempty"`
+	Updated        *TimeRange `json:"updated,omitempty"`
+	Deleted        *TimeRange `json:"deleted,omitempty"`
+	IncludeDeleted bool       `json:"include_deleted,omitempty"`
+	Sort           string     `json:"sort,omitempty"`
+	Limit          int        `json:"limit,omitempty"`
+}
+
+// /users/query, удаленных видит только администратор
+func (rt *Handlers) QueryUsers(ctx context.Context, uq UserQuery, f func(User) error) error {
+	q := user.Query{
+		Name:           uq.Name,
+		Mode:           user.SearchMode(uq.Mode),
+		PermsAll:       uq.PermsAll,
+		PermsAny:       uq.PermsAny,
+		PermsNone:      uq.PermsNone,
+		Created:        uq.Created.query(),
+		Updated:        uq.Updated.query(),
+		Deleted:        uq.Deleted.query(),
+		IncludeDeleted: uq.IncludeDeleted,
+		Sort:           user.QuerySort(uq.Sort),
+		Limit:          uq.Limit,
+	}
+	if cu, ok := auth.UserFromContext(ctx); ok && q.WithDeleted() && !cu.Can(user.PermAdmin) {
+		return fmt.Errorf("%w: only admin can query deleted users", ErrForbidden)
+	}
+	return rt.searchUsers(ctx, q, f)
+}
+
+func (rt *Handlers) searchUsers(ctx context.Context, q user.Query, f func(User) error) error {
+	var ferr error
+	err := rt.us.SearchUsers(ctx, q, func(u user.User) error {
+		ferr = f(userFromDomain(u))
+		return ferr
+	})
+	switch {
+	case err == nil, ferr != nil:
+		return err
+	case errors.Is(err, user.ErrBadQuery):
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	default:
 		return fmt.Errorf("error when reading: %w", err)
 	}
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case u, ok := <-ch:
-			if !ok {
-				return nil
-			}
-			if err := f(User{
-				ID:         u.ID,
-				Name:       u.Name,
-				Data:       u.Data,
-				Permission: u.Permissions,
-			}); err != nil {
-				return err
-			}
+// /admin/compact
+func (rt *Handlers) Compact(ctx context.Context) error {
+	if err := rt.us.Compact(ctx); err != nil {
+		if errors.Is(err, user.ErrNotSupported) {
+			return fmt.Errorf("%w: %v", ErrBadRequest, err)
 		}
+		return fmt.Errorf("error when compacting: %w", err)
+	}
+	return nil
+}
+
+// /admin/restore/{id}, возвращает только версию удаленного из ifMatch,
+// без него - ErrPreconditionRequired
+func (rt *Handlers) RestoreUser(ctx context.Context, uid uuid.UUID, ifMatch string) (User, error) {
+	if (uid == uuid.UUID{}) {
+		return User{}, fmt.Errorf("%w: uid is empty", ErrBadRequest)
+	}
+
+	var nbu *user.User
+	err := eachVersion(ifMatch, func(version int64) error {
+		var err error
+		nbu, err = rt.us.Restore(ctx, uid, version)
+		return err
+	})
+	if err != nil {
+		return User{}, fmt.Errorf("error when restoring: %w", err)
+	}
+
+	return userFromDomain(*nbu), nil
+}
+
+// /admin/purge/{id}, стирает только версию удаленного из ifMatch,
+// без него - ErrPreconditionRequired
+func (rt *Handlers) PurgeUser(ctx context.Context, uid uuid.UUID, ifMatch string) error {
+	if (uid == uuid.UUID{}) {
+		return fmt.Errorf("%w: uid is empty", ErrBadRequest)
+	}
+	err := eachVersion(ifMatch, func(version int64) error {
+		return rt.us.Purge(ctx, uid, version)
+	})
+	if err != nil {
+		return fmt.Errorf("error when purging: %w", err)
 	}
+	return nil
 }
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/larikhide/reguser/api/auth"
+	"github.com/larikhide/reguser/app/repos/user"
+	"github.com/larikhide/reguser/db/mem/usermemstore"
+
+	"github.com/google/uuid"
+)
+
+func TestTargetPermissions(t *testing.T) {
+	ctx := context.Background()
+	rt := NewHandlers(user.NewUsers(usermemstore.NewUsers()), nil)
+
+	admin, err := rt.CreateUser(ctx, User{Name: "admin", Permission: user.PermAdmin, Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := rt.CreateUser(ctx, User{Name: "plain", Permission: user.PermReadUsers, Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller := user.User{Name: "editor", Permissions: user.PermReadUsers | user.PermUpdateUsers | user.PermDeleteUsers}
+	cctx := auth.WithUser(ctx, caller)
+
+	pw := "new"
+	noPerms := 0
+	_, err = rt.PatchUser(cctx, admin.ID, UserPatch{Password: &pw}, ETag(admin.Version))
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("patch password of admin returned %v, want %v", err, ErrForbidden)
+	}
+	_, err = rt.PatchUser(cctx, admin.ID, UserPatch{Permission: &noPerms}, ETag(admin.Version))
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("patch perms of admin returned %v, want %v", err, ErrForbidden)
+	}
+	_, err = rt.UpdateUser(cctx, admin.ID, User{Name: "admin", Password: pw}, ETag(admin.Version))
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("update of admin returned %v, want %v", err, ErrForbidden)
+	}
+	_, err = rt.DeleteUser(cctx, admin.ID, ETag(admin.Version))
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("delete of admin returned %v, want %v", err, ErrForbidden)
+	}
+	if _, err := rt.us.Authenticate(ctx, "admin", "pw"); err != nil {
+		t.Errorf("admin password changed: %v", err)
+	}
+
+	// права цели - подмножество прав вызывающего
+	if _, err := rt.PatchUser(cctx, plain.ID, UserPatch{Password: &pw}, ETag(plain.Version)); err != nil {
+		t.Errorf("patch of plain user error: %v", err)
+	}
+	// администратору можно все
+	actx := auth.WithUser(ctx, user.User{Name: "root", Permissions: user.PermAdmin})
+	if _, err := rt.PatchUser(actx, admin.ID, UserPatch{Password: &pw}, ETag(admin.Version)); err != nil {
+		t.Errorf("patch by admin error: %v", err)
+	}
+}
+
+func TestIfMatchRequired(t *testing.T) {
+	ctx := context.Background()
+	rt := NewHandlers(user.NewUsers(usermemstore.NewUsers()), nil)
+	u, err := rt.CreateUser(ctx, User{Name: "kate", Permission: user.PermReadUsers})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := "new"
+	if _, err := rt.UpdateUser(ctx, u.ID, User{Name: "kate"}, ""); !errors.Is(err, ErrPreconditionRequired) {
+		t.Errorf("update without If-Match returned %v, want %v", err, ErrPreconditionRequired)
+	}
+	if _, err := rt.PatchUser(ctx, u.ID, UserPatch{Data: &data}, ""); !errors.Is(err, ErrPreconditionRequired) {
+		t.Errorf("patch without If-Match returned %v, want %v", err, ErrPreconditionRequired)
+	}
+	if _, err := rt.DeleteUser(ctx, u.ID, ""); !errors.Is(err, ErrPreconditionRequired) {
+		t.Errorf("delete without If-Match returned %v, want %v", err, ErrPreconditionRequired)
+	}
+	if _, err := rt.ReadUser(ctx, u.ID); err != nil {
+		t.Fatalf("user changed without If-Match: %v", err)
+	}
+
+	du, err := rt.DeleteUser(ctx, u.ID, ETag(u.Version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// удаление отдает версию надгробия, по ней удаленного возвращают
+	deleted := du.Version
+	if deleted != u.Version+1 {
+		t.Errorf("delete returned version %d, want %d", deleted, u.Version+1)
+	}
+	if _, err := rt.RestoreUser(ctx, u.ID, ""); !errors.Is(err, ErrPreconditionRequired) {
+		t.Errorf("restore without If-Match returned %v, want %v", err, ErrPreconditionRequired)
+	}
+	if _, err := rt.RestoreUser(ctx, u.ID, ETag(u.Version)); !errors.Is(err, user.ErrVersionMismatch) {
+		t.Errorf("restore with stale If-Match returned %v, want %v", err, user.ErrVersionMismatch)
+	}
+	ru, err := rt.RestoreUser(ctx, u.ID, ETag(u.Version)+", "+ETag(deleted))
+	if err != nil {
+		t.Fatalf("restore with current version among If-Match error: %v", err)
+	}
+	if ru.Version != deleted+1 {
+		t.Errorf("restored version %d, want %d", ru.Version, deleted+1)
+	}
+}
+
+func TestPurgeIfMatch(t *testing.T) {
+	ctx := context.Background()
+	rt := NewHandlers(user.NewUsers(usermemstore.NewUsers()), nil)
+	u, err := rt.CreateUser(ctx, User{Name: "kate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	du, err := rt.DeleteUser(ctx, u.ID, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.PurgeUser(ctx, u.ID, ""); !errors.Is(err, ErrPreconditionRequired) {
+		t.Errorf("purge without If-Match returned %v, want %v", err, ErrPreconditionRequired)
+	}
+	if err := rt.PurgeUser(ctx, u.ID, ETag(u.Version)); !errors.Is(err, user.ErrVersionMismatch) {
+		t.Errorf("purge with stale If-Match returned %v, want %v", err, user.ErrVersionMismatch)
+	}
+	if err := rt.PurgeUser(ctx, u.ID, ETag(du.Version)); err != nil {
+		t.Fatalf("purge with version from delete error: %v", err)
+	}
+	if _, err := rt.RestoreUser(ctx, u.ID, "*"); !errors.Is(err, user.ErrNotFound) {
+		t.Errorf("restore of purged returned %v, want %v", err, user.ErrNotFound)
+	}
+}
+
+// promoteStore дает администраторские права пользователю target после
+// первого чтения, как будто его повысили между проверкой прав и записью
+type promoteStore struct {
+	user.UserStore
+	target   uuid.UUID
+	promoted bool
+}
+
+func (ps *promoteStore) Read(ctx context.Context, uid uuid.UUID) (*user.User, error) {
+	u, err := ps.UserStore.Read(ctx, uid)
+	if err != nil || uid != ps.target || ps.promoted {
+		return u, err
+	}
+	ps.promoted = true
+	pu := *u
+	pu.Permissions = user.PermAdmin
+	pu.Version = 0
+	if err := ps.UserStore.Update(ctx, pu); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// TestIfMatchAnyTarget - с If-Match "*" меняется только та версия,
+// права которой проверены
+func TestIfMatchAnyTarget(t *testing.T) {
+	ctx := context.Background()
+	caller := user.User{Name: "editor", Permissions: user.PermReadUsers | user.PermUpdateUsers | user.PermDeleteUsers}
+	cctx := auth.WithUser(ctx, caller)
+	pw := "new"
+
+	for _, c := range []struct {
+		name string
+		do   func(rt *Handlers, id uuid.UUID) error
+	}{
+		{"update", func(rt *Handlers, id uuid.UUID) error {
+			_, err := rt.UpdateUser(cctx, id, User{Name: "plain", Password: pw}, "*")
+			return err
+		}},
+		{"patch", func(rt *Handlers, id uuid.UUID) error {
+			_, err := rt.PatchUser(cctx, id, UserPatch{Password: &pw}, "*")
+			return err
+		}},
+		{"delete", func(rt *Handlers, id uuid.UUID) error {
+			_, err := rt.DeleteUser(cctx, id, "*")
+			return err
+		}},
+	} {
+		ps := &promoteStore{UserStore: usermemstore.NewUsers()}
+		rt := NewHandlers(user.NewUsers(ps), nil)
+		u, err := rt.CreateUser(ctx, User{Name: "plain", Permission: user.PermReadUsers, Password: "pw"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps.target = u.ID
+
+		if err := c.do(rt, u.ID); !errors.Is(err, user.ErrVersionMismatch) {
+			t.Errorf("%s of promoted user returned %v, want %v", c.name, err, user.ErrVersionMismatch)
+		}
+		if _, err := rt.us.Authenticate(ctx, "plain", "pw"); err != nil {
+			t.Errorf("%s changed promoted user: %v", c.name, err)
+		}
+	}
+}
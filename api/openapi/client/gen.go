@@ -0,0 +1,3 @@
+//go:generate oapi-codegen -generate client,types -package client -o ./client.go ../api.oapi3.yaml
+
+package client
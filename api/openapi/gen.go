@@ -1,3 +1,3 @@
-//go:generate oapi-codegen -generate chi-server,spec -package openapi -o ./openapi.go ./api.oapi3.yaml
+//go:generate oapi-codegen -generate types,chi-server,spec -package openapi -o ./openapi.go ./api.oapi3.yaml
 
 package openapi
@@ -1,6 +1,6 @@
 // Package openapi provides primitives to interact with the openapi HTTP API.
 //
-// Code generated by github.com/deepmap/oapi-codegen version v1.8.3 DO NOT EDIT.
+// Code generated by github.com/deepmap/oapi-codegen version v1.9.0 DO NOT EDIT.
 package openapi
 
 import (
@@ -12,36 +12,495 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/deepmap/oapi-codegen/pkg/runtime"
 	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/go-chi/chi/v5"
 )
 
+// Defines values for ErrorField.
+const (
+	ErrorFieldId ErrorField = "id"
+
+	ErrorFieldName ErrorField = "name"
+)
+
+// Defines values for UserQueryMode.
+const (
+	UserQueryModeFulltext UserQueryMode = "fulltext"
+
+	UserQueryModeFuzzy UserQueryMode = "fuzzy"
+
+	UserQueryModePrefix UserQueryMode = "prefix"
+
+	UserQueryModeSubstring UserQueryMode = "substring"
+)
+
+// Defines values for UserQuerySort.
+const (
+	UserQuerySortCreatedAt UserQuerySort = "created_at"
+
+	UserQuerySortCreatedAt1 UserQuerySort = "-created_at"
+
+	UserQuerySortName UserQuerySort = "name"
+
+	UserQuerySortName1 UserQuerySort = "-name"
+
+	UserQuerySortUpdatedAt UserQuerySort = "updated_at"
+
+	UserQuerySortUpdatedAt1 UserQuerySort = "-updated_at"
+)
+
+// CreateUserRequest defines model for CreateUserRequest.
+type CreateUserRequest struct {
+	Data *string `json:"data,omitempty"`
+	Name string  `json:"name"`
+
+	// bcrypt uses at most 72 bytes
+	Password *string `json:"password,omitempty"`
+	Perms    *int    `json:"perms,omitempty"`
+}
+
+// Error defines model for Error.
+type Error struct {
+	// application-specific error code
+	Code *int64 `json:"code,omitempty"`
+
+	// application-level error message
+	Error *string `json:"error,omitempty"`
+
+	// the field whose value is taken, for 409
+	Field *ErrorField `json:"field,omitempty"`
+
+	// user-level status message
+	Status string `json:"status"`
+}
+
+// the field whose value is taken, for 409
+type ErrorField string
+
+// LoginRequest defines model for LoginRequest.
+type LoginRequest struct {
+	Name string `json:"name"`
+
+	// bcrypt uses at most 72 bytes
+	Password string `json:"password"`
+}
+
+// PatchUserRequest defines model for PatchUserRequest.
+type PatchUserRequest struct {
+	Data *string `json:"data,omitempty"`
+	Name *string `json:"name,omitempty"`
+
+	// bcrypt uses at most 72 bytes
+	Password *string `json:"password,omitempty"`
+	Perms    *int    `json:"perms,omitempty"`
+}
+
+// RefreshRequest defines model for RefreshRequest.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// the last item of a search result that failed midway
+type SearchError struct {
+	Error string `json:"error"`
+}
+
+// interval [from, to), a missing bound is open
+type TimeRange struct {
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+}
+
+// TokenPair defines model for TokenPair.
+type TokenPair struct {
+	AccessToken string `json:"access_token"`
+
+	// access token lifetime in seconds
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+}
+
+// User defines model for User.
+type User struct {
+	// RFC 3339 in UTC, missing for users stored before timestamps were kept
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	Data      string     `json:"data"`
+
+	// RFC 3339 in UTC, only for deleted users
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+
+	// permission bits, 1 read, 2 create, 4 update, 8 delete, 16 admin; at most 15 bits, the postgres store keeps them in int2
+	Perms int `json:"perms"`
+
+	// RFC 3339 in UTC, missing for users stored before timestamps were kept
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+
+	// grows with every change of the user, the same as in ETag
+	Version *int64 `json:"version,omitempty"`
+}
+
+// UserPage defines model for UserPage.
+type UserPage struct {
+	// empty on the last page
+	NextCursor *string `json:"next_cursor,omitempty"`
+	Users      []User  `json:"users"`
+}
+
+// all fields are optional, an empty query matches every live user;
+// deleted selects only users deleted in that interval
+type UserQuery struct {
+	// interval [from, to), a missing bound is open
+	Created *TimeRange `json:"created,omitempty"`
+
+	// interval [from, to), a missing bound is open
+	Deleted        *TimeRange `json:"deleted,omitempty"`
+	IncludeDeleted *bool      `json:"include_deleted,omitempty"`
+
+	// 0 or missing is no limit
+	Limit *int `json:"limit,omitempty"`
+
+	// same as the mode of /search/{q}
+	Mode *UserQueryMode `json:"mode,omitempty"`
+
+	// compared with users by the mode rules
+	Name *string `json:"name,omitempty"`
+
+	// user has all these permission bits
+	PermsAll *int `json:"perms_all,omitempty"`
+
+	// user has at least one of these permission bits
+	PermsAny *int `json:"perms_any,omitempty"`
+
+	// user has none of these permission bits
+	PermsNone *int `json:"perms_none,omitempty"`
+
+	// if empty, by name (bytewise) in prefix mode, by relevance then created_at in fuzzy and fulltext modes, by created_at otherwise; ties by id
+	Sort *UserQuerySort `json:"sort,omitempty"`
+
+	// interval [from, to), a missing bound is open
+	Updated *TimeRange `json:"updated,omitempty"`
+}
+
+// same as the mode of /search/{q}
+type UserQueryMode string
+
+// if empty, by name (bytewise) in prefix mode, by relevance then created_at in fuzzy and fulltext modes, by created_at otherwise; ties by id
+type UserQuerySort string
+
+// IfMatch defines model for IfMatch.
+type IfMatch string
+
+// IfNoneMatch defines model for IfNoneMatch.
+type IfNoneMatch string
+
+// UserID defines model for UserID.
+type UserID string
+
+// BadRequest defines model for BadRequest.
+type BadRequest Error
+
+// Conflict defines model for Conflict.
+type Conflict Error
+
+// Forbidden defines model for Forbidden.
+type Forbidden Error
+
+// InternalError defines model for InternalError.
+type InternalError Error
+
+// NotFound defines model for NotFound.
+type NotFound Error
+
+// PreconditionFailed defines model for PreconditionFailed.
+type PreconditionFailed Error
+
+// PreconditionRequired defines model for PreconditionRequired.
+type PreconditionRequired Error
+
+// Unauthorized defines model for Unauthorized.
+type Unauthorized Error
+
+// PurgeUserParams defines parameters for PurgeUser.
+type PurgeUserParams struct {
+	// ETag of the user version the change is based on, or *;
+	// required to update, delete, restore and purge; for a deleted user
+	// it is the ETag of the delete response or the version found
+	// by a query with include_deleted
+	IfMatch *IfMatch `json:"If-Match,omitempty"`
+}
+
+// RestoreUserParams defines parameters for RestoreUser.
+type RestoreUserParams struct {
+	// ETag of the user version the change is based on, or *;
+	// required to update, delete, restore and purge; for a deleted user
+	// it is the ETag of the delete response or the version found
+	// by a query with include_deleted
+	IfMatch *IfMatch `json:"If-Match,omitempty"`
+}
+
+// PostCreateJSONBody defines parameters for PostCreate.
+type PostCreateJSONBody CreateUserRequest
+
+// DeleteDeleteIdParams defines parameters for DeleteDeleteId.
+type DeleteDeleteIdParams struct {
+	// ETag of the user version the change is based on, or *;
+	// required to update, delete, restore and purge; for a deleted user
+	// it is the ETag of the delete response or the version found
+	// by a query with include_deleted
+	IfMatch *IfMatch `json:"If-Match,omitempty"`
+}
+
+// LoginJSONBody defines parameters for Login.
+type LoginJSONBody LoginRequest
+
+// GetReadIdParams defines parameters for GetReadId.
+type GetReadIdParams struct {
+	// ETag the client already has
+	IfNoneMatch *IfNoneMatch `json:"If-None-Match,omitempty"`
+}
+
+// RefreshTokenJSONBody defines parameters for RefreshToken.
+type RefreshTokenJSONBody RefreshRequest
+
+// FindUsersParams defines parameters for FindUsers.
+type FindUsersParams struct {
+	// prefix - name starts with q, case sensitive (default);
+	// substring - name or data contains q, ignoring case and accents;
+	// fuzzy - name is similar to q by trigrams, best matches first;
+	// fulltext - every word of q is in the name or data, best matches first
+	Mode *FindUsersParamsMode `json:"mode,omitempty"`
+}
+
+// FindUsersParamsMode defines parameters for FindUsers.
+type FindUsersParamsMode string
+
+// PatchUpdateIdJSONBody defines parameters for PatchUpdateId.
+type PatchUpdateIdJSONBody PatchUserRequest
+
+// PatchUpdateIdParams defines parameters for PatchUpdateId.
+type PatchUpdateIdParams struct {
+	// ETag of the user version the change is based on, or *;
+	// required to update, delete, restore and purge; for a deleted user
+	// it is the ETag of the delete response or the version found
+	// by a query with include_deleted
+	IfMatch *IfMatch `json:"If-Match,omitempty"`
+}
+
+// PutUpdateIdJSONBody defines parameters for PutUpdateId.
+type PutUpdateIdJSONBody CreateUserRequest
+
+// PutUpdateIdParams defines parameters for PutUpdateId.
+type PutUpdateIdParams struct {
+	// ETag of the user version the change is based on, or *;
+	// required to update, delete, restore and purge; for a deleted user
+	// it is the ETag of the delete response or the version found
+	// by a query with include_deleted
+	IfMatch *IfMatch `json:"If-Match,omitempty"`
+}
+
+// ListUsersParams defines parameters for ListUsers.
+type ListUsersParams struct {
+	// page size, 50 by default, 1000 max
+	Limit *int `json:"limit,omitempty"`
+
+	// next_cursor from the previous page
+	Cursor *string `json:"cursor,omitempty"`
+}
+
+// QueryUsersJSONBody defines parameters for QueryUsers.
+type QueryUsersJSONBody UserQuery
+
+// PostCreateJSONRequestBody defines body for PostCreate for application/json ContentType.
+type PostCreateJSONRequestBody PostCreateJSONBody
+
+// LoginJSONRequestBody defines body for Login for application/json ContentType.
+type LoginJSONRequestBody LoginJSONBody
+
+// RefreshTokenJSONRequestBody defines body for RefreshToken for application/json ContentType.
+type RefreshTokenJSONRequestBody RefreshTokenJSONBody
+
+// PatchUpdateIdJSONRequestBody defines body for PatchUpdateId for application/json ContentType.
+type PatchUpdateIdJSONRequestBody PatchUpdateIdJSONBody
+
+// PutUpdateIdJSONRequestBody defines body for PutUpdateId for application/json ContentType.
+type PutUpdateIdJSONRequestBody PutUpdateIdJSONBody
+
+// QueryUsersJSONRequestBody defines body for QueryUsers for application/json ContentType.
+type QueryUsersJSONRequestBody QueryUsersJSONBody
+
 // ServerInterface represents all server handlers.
 type ServerInterface interface {
+	// Compact storage
+	// (POST /admin/compact)
+	Compact(w http.ResponseWriter, r *http.Request)
+	// Purge user
+	// (DELETE /admin/purge/{id})
+	PurgeUser(w http.ResponseWriter, r *http.Request, id UserID, params PurgeUserParams)
+	// Restore user
+	// (POST /admin/restore/{id})
+	RestoreUser(w http.ResponseWriter, r *http.Request, id UserID, params RestoreUserParams)
 	// Create user
 	// (POST /create)
 	PostCreate(w http.ResponseWriter, r *http.Request)
 	// Delete user
 	// (DELETE /delete/{id})
-	DeleteDeleteId(w http.ResponseWriter, r *http.Request, id string)
+	DeleteDeleteId(w http.ResponseWriter, r *http.Request, id UserID, params DeleteDeleteIdParams)
+	// Login
+	// (POST /login)
+	Login(w http.ResponseWriter, r *http.Request)
 	// Get user
 	// (GET /read/{id})
-	GetReadId(w http.ResponseWriter, r *http.Request, id string)
+	GetReadId(w http.ResponseWriter, r *http.Request, id UserID, params GetReadIdParams)
+	// Refresh tokens
+	// (POST /refresh)
+	RefreshToken(w http.ResponseWriter, r *http.Request)
 	// Search user
 	// (GET /search/{q})
-	FindUsers(w http.ResponseWriter, r *http.Request, q string)
+	FindUsers(w http.ResponseWriter, r *http.Request, q string, params FindUsersParams)
+	// Patch user
+	// (PATCH /update/{id})
+	PatchUpdateId(w http.ResponseWriter, r *http.Request, id UserID, params PatchUpdateIdParams)
+	// Update user
+	// (PUT /update/{id})
+	PutUpdateId(w http.ResponseWriter, r *http.Request, id UserID, params PutUpdateIdParams)
+	// List users
+	// (GET /users)
+	ListUsers(w http.ResponseWriter, r *http.Request, params ListUsersParams)
+	// Query users
+	// (POST /users/query)
+	QueryUsers(w http.ResponseWriter, r *http.Request)
 }
 
 // ServerInterfaceWrapper converts contexts to parameters.
 type ServerInterfaceWrapper struct {
 	Handler            ServerInterface
 	HandlerMiddlewares []MiddlewareFunc
+	ErrorHandlerFunc   func(w http.ResponseWriter, r *http.Request, err error)
 }
 
 type MiddlewareFunc func(http.HandlerFunc) http.HandlerFunc
 
+// Compact operation middleware
+func (siw *ServerInterfaceWrapper) Compact(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.Compact(w, r)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
+// PurgeUser operation middleware
+func (siw *ServerInterfaceWrapper) PurgeUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id UserID
+
+	err = runtime.BindStyledParameter("simple", false, "id", chi.URLParam(r, "id"), &id)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params PurgeUserParams
+
+	headers := r.Header
+
+	// ------------- Optional header parameter "If-Match" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("If-Match")]; found {
+		var IfMatch IfMatch
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "If-Match", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "If-Match", runtime.ParamLocationHeader, valueList[0], &IfMatch)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "If-Match", Err: err})
+			return
+		}
+
+		params.IfMatch = &IfMatch
+
+	}
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PurgeUser(w, r, id, params)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
+// RestoreUser operation middleware
+func (siw *ServerInterfaceWrapper) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id UserID
+
+	err = runtime.BindStyledParameter("simple", false, "id", chi.URLParam(r, "id"), &id)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params RestoreUserParams
+
+	headers := r.Header
+
+	// ------------- Optional header parameter "If-Match" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("If-Match")]; found {
+		var IfMatch IfMatch
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "If-Match", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "If-Match", runtime.ParamLocationHeader, valueList[0], &IfMatch)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "If-Match", Err: err})
+			return
+		}
+
+		params.IfMatch = &IfMatch
+
+	}
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.RestoreUser(w, r, id, params)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
 // PostCreate operation middleware
 func (siw *ServerInterfaceWrapper) PostCreate(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -64,16 +523,55 @@ func (siw *ServerInterfaceWrapper) DeleteDeleteId(w http.ResponseWriter, r *http
 	var err error
 
 	// ------------- Path parameter "id" -------------
-	var id string
+	var id UserID
 
 	err = runtime.BindStyledParameter("simple", false, "id", chi.URLParam(r, "id"), &id)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid format for parameter id: %s", err), http.StatusBadRequest)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
 		return
 	}
 
+	// Parameter object where we will unmarshal all parameters from the context
+	var params DeleteDeleteIdParams
+
+	headers := r.Header
+
+	// ------------- Optional header parameter "If-Match" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("If-Match")]; found {
+		var IfMatch IfMatch
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "If-Match", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "If-Match", runtime.ParamLocationHeader, valueList[0], &IfMatch)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "If-Match", Err: err})
+			return
+		}
+
+		params.IfMatch = &IfMatch
+
+	}
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.DeleteDeleteId(w, r, id, params)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
+// Login operation middleware
+func (siw *ServerInterfaceWrapper) Login(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	var handler = func(w http.ResponseWriter, r *http.Request) {
-		siw.Handler.DeleteDeleteId(w, r, id)
+		siw.Handler.Login(w, r)
 	}
 
 	for _, middleware := range siw.HandlerMiddlewares {
@@ -90,16 +588,55 @@ func (siw *ServerInterfaceWrapper) GetReadId(w http.ResponseWriter, r *http.Requ
 	var err error
 
 	// ------------- Path parameter "id" -------------
-	var id string
+	var id UserID
 
 	err = runtime.BindStyledParameter("simple", false, "id", chi.URLParam(r, "id"), &id)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid format for parameter id: %s", err), http.StatusBadRequest)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
 		return
 	}
 
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetReadIdParams
+
+	headers := r.Header
+
+	// ------------- Optional header parameter "If-None-Match" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("If-None-Match")]; found {
+		var IfNoneMatch IfNoneMatch
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "If-None-Match", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "If-None-Match", runtime.ParamLocationHeader, valueList[0], &IfNoneMatch)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "If-None-Match", Err: err})
+			return
+		}
+
+		params.IfNoneMatch = &IfNoneMatch
+
+	}
+
 	var handler = func(w http.ResponseWriter, r *http.Request) {
-		siw.Handler.GetReadId(w, r, id)
+		siw.Handler.GetReadId(w, r, id, params)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
+// RefreshToken operation middleware
+func (siw *ServerInterfaceWrapper) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.RefreshToken(w, r)
 	}
 
 	for _, middleware := range siw.HandlerMiddlewares {
@@ -120,12 +657,168 @@ func (siw *ServerInterfaceWrapper) FindUsers(w http.ResponseWriter, r *http.Requ
 
 	err = runtime.BindStyledParameter("simple", false, "q", chi.URLParam(r, "q"), &q)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid format for parameter q: %s", err), http.StatusBadRequest)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "q", Err: err})
+		return
+	}
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params FindUsersParams
+
+	// ------------- Optional query parameter "mode" -------------
+	if paramValue := r.URL.Query().Get("mode"); paramValue != "" {
+
+	}
+
+	err = runtime.BindQueryParameter("form", true, false, "mode", r.URL.Query(), &params.Mode)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "mode", Err: err})
+		return
+	}
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.FindUsers(w, r, q, params)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
+// PatchUpdateId operation middleware
+func (siw *ServerInterfaceWrapper) PatchUpdateId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id UserID
+
+	err = runtime.BindStyledParameter("simple", false, "id", chi.URLParam(r, "id"), &id)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params PatchUpdateIdParams
+
+	headers := r.Header
+
+	// ------------- Optional header parameter "If-Match" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("If-Match")]; found {
+		var IfMatch IfMatch
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "If-Match", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "If-Match", runtime.ParamLocationHeader, valueList[0], &IfMatch)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "If-Match", Err: err})
+			return
+		}
+
+		params.IfMatch = &IfMatch
+
+	}
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PatchUpdateId(w, r, id, params)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
+// PutUpdateId operation middleware
+func (siw *ServerInterfaceWrapper) PutUpdateId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id UserID
+
+	err = runtime.BindStyledParameter("simple", false, "id", chi.URLParam(r, "id"), &id)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params PutUpdateIdParams
+
+	headers := r.Header
+
+	// ------------- Optional header parameter "If-Match" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("If-Match")]; found {
+		var IfMatch IfMatch
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "If-Match", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "If-Match", runtime.ParamLocationHeader, valueList[0], &IfMatch)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "If-Match", Err: err})
+			return
+		}
+
+		params.IfMatch = &IfMatch
+
+	}
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PutUpdateId(w, r, id, params)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
+// ListUsers operation middleware
+func (siw *ServerInterfaceWrapper) ListUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params ListUsersParams
+
+	// ------------- Optional query parameter "limit" -------------
+	if paramValue := r.URL.Query().Get("limit"); paramValue != "" {
+
+	}
+
+	err = runtime.BindQueryParameter("form", true, false, "limit", r.URL.Query(), &params.Limit)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "limit", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "cursor" -------------
+	if paramValue := r.URL.Query().Get("cursor"); paramValue != "" {
+
+	}
+
+	err = runtime.BindQueryParameter("form", true, false, "cursor", r.URL.Query(), &params.Cursor)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "cursor", Err: err})
 		return
 	}
 
 	var handler = func(w http.ResponseWriter, r *http.Request) {
-		siw.Handler.FindUsers(w, r, q)
+		siw.Handler.ListUsers(w, r, params)
 	}
 
 	for _, middleware := range siw.HandlerMiddlewares {
@@ -135,15 +828,100 @@ func (siw *ServerInterfaceWrapper) FindUsers(w http.ResponseWriter, r *http.Requ
 	handler(w, r.WithContext(ctx))
 }
 
+// QueryUsers operation middleware
+func (siw *ServerInterfaceWrapper) QueryUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var handler = func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.QueryUsers(w, r)
+	}
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler(w, r.WithContext(ctx))
+}
+
+type UnescapedCookieParamError struct {
+	ParamName string
+	Err       error
+}
+
+func (e *UnescapedCookieParamError) Error() string {
+	return fmt.Sprintf("error unescaping cookie parameter '%s'", e.ParamName)
+}
+
+func (e *UnescapedCookieParamError) Unwrap() error {
+	return e.Err
+}
+
+type UnmarshalingParamError struct {
+	ParamName string
+	Err       error
+}
+
+func (e *UnmarshalingParamError) Error() string {
+	return fmt.Sprintf("Error unmarshaling parameter %s as JSON: %s", e.ParamName, e.Err.Error())
+}
+
+func (e *UnmarshalingParamError) Unwrap() error {
+	return e.Err
+}
+
+type RequiredParamError struct {
+	ParamName string
+}
+
+func (e *RequiredParamError) Error() string {
+	return fmt.Sprintf("Query argument %s is required, but not found", e.ParamName)
+}
+
+type RequiredHeaderError struct {
+	ParamName string
+	Err       error
+}
+
+func (e *RequiredHeaderError) Error() string {
+	return fmt.Sprintf("Header parameter %s is required, but not found", e.ParamName)
+}
+
+func (e *RequiredHeaderError) Unwrap() error {
+	return e.Err
+}
+
+type InvalidParamFormatError struct {
+	ParamName string
+	Err       error
+}
+
+func (e *InvalidParamFormatError) Error() string {
+	return fmt.Sprintf("Invalid format for parameter %s: %s", e.ParamName, e.Err.Error())
+}
+
+func (e *InvalidParamFormatError) Unwrap() error {
+	return e.Err
+}
+
+type TooManyValuesForParamError struct {
+	ParamName string
+	Count     int
+}
+
+func (e *TooManyValuesForParamError) Error() string {
+	return fmt.Sprintf("Expected one value for %s, got %d", e.ParamName, e.Count)
+}
+
 // Handler creates http.Handler with routing matching OpenAPI spec.
 func Handler(si ServerInterface) http.Handler {
 	return HandlerWithOptions(si, ChiServerOptions{})
 }
 
 type ChiServerOptions struct {
-	BaseURL     string
-	BaseRouter  chi.Router
-	Middlewares []MiddlewareFunc
+	BaseURL          string
+	BaseRouter       chi.Router
+	Middlewares      []MiddlewareFunc
+	ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request, err error)
 }
 
 // HandlerFromMux creates http.Handler with routing matching OpenAPI spec based on the provided mux.
@@ -167,23 +945,56 @@ func HandlerWithOptions(si ServerInterface, options ChiServerOptions) http.Handl
 	if r == nil {
 		r = chi.NewRouter()
 	}
+	if options.ErrorHandlerFunc == nil {
+		options.ErrorHandlerFunc = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
 	wrapper := ServerInterfaceWrapper{
 		Handler:            si,
 		HandlerMiddlewares: options.Middlewares,
+		ErrorHandlerFunc:   options.ErrorHandlerFunc,
 	}
 
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/admin/compact", wrapper.Compact)
+	})
+	r.Group(func(r chi.Router) {
+		r.Delete(options.BaseURL+"/admin/purge/{id}", wrapper.PurgeUser)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/admin/restore/{id}", wrapper.RestoreUser)
+	})
 	r.Group(func(r chi.Router) {
 		r.Post(options.BaseURL+"/create", wrapper.PostCreate)
 	})
 	r.Group(func(r chi.Router) {
 		r.Delete(options.BaseURL+"/delete/{id}", wrapper.DeleteDeleteId)
 	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/login", wrapper.Login)
+	})
 	r.Group(func(r chi.Router) {
 		r.Get(options.BaseURL+"/read/{id}", wrapper.GetReadId)
 	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/refresh", wrapper.RefreshToken)
+	})
 	r.Group(func(r chi.Router) {
 		r.Get(options.BaseURL+"/search/{q}", wrapper.FindUsers)
 	})
+	r.Group(func(r chi.Router) {
+		r.Patch(options.BaseURL+"/update/{id}", wrapper.PatchUpdateId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Put(options.BaseURL+"/update/{id}", wrapper.PutUpdateId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/users", wrapper.ListUsers)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/users/query", wrapper.QueryUsers)
+	})
 
 	return r
 }
@@ -191,14 +1002,57 @@ func HandlerWithOptions(si ServerInterface, options ChiServerOptions) http.Handl
 // Base64 encoded, gzipped, json marshaled Swagger object
 var swaggerSpec = []string{
 
-	"H4sIAAAAAAAC/+ySy2vcMBDG/xUzZxNvXxff+gxLDw3Z9lRy0FqTXQXrsTPjwGL0v5eRk5CuXUqhbC+9",
-	"GEnfzKfR9/MIXfQpBgzC0I65BhduI7QjWOSOXBIXA7Rw/XHztXp7tYYaxEmP0MLG+dRjxUj3rsMH8R6J",
-	"p44XF6uLFeQaYsJgkoMWXpWjGpKRvd4GTUdoBHWZIsv82vdFrwZGguJERpW1hRauIsukQw2EhwFZ3kV7",
-	"VJcuBsFQDE1KvetKW3PH6joCd3v0RldyTPqWuL3DTiDnXJ9MoC3VVm2nSxyhhVZowKwHnGJgLI95uVrN",
-	"H/Dls0bweknaGls9jK01b5ZqXBCkYPqSMlKFRJFAp+TBe0PHk4xUaSz2KNiMzubJUbdz7w/lfDnbSZu+",
-	"a1uQkfEoSAzt99mU9tHF6VbxQg3BeCziLLl6DoCFXNhBzjfLqf49oGcg8jzZQoTQ2CceO1z40S9Rlklc",
-	"olyjsf8h/CmEp0QLAUZD3b4ZD79GsCklyxQ+uWC/sQb/GwraXWno1S1FX21x58IyksNZiThBzz8tThjV",
-	"jweGyBzn+3/C8DmSMsFUOwU/UA8tNJBv8o8AAAD//1zjgi7GBgAA",
+	"H4sIAAAAAAAC/+xb23PbNrP/VzA456E9Q0fyJUkrP7Vp0klPL/4cZ76HqOOByKWEmgRoAJStePS/f7ML",
+	"8CZRl3yxnabjlzgiAexi8dsLdpd3PNZ5oRUoZ/nojs9AJGDov68vxBT/JmBjIwsnteIjXlowbA7GSq0i",
+	"Fs+EmoJlN9LNGMzBLMIjplPmZsBwOI+4jWeQC1zNLQrgI26dkWrKl8tlxAthRA4ukH2b/iZcPFunjPy0",
+	"l624oAeBqrRsIiwkDJnThv3f6VgZuC6lgYQ5zcoiEQ4ilkAG+NeAddoAEyphRWmmcMpSbZgIAxIiNFbS",
+	"4cpIp82EH4NrFFpZQHr4uGIr1aVKxmqyYIJdlygakpJUcVYmcBkojBWPuMT9edHziCuRAx/xt+mBl8Q2",
+	"8UX8bfq7VrBNZiSfTIJyTGQGRLJgM2G3kMUF96L93oJ5+9M6WZlUB08kCuFmDQGZ8IhXh8JHzpTQppJq",
+	"kwuHSCtpZA9gKokTXn4UyTlcl2Ad/oq1cqDov6IoMhkLZGnwl0W+7lpk/tdAykf8fwYN/gf+rR28NkYb",
+	"T6q7r4lImAnElhF/pVWayfgRCBPe40AuqJtQDG6ldVJNmVYwonOWCSFVXIGK6AEKvX7k0ai0m4FhmZwH",
+	"RZJTpVG6LBYWogrH/pVlUjHBboxWU2adcDBWuPc32kxkkoB6+M2nNSmEu3JglMj86AenLQM5ZsHMwTDw",
+	"AyP+u3ZvUMEf6eyVdt6gBNq/6USmEpINBnomLE3xZjFhVqoY6FQ76l3ZKh71Gf4+bsOwAY0hZs8MxFol",
+	"Esm/ETKDxxIJ7rF3f92trbB4Xhueh2ay5kRalktryXxF/L0SpZtpIz8+iqTa1PB1mIELvjIgHKANbxnQ",
+	"wugCjJPeuCbCEe1c3P4KaupmfHQ4HA7XrHJl3Dsjj54PI55LVc/smVYIa2+06cHxJDaLwqEVskw4lmvr",
+	"2MsjNlk4sDxq03l51LcwmNwGhmRe5nx0fPTyxUtiyP9udoFKPgXDvW+p8PHB7+nPepie/AUxGf7a+HSl",
+	"FesE1jfSOtUDW0AsUxl7O8JoQtS4PKncixO+zlfEoaK4ee0M5pCFhXOwVkyB9wgmlZD1iBt1h16xm5m2",
+	"wOYiK6HlSzAsOhl+zyMOCqX3wfvxFRE1ZNBVlLbfPAVW/ZDNvK6cRlix7zx+1VOpNoK4guZjga8PRS1i",
+	"fRs4Q0PxpIkdTVwT0jmkBuxso4iMf3/p9JUPS7afS3d436m8A2Hi2et+1UOFyYR1TDrI8UogmKXxzIAt",
+	"M8fcTDiWkkdkuUxuxIJHKxzXWr2dUz+sj8MLmcM5usB1/ihymYuMfUiNziPm9LcRE5UnYhMMJlC/dQFq",
+	"jTGc0gnG8dp04GTea1Kc3nds37FeoPzPhOwxqCKOwdqNBxpxuC2kAXspVY9tpMmMJrNMpoAsYTRrKRqw",
+	"+xneXaDC3V+BuvSPd51kZ0Ori3eW6uyt7+jRWvS4IPLpyaVw6wI5f/OKHR8ff48yeH/xKqqxgLYd7bJl",
+	"dBtO2ARSbYChwKwTeWHZDRhgV1A4Hu110NEnGKxwE96PZ62yBTHcvqHbvbmSyR53zM02dLNx67KNj1G4",
+	"WrGJdDZihwwv3hE7Yv6EInZSJyO+q9MRhy+YSHKpTms7e/g8LIDmptDWTQ2EY2JXAAVlJXKUjlTuyFvj",
+	"vY1sxD0Lfwe4VOH6GhtTo292JJi8dCzedAXdV+l20qPetTAOd8Z+TXQToFyd9SZdPBNTWNdHBbfuMi6N",
+	"7XMhkBduwUIGi3xJsSFo8yAf3XF0NnbXbQDZ4Y2pFcaIxdoG/ZKbdvMvTFj12NQs81GiZcIA0/RcZBEl",
+	"I2g3PtOVYzwDNpxYnWk4HatKbS1kEDvr9dmjqXollfedlQcbr/unYOZ2CaJxj42Z+aQ5K8m6loGfaJ2B",
+	"oOtlJnPZoz9DTKRUOiPxPs78yF1KmfdeIyp4I1ZwBCrAwEccg7vrZSswLwyk8pZH3JaTAKGIp+XHjwv6",
+	"m2UObl1v0F6ZvS5lFJJAPScl9Gc1WTSMmDKjQLDfOF6KLNuSpUBEuRlYYCs285NtWaCmFtuoOZYBKppW",
+	"lQW5N8pKK9iajrlPklabHsjJ1GthhOdDmb9vMEq/kRa+RbXyyKBToyEGMpiLkDpRrAkecDAhhjLjFWZo",
+	"oqWZraGUTUQSpwzVE9/KpAXHYEQPwt9mJj7s/Gp5o4gftH71YTW8/gR1Xg8+l6Tiqe5xfq/fXbAfzt7y",
+	"iDvpMpz0TuZFBpQIlDGEl7Xb4ofPhs+GyJguQIlC8hE/pkcR5b/JbA3IuxObwqeN0aX3UIcbIx0EP5/K",
+	"LJRYdOmYzpIqt2WbukWIgyIfP5BV5cSKoeTA24SP+KtAdiWBfjQ82aDzMcp3GfGT4XCTmOuVBq08PE05",
+	"3D2lkwqjSce7J71pZ4Of78NZN2WMZ27LPBdm0ciEJC0CSMIpkVwHdzJZevGgB1gX1BmYXCDFDNUp13NY",
+	"qR6FkLVTGTI6rxOVW4/sDHl470sp7TLZh/49N0MGoTSzjHaOrApuyz/3AYZH298bFSfDk90z6gQ+Tfh+",
+	"94S62oMTDo92T+jJjOPUo+8+bWqdsb4PvBOgCJdtqIcyaA32fqv0I9WIJiK+uk+In3vaXw7kw3vLwvu4",
+	"ez0J/8f/f06B5UnPvkI9C6huaZqPdDZrl6/GVHXzFTegrfPvQ+kcrPtRJ4t7Q+56KagHxgpuKva65fvl",
+	"k07do059oop8fgjUAh4h1Zv2nZHPT/R8LwdwSq8qdlgsjJFgx6o9odNU4/0Kc7ru0NHGB7pMurFaUxDP",
+	"i//3bfLkR/7pfuRrdQstnfG6lmHlcrNTeH0bsp10mafbXijTURb2l39fsFDmwHehnOBLHnZNSahK+kAO",
+	"pFOB7fMdq/w/qhNpSkz9WvWI2vHZEPKnSOAxIJLaTE+hBz8/gwsG+nh4wmS60v6DeSnpLItLY0C5Km/e",
+	"hc3P4M5BJA9sVpsmxq/QtB7vacDqrq1/ljn+bExXMK1gTWZsD6vYMXihcxejVP+7EDKUhjBn1h0rLTMw",
+	"11eQ9FxIaeBFXaO9f2u50snQg8cOt0+28r++hXUcIqGrVTLZZDV930f/VeyNVMn7UHJesYbdRTwd5hPW",
+	"UdNRS56QouMJTKluS+9aqfn+tunrrV3Ta20Hq+yE9Q88feuEqfqIryPq+2UWlJUOS3XfJJCKMnPfno5V",
+	"XUOqpmLpXTjBEGxCKovzOw3E5OYxKlHOno6VLyMc1I3IVuYyExTbX1MZycipETmWFcC6unKYSmMdTQ+1",
+	"h4NQTKTgR6fsOvQm103OgbG+dZomeypPNkIN4m7k+Lk1tM92Xiv1VmogKg0wkTrwfdlUzmU3wvpThKT6",
+	"NqHpRrob+56hMR+N+bNnz8Z8iQKoasdawR/pRge+UkXePqjdIrX8s6/m3N7u7YFKdm1Zq6AoBfWoK4hY",
+	"I4X2TvHdhp32dB3BrRvAHJQ7sM6AyLex4Hu9Dywox2iODUEUkSJ8g9rwbcKqvaTOyVzQByTxTFtQVe30",
+	"hziGwrH6+4tW9OGlerCp88zgbcYwC47dzMCrQDA3od+sQcsv7/74fR0yUQtJVPoDlVSfFbDWmRKctn+/",
+	"8zcPZV6sy09pR/apcGKSwb04mrbHwDcDX51sEur9n+e8Cq0sVfJkKuegPPp9l8V6JpAaRWnxR8xz3H8E",
+	"tNbw2vfdB4kAHYUP957yjk+5/C9SM6O7stftiBdlb8G+yETcivAiHyRRxqNu9ehR59L9A5R5r+pBy6q1",
+	"2sXqdFbdzEiXNa2etP1J27+Itnt9bLvyqvey966IbZ/MzYwup1VvHH0waSm4YNokPZfIX6V1e10isR+U",
+	"WfkRIvZ8iIFjuJlFDHupWS5uN1xsqk7DBv51f9khdWFvb4W9Wyv91W2s/u4arqxzqUtbda328eHnbI0g",
+	"Hzrdd+b7er5wLuML9DYhyjwkW0AeXFedvf25tVYka6suwqjtw8inNa3eUbcRn9qC59JKBL/T2xo/qMW4",
+	"0oKHcEtNH/Nyubxvb/J0T3+6pz/d07+2ezqZg9omLqMAIe96S5PxER+gfvxnAIyse8gXRQAA",
 }
 
 // GetSwagger returns the content of the embedded swagger specification file
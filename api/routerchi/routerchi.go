@@ -1,11 +1,14 @@
 package routerchi
 
 import (
-	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/larikhide/reguser/api/auth"
+	"github.com/larikhide/reguser/api/errs"
 	"github.com/larikhide/reguser/api/handler"
+	"github.com/larikhide/reguser/api/stream"
+	"github.com/larikhide/reguser/app/repos/user"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
@@ -23,13 +26,23 @@ func NewRouterChi(hs *handler.Handlers) *RouterChi {
 		hs: hs,
 	}
 
+	r.Post("/login", ret.Login)
+	r.Post("/refresh", ret.RefreshToken)
+
 	r.Group(func(ur chi.Router) {
-		ur.Use(auth.AuthMiddleware)
+		ur.Use(auth.AuthMiddleware(hs))
 
-		ur.Post("/create", ret.CreateUser)
-		ur.Get("/read/{id}", ret.ReadUser)
-		ur.Delete("/delete/{id}", ret.DeleteUser)
-		ur.Get("/search/{q}", ret.SearchUser)
+		ur.With(auth.RequirePerms(user.PermCreateUsers)).Post("/create", ret.CreateUser)
+		ur.With(auth.RequirePerms(user.PermReadUsers)).Get("/read/{id}", ret.ReadUser)
+		ur.With(auth.RequirePerms(user.PermUpdateUsers)).Put("/update/{id}", ret.UpdateUser)
+		ur.With(auth.RequirePerms(user.PermUpdateUsers)).Patch("/update/{id}", ret.PatchUser)
+		ur.With(auth.RequirePerms(user.PermDeleteUsers)).Delete("/delete/{id}", ret.DeleteUser)
+		ur.With(auth.RequirePerms(user.PermReadUsers)).Get("/search/{q}", ret.SearchUser)
+		ur.With(auth.RequirePerms(user.PermReadUsers)).Get("/users", ret.ListUsers)
+		ur.With(auth.RequirePerms(user.PermReadUsers)).Post("/users/query", ret.QueryUsers)
+		ur.With(auth.RequirePerms(user.PermAdmin)).Post("/admin/compact", ret.Compact)
+		ur.With(auth.RequirePerms(user.PermAdmin)).Post("/admin/restore/{id}", ret.RestoreUser)
+		ur.With(auth.RequirePerms(user.PermAdmin)).Delete("/admin/purge/{id}", ret.PurgeUser)
 	})
 
 	ret.Mux = r
@@ -46,19 +59,82 @@ func (User) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+type UserPatch handler.UserPatch
+
+func (UserPatch) Bind(r *http.Request) error {
+	return nil
+}
+
+type LoginRequest handler.LoginRequest
+
+func (LoginRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+type RefreshRequest handler.RefreshRequest
+
+func (RefreshRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+type UserQuery handler.UserQuery
+
+func (UserQuery) Bind(r *http.Request) error {
+	return nil
+}
+
+type TokenPair auth.TokenPair
+
+func (TokenPair) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (rt *RouterChi) Login(w http.ResponseWriter, r *http.Request) {
+	lr := LoginRequest{}
+	if err := render.Bind(r, &lr); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	tp, err := rt.hs.Login(r.Context(), handler.LoginRequest(lr))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	render.Render(w, r, TokenPair(tp))
+}
+
+func (rt *RouterChi) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	rr := RefreshRequest{}
+	if err := render.Bind(r, &rr); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	tp, err := rt.hs.RefreshToken(r.Context(), handler.RefreshRequest(rr))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	render.Render(w, r, TokenPair(tp))
+}
+
 func (rt *RouterChi) CreateUser(w http.ResponseWriter, r *http.Request) {
 	ru := User{}
 	if err := render.Bind(r, &ru); err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+		render.Render(w, r, errs.ErrInvalidRequest(err))
 		return
 	}
 
 	u, err := rt.hs.CreateUser(r.Context(), handler.User(ru))
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, errs.ErrFromHandler(err))
 		return
 	}
 
+	w.Header().Set("ETag", handler.ETag(u.Version))
 	render.Render(w, r, User(u))
 }
 
@@ -67,16 +143,71 @@ func (rt *RouterChi) ReadUser(w http.ResponseWriter, r *http.Request) {
 
 	uid, err := uuid.Parse(sid)
 	if err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+		render.Render(w, r, errs.ErrInvalidRequest(err))
 		return
 	}
 
 	u, err := rt.hs.ReadUser(r.Context(), uid)
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	w.Header().Set("ETag", handler.ETag(u.Version))
+	if handler.NotModified(r.Header.Get("If-None-Match"), u.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	render.Render(w, r, User(u))
+}
+
+func (rt *RouterChi) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	sid := chi.URLParam(r, "id")
+
+	uid, err := uuid.Parse(sid)
+	if err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	ru := User{}
+	if err := render.Bind(r, &ru); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	u, err := rt.hs.UpdateUser(r.Context(), uid, handler.User(ru), r.Header.Get("If-Match"))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
 		return
 	}
 
+	w.Header().Set("ETag", handler.ETag(u.Version))
+	render.Render(w, r, User(u))
+}
+
+func (rt *RouterChi) PatchUser(w http.ResponseWriter, r *http.Request) {
+	sid := chi.URLParam(r, "id")
+
+	uid, err := uuid.Parse(sid)
+	if err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	rp := UserPatch{}
+	if err := render.Bind(r, &rp); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	u, err := rt.hs.PatchUser(r.Context(), uid, handler.UserPatch(rp), r.Header.Get("If-Match"))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	w.Header().Set("ETag", handler.ETag(u.Version))
 	render.Render(w, r, User(u))
 }
 
@@ -85,40 +216,108 @@ func (rt *RouterChi) DeleteUser(w http.ResponseWriter, r *http.Request) {
 
 	uid, err := uuid.Parse(sid)
 	if err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+		render.Render(w, r, errs.ErrInvalidRequest(err))
 		return
 	}
 
-	u, err := rt.hs.DeleteUser(r.Context(), uid)
+	u, err := rt.hs.DeleteUser(r.Context(), uid, r.Header.Get("If-Match"))
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, errs.ErrFromHandler(err))
 		return
 	}
 
+	w.Header().Set("ETag", handler.ETag(u.Version))
 	render.Render(w, r, User(u))
 }
 
-func (rt *RouterChi) SearchUser(w http.ResponseWriter, r *http.Request) {
-	q := chi.URLParam(r, "id")
-	fmt.Fprintln(w, "[")
-	comma := false
-	err := rt.hs.SearchUser(r.Context(), q, func(u handler.User) error {
-		if comma {
-			fmt.Fprintln(w, ",")
-		} else {
-			comma = true
-		}
-		if err := render.Render(w, r, User(u)); err != nil {
-			return err
+type UserPage handler.UserPage
+
+func (UserPage) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (rt *RouterChi) ListUsers(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if sl := r.URL.Query().Get("limit"); sl != "" {
+		var err error
+		if limit, err = strconv.Atoi(sl); err != nil {
+			render.Render(w, r, errs.ErrInvalidRequest(err))
+			return
 		}
-		w.(http.Flusher).Flush()
-		return nil
+	}
+
+	up, err := rt.hs.ListUsers(r.Context(), r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	render.Render(w, r, UserPage(up))
+}
+
+func (rt *RouterChi) SearchUser(w http.ResponseWriter, r *http.Request) {
+	q := chi.URLParam(r, "q")
+	stream.Users(w, r, func(f func(handler.User) error) error {
+		return rt.hs.SearchUser(r.Context(), q, r.URL.Query().Get("mode"), f)
+	}, func(w http.ResponseWriter, r *http.Request, err error) {
+		render.Render(w, r, errs.ErrFromHandler(err))
 	})
+}
+
+func (rt *RouterChi) QueryUsers(w http.ResponseWriter, r *http.Request) {
+	uq := UserQuery{}
+	if err := render.Bind(r, &uq); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+	stream.Users(w, r, func(f func(handler.User) error) error {
+		return rt.hs.QueryUsers(r.Context(), handler.UserQuery(uq), f)
+	}, func(w http.ResponseWriter, r *http.Request, err error) {
+		render.Render(w, r, errs.ErrFromHandler(err))
+	})
+}
+
+func (rt *RouterChi) Compact(w http.ResponseWriter, r *http.Request) {
+	if err := rt.hs.Compact(r.Context()); err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+func (rt *RouterChi) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	sid := chi.URLParam(r, "id")
+
+	uid, err := uuid.Parse(sid)
 	if err != nil {
-		if comma {
-			fmt.Fprint(w, ",")
-		}
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
 	}
-	fmt.Fprintln(w, "]")
+
+	u, err := rt.hs.RestoreUser(r.Context(), uid, r.Header.Get("If-Match"))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	w.Header().Set("ETag", handler.ETag(u.Version))
+	render.Render(w, r, User(u))
+}
+
+func (rt *RouterChi) PurgeUser(w http.ResponseWriter, r *http.Request) {
+	sid := chi.URLParam(r, "id")
+
+	uid, err := uuid.Parse(sid)
+	if err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	if err := rt.hs.PurgeUser(r.Context(), uid, r.Header.Get("If-Match")); err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	render.NoContent(w, r)
 }
@@ -1,13 +1,17 @@
 package routergin
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/larikhide/reguser/api/auth"
 	"github.com/larikhide/reguser/api/handler"
+	"github.com/larikhide/reguser/api/stream"
+	"github.com/larikhide/reguser/app/repos/user"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/render"
 	"github.com/google/uuid"
 )
 
@@ -16,12 +20,32 @@ type RouterGin struct {
 	hs *handler.Handlers
 }
 
-func GinAuthMW(c *gin.Context) {
-	if u, p, ok := c.Request.BasicAuth(); !ok || !(u == "admin" && p == "admin") {
-		c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("unautorized"))
-		return
+func GinAuthMW(a auth.Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		au, ok := auth.Credentials(a, c.Request)
+		if !ok {
+			c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("unautorized"))
+			return
+		}
+		c.Request = c.Request.WithContext(auth.WithUser(c.Request.Context(), *au))
+		c.Next()
+	}
+}
+
+// GinRequirePerms ставится после GinAuthMW
+func GinRequirePerms(perms int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := auth.UserFromContext(c.Request.Context())
+		if !ok {
+			c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("unautorized"))
+			return
+		}
+		if !u.Can(perms) {
+			c.AbortWithError(http.StatusForbidden, fmt.Errorf("forbidden"))
+			return
+		}
+		c.Next()
 	}
-	c.Next()
 }
 
 func NewRouterGin(hs *handler.Handlers) *RouterGin {
@@ -30,12 +54,23 @@ func NewRouterGin(hs *handler.Handlers) *RouterGin {
 		hs: hs,
 	}
 
-	r.Use(GinAuthMW)
+	r.POST("/login", ret.Login)
+	r.POST("/refresh", ret.RefreshToken)
+
+	ar := r.Group("/")
+	ar.Use(GinAuthMW(hs))
 
-	r.POST("/create", ret.CreateUser)
-	r.GET("/read/:id", ret.ReadUser)
-	r.DELETE("/delete/:id", ret.DeleteUser)
-	r.GET("/search/:q", ret.SearchUser)
+	ar.POST("/create", GinRequirePerms(user.PermCreateUsers), ret.CreateUser)
+	ar.GET("/read/:id", GinRequirePerms(user.PermReadUsers), ret.ReadUser)
+	ar.PUT("/update/:id", GinRequirePerms(user.PermUpdateUsers), ret.UpdateUser)
+	ar.PATCH("/update/:id", GinRequirePerms(user.PermUpdateUsers), ret.PatchUser)
+	ar.DELETE("/delete/:id", GinRequirePerms(user.PermDeleteUsers), ret.DeleteUser)
+	ar.GET("/search/:q", GinRequirePerms(user.PermReadUsers), ret.SearchUser)
+	ar.GET("/users", GinRequirePerms(user.PermReadUsers), ret.ListUsers)
+	ar.POST("/users/query", GinRequirePerms(user.PermReadUsers), ret.QueryUsers)
+	ar.POST("/admin/compact", GinRequirePerms(user.PermAdmin), ret.Compact)
+	ar.POST("/admin/restore/:id", GinRequirePerms(user.PermAdmin), ret.RestoreUser)
+	ar.DELETE("/admin/purge/:id", GinRequirePerms(user.PermAdmin), ret.PurgeUser)
 
 	ret.Engine = r
 	return ret
@@ -43,6 +78,69 @@ func NewRouterGin(hs *handler.Handlers) *RouterGin {
 
 type User handler.User
 
+// errStatus подбирает код ответа по ошибке из handler.Handlers
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, handler.ErrBadRequest), errors.Is(err, user.ErrValidation):
+		return http.StatusBadRequest
+	case errors.Is(err, handler.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, handler.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, user.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, user.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, user.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, handler.ErrPreconditionRequired):
+		return http.StatusPreconditionRequired
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errBody - тело ответа с ошибкой, у 409 с полем, из-за которого конфликт
+func errBody(err error) gin.H {
+	h := gin.H{"error": err.Error()}
+	if f := user.ConflictField(err); f != "" {
+		h["field"] = f
+	}
+	return h
+}
+
+func (rt *RouterGin) Login(c *gin.Context) {
+	lr := handler.LoginRequest{}
+	if err := c.ShouldBindJSON(&lr); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tp, err := rt.hs.Login(c.Request.Context(), lr)
+	if err != nil {
+		c.JSON(errStatus(err), errBody(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, tp)
+}
+
+func (rt *RouterGin) RefreshToken(c *gin.Context) {
+	rr := handler.RefreshRequest{}
+	if err := c.ShouldBindJSON(&rr); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tp, err := rt.hs.RefreshToken(c.Request.Context(), rr)
+	if err != nil {
+		c.JSON(errStatus(err), errBody(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, tp)
+}
+
 func (rt *RouterGin) CreateUser(c *gin.Context) {
 	ru := User{}
 	if err := c.ShouldBindJSON(&ru); err != nil {
@@ -52,10 +150,11 @@ func (rt *RouterGin) CreateUser(c *gin.Context) {
 
 	u, err := rt.hs.CreateUser(c.Request.Context(), handler.User(ru))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errStatus(err), errBody(err))
 		return
 	}
 
+	c.Header("ETag", handler.ETag(u.Version))
 	c.JSON(http.StatusOK, u)
 }
 
@@ -70,10 +169,65 @@ func (rt *RouterGin) ReadUser(c *gin.Context) {
 
 	u, err := rt.hs.ReadUser(c.Request.Context(), uid)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errStatus(err), errBody(err))
+		return
+	}
+
+	c.Header("ETag", handler.ETag(u.Version))
+	if handler.NotModified(c.GetHeader("If-None-Match"), u.Version) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, u)
+}
+
+func (rt *RouterGin) UpdateUser(c *gin.Context) {
+	sid := c.Param("id")
+
+	uid, err := uuid.Parse(sid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ru := User{}
+	if err := c.ShouldBindJSON(&ru); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, err := rt.hs.UpdateUser(c.Request.Context(), uid, handler.User(ru), c.GetHeader("If-Match"))
+	if err != nil {
+		c.JSON(errStatus(err), errBody(err))
+		return
+	}
+
+	c.Header("ETag", handler.ETag(u.Version))
+	c.JSON(http.StatusOK, u)
+}
+
+func (rt *RouterGin) PatchUser(c *gin.Context) {
+	sid := c.Param("id")
+
+	uid, err := uuid.Parse(sid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rp := handler.UserPatch{}
+	if err := c.ShouldBindJSON(&rp); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, err := rt.hs.PatchUser(c.Request.Context(), uid, rp, c.GetHeader("If-Match"))
+	if err != nil {
+		c.JSON(errStatus(err), errBody(err))
 		return
 	}
 
+	c.Header("ETag", handler.ETag(u.Version))
 	c.JSON(http.StatusOK, u)
 }
 
@@ -86,35 +240,98 @@ func (rt *RouterGin) DeleteUser(c *gin.Context) {
 		return
 	}
 
-	u, err := rt.hs.DeleteUser(c.Request.Context(), uid)
+	u, err := rt.hs.DeleteUser(c.Request.Context(), uid, c.GetHeader("If-Match"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errStatus(err), errBody(err))
 		return
 	}
 
+	c.Header("ETag", handler.ETag(u.Version))
 	c.JSON(http.StatusOK, u)
 }
 
-func (rt *RouterGin) SearchUser(c *gin.Context) {
-	q := c.Param("id")
-	w := c.Writer
-	fmt.Fprintln(w, "[")
-	comma := false
-	err := rt.hs.SearchUser(c.Request.Context(), q, func(u handler.User) error {
-		if comma {
-			fmt.Fprintln(w, ",")
-		} else {
-			comma = true
+func (rt *RouterGin) ListUsers(c *gin.Context) {
+	limit := 0
+	if sl := c.Query("limit"); sl != "" {
+		var err error
+		if limit, err = strconv.Atoi(sl); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
-		(render.JSON{Data: u}).Render(w)
-		w.Flush()
-		return nil
+	}
+
+	up, err := rt.hs.ListUsers(c.Request.Context(), c.Query("cursor"), limit)
+	if err != nil {
+		c.JSON(errStatus(err), errBody(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, up)
+}
+
+func (rt *RouterGin) SearchUser(c *gin.Context) {
+	q := c.Param("q")
+	stream.Users(c.Writer, c.Request, func(f func(handler.User) error) error {
+		return rt.hs.SearchUser(c.Request.Context(), q, c.Query("mode"), f)
+	}, func(w http.ResponseWriter, r *http.Request, err error) {
+		c.JSON(errStatus(err), errBody(err))
 	})
+}
+
+func (rt *RouterGin) QueryUsers(c *gin.Context) {
+	uq := handler.UserQuery{}
+	if err := c.ShouldBindJSON(&uq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stream.Users(c.Writer, c.Request, func(f func(handler.User) error) error {
+		return rt.hs.QueryUsers(c.Request.Context(), uq, f)
+	}, func(w http.ResponseWriter, r *http.Request, err error) {
+		c.JSON(errStatus(err), errBody(err))
+	})
+}
+
+func (rt *RouterGin) Compact(c *gin.Context) {
+	if err := rt.hs.Compact(c.Request.Context()); err != nil {
+		c.JSON(errStatus(err), errBody(err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (rt *RouterGin) RestoreUser(c *gin.Context) {
+	sid := c.Param("id")
+
+	uid, err := uuid.Parse(sid)
 	if err != nil {
-		if comma {
-			fmt.Fprint(w, ",")
-		}
-		(render.JSON{Data: err}).Render(w)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, err := rt.hs.RestoreUser(c.Request.Context(), uid, c.GetHeader("If-Match"))
+	if err != nil {
+		c.JSON(errStatus(err), errBody(err))
+		return
 	}
-	fmt.Fprintln(w, "]")
+
+	c.Header("ETag", handler.ETag(u.Version))
+	c.JSON(http.StatusOK, u)
+}
+
+func (rt *RouterGin) PurgeUser(c *gin.Context) {
+	sid := c.Param("id")
+
+	uid, err := uuid.Parse(sid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := rt.hs.PurgeUser(c.Request.Context(), uid, c.GetHeader("If-Match")); err != nil {
+		c.JSON(errStatus(err), errBody(err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
 }
@@ -2,13 +2,15 @@ package routeroapi
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/larikhide/reguser/api/auth"
+	"github.com/larikhide/reguser/api/errs"
 	"github.com/larikhide/reguser/api/handler"
 	"github.com/larikhide/reguser/api/openapi"
+	"github.com/larikhide/reguser/api/stream"
+	"github.com/larikhide/reguser/app/repos/user"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
@@ -17,25 +19,37 @@ import (
 
 type RouterOpenAPI struct {
 	*chi.Mux
-	hs *handler.Handlers
+	hs        *handler.Handlers
+	onRespErr func(r *http.Request, err error)
 }
 
-func NewRouterOpenAPI(hs *handler.Handlers) *RouterOpenAPI {
+func NewRouterOpenAPI(hs *handler.Handlers, opts ...Option) *RouterOpenAPI {
 	r := chi.NewRouter()
-	r.Use(auth.AuthMiddleware)
 
 	ret := &RouterOpenAPI{
 		hs: hs,
 	}
-
-	r.Mount("/", openapi.Handler(ret))
+	for _, opt := range opts {
+		opt(ret)
+	}
 
 	swg, err := openapi.GetSwagger()
 	if err != nil {
 		log.Fatal("swagger fail")
 	}
 
-	r.Get("/swagger.json", func(w http.ResponseWriter, r *http.Request) {
+	v, err := newValidator(swg, ret.onRespErr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// последний в списке выполняется первым: аутентификация, права, проверка запроса
+	r.Mount("/", openapi.HandlerWithOptions(ret, openapi.ChiServerOptions{
+		Middlewares:      []openapi.MiddlewareFunc{v.middleware, routePerms, ret.authenticate},
+		ErrorHandlerFunc: paramError,
+	}))
+
+	r.With(auth.AuthMiddleware(hs)).Get("/swagger.json", func(w http.ResponseWriter, r *http.Request) {
 		enc := json.NewEncoder(w)
 		_ = enc.Encode(swg)
 	})
@@ -44,84 +58,429 @@ func NewRouterOpenAPI(hs *handler.Handlers) *RouterOpenAPI {
 	return ret
 }
 
-type User handler.User
+// права на операции из спецификации, ключ - метод и шаблон пути
+var opPerms = map[string]int{
+	"POST /create":             user.PermCreateUsers,
+	"GET /read/{id}":           user.PermReadUsers,
+	"PUT /update/{id}":         user.PermUpdateUsers,
+	"PATCH /update/{id}":       user.PermUpdateUsers,
+	"DELETE /delete/{id}":      user.PermDeleteUsers,
+	"GET /search/{q}":          user.PermReadUsers,
+	"GET /users":               user.PermReadUsers,
+	"POST /users/query":        user.PermReadUsers,
+	"POST /admin/compact":      user.PermAdmin,
+	"POST /admin/restore/{id}": user.PermAdmin,
+	"DELETE /admin/purge/{id}": user.PermAdmin,
+}
 
-func (User) Bind(r *http.Request) error {
-	return nil
+// операции без аутентификации
+var opPublic = map[string]bool{
+	"POST /login":   true,
+	"POST /refresh": true,
+}
+
+func routeOp(r *http.Request) string {
+	return r.Method + " " + chi.RouteContext(r.Context()).RoutePattern()
+}
+
+func (rt *RouterOpenAPI) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	amw := auth.AuthMiddleware(rt.hs)(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opPublic[routeOp(r)] {
+			next(w, r)
+			return
+		}
+		amw.ServeHTTP(w, r)
+	}
 }
 
+func routePerms(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op := routeOp(r)
+		if opPublic[op] {
+			next(w, r)
+			return
+		}
+		perms, ok := opPerms[op]
+		if !ok {
+			// операция без прав - ошибка в opPerms
+			perms = user.PermAdmin
+		}
+		auth.RequirePerms(perms)(next).ServeHTTP(w, r)
+	}
+}
+
+// типы запросов и ответов из спецификации
+
+type User openapi.User
+
 func (User) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+func userFromHandler(u handler.User) User {
+	ret := User{
+		Id:        u.ID.String(),
+		Name:      u.Name,
+		Data:      u.Data,
+		Perms:     u.Permission,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+		DeletedAt: u.DeletedAt,
+	}
+	if u.Version != 0 {
+		v := u.Version
+		ret.Version = &v
+	}
+	return ret
+}
+
+func ifMatch(h *openapi.IfMatch) string {
+	if h == nil {
+		return ""
+	}
+	return string(*h)
+}
+
+type CreateUserRequest openapi.CreateUserRequest
+
+func (CreateUserRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+func (cr CreateUserRequest) user() handler.User {
+	u := handler.User{
+		Name: cr.Name,
+	}
+	if cr.Data != nil {
+		u.Data = *cr.Data
+	}
+	if cr.Perms != nil {
+		u.Permission = *cr.Perms
+	}
+	if cr.Password != nil {
+		u.Password = *cr.Password
+	}
+	return u
+}
+
+type PatchUserRequest openapi.PatchUserRequest
+
+func (PatchUserRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+type UserQuery openapi.UserQuery
+
+func (UserQuery) Bind(r *http.Request) error {
+	return nil
+}
+
+func timeRange(tr *openapi.TimeRange) *handler.TimeRange {
+	if tr == nil {
+		return nil
+	}
+	return &handler.TimeRange{From: tr.From, To: tr.To}
+}
+
+func (uq UserQuery) query() handler.UserQuery {
+	q := handler.UserQuery{
+		Created: timeRange(uq.Created),
+		Updated: timeRange(uq.Updated),
+		Deleted: timeRange(uq.Deleted),
+	}
+	if uq.Name != nil {
+		q.Name = *uq.Name
+	}
+	if uq.Mode != nil {
+		q.Mode = string(*uq.Mode)
+	}
+	if uq.PermsAll != nil {
+		q.PermsAll = *uq.PermsAll
+	}
+	if uq.PermsAny != nil {
+		q.PermsAny = *uq.PermsAny
+	}
+	if uq.PermsNone != nil {
+		q.PermsNone = *uq.PermsNone
+	}
+	if uq.IncludeDeleted != nil {
+		q.IncludeDeleted = *uq.IncludeDeleted
+	}
+	if uq.Sort != nil {
+		q.Sort = string(*uq.Sort)
+	}
+	if uq.Limit != nil {
+		q.Limit = *uq.Limit
+	}
+	return q
+}
+
+type LoginRequest openapi.LoginRequest
+
+func (LoginRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+type RefreshRequest openapi.RefreshRequest
+
+func (RefreshRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+type TokenPair openapi.TokenPair
+
+func (TokenPair) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func tokenPair(tp auth.TokenPair) TokenPair {
+	return TokenPair{
+		AccessToken:  tp.AccessToken,
+		RefreshToken: tp.RefreshToken,
+		TokenType:    tp.TokenType,
+		ExpiresIn:    tp.ExpiresIn,
+	}
+}
+
+func parseUserID(id openapi.UserID) (uuid.UUID, error) {
+	return uuid.Parse(string(id))
+}
+
+func (rt *RouterOpenAPI) Login(w http.ResponseWriter, r *http.Request) {
+	lr := LoginRequest{}
+	if err := render.Bind(r, &lr); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	tp, err := rt.hs.Login(r.Context(), handler.LoginRequest(lr))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	render.Render(w, r, tokenPair(tp))
+}
+
+func (rt *RouterOpenAPI) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	rr := RefreshRequest{}
+	if err := render.Bind(r, &rr); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	tp, err := rt.hs.RefreshToken(r.Context(), handler.RefreshRequest(rr))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	render.Render(w, r, tokenPair(tp))
+}
+
 func (rt *RouterOpenAPI) PostCreate(w http.ResponseWriter, r *http.Request) {
-	ru := User{}
-	if err := render.Bind(r, &ru); err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+	cr := CreateUserRequest{}
+	if err := render.Bind(r, &cr); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
 		return
 	}
 
-	u, err := rt.hs.CreateUser(r.Context(), handler.User(ru))
+	u, err := rt.hs.CreateUser(r.Context(), cr.user())
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, errs.ErrFromHandler(err))
 		return
 	}
 
-	render.Render(w, r, User(u))
+	w.Header().Set("ETag", handler.ETag(u.Version))
+	render.Render(w, r, userFromHandler(u))
 }
 
-func (rt *RouterOpenAPI) GetReadId(w http.ResponseWriter, r *http.Request, sid string) {
-	uid, err := uuid.Parse(sid)
+func (rt *RouterOpenAPI) GetReadId(w http.ResponseWriter, r *http.Request, id openapi.UserID, params openapi.GetReadIdParams) {
+	uid, err := parseUserID(id)
 	if err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+		render.Render(w, r, errs.ErrInvalidRequest(err))
 		return
 	}
 
 	u, err := rt.hs.ReadUser(r.Context(), uid)
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, errs.ErrFromHandler(err))
 		return
 	}
 
-	render.Render(w, r, User(u))
+	w.Header().Set("ETag", handler.ETag(u.Version))
+	if params.IfNoneMatch != nil && handler.NotModified(string(*params.IfNoneMatch), u.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	render.Render(w, r, userFromHandler(u))
 }
 
-func (rt *RouterOpenAPI) DeleteDeleteId(w http.ResponseWriter, r *http.Request, sid string) {
-	uid, err := uuid.Parse(sid)
+func (rt *RouterOpenAPI) PutUpdateId(w http.ResponseWriter, r *http.Request, id openapi.UserID, params openapi.PutUpdateIdParams) {
+	uid, err := parseUserID(id)
 	if err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	cr := CreateUserRequest{}
+	if err := render.Bind(r, &cr); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
 		return
 	}
 
-	u, err := rt.hs.DeleteUser(r.Context(), uid)
+	u, err := rt.hs.UpdateUser(r.Context(), uid, cr.user(), ifMatch(params.IfMatch))
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, errs.ErrFromHandler(err))
 		return
 	}
 
-	render.Render(w, r, User(u))
+	w.Header().Set("ETag", handler.ETag(u.Version))
+	render.Render(w, r, userFromHandler(u))
 }
 
-func (rt *RouterOpenAPI) FindUsers(w http.ResponseWriter, r *http.Request, q string) {
-	fmt.Fprintln(w, "[")
-	comma := false
-	err := rt.hs.SearchUser(r.Context(), q, func(u handler.User) error {
-		if comma {
-			fmt.Fprintln(w, ",")
-		} else {
-			comma = true
-		}
-		if err := render.Render(w, r, User(u)); err != nil {
-			return err
-		}
-		w.(http.Flusher).Flush()
-		return nil
+func (rt *RouterOpenAPI) PatchUpdateId(w http.ResponseWriter, r *http.Request, id openapi.UserID, params openapi.PatchUpdateIdParams) {
+	uid, err := parseUserID(id)
+	if err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	pr := PatchUserRequest{}
+	if err := render.Bind(r, &pr); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	u, err := rt.hs.PatchUser(r.Context(), uid, handler.UserPatch{
+		Name:       pr.Name,
+		Data:       pr.Data,
+		Permission: pr.Perms,
+		Password:   pr.Password,
+	}, ifMatch(params.IfMatch))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	w.Header().Set("ETag", handler.ETag(u.Version))
+	render.Render(w, r, userFromHandler(u))
+}
+
+func (rt *RouterOpenAPI) DeleteDeleteId(w http.ResponseWriter, r *http.Request, id openapi.UserID, params openapi.DeleteDeleteIdParams) {
+	uid, err := parseUserID(id)
+	if err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	u, err := rt.hs.DeleteUser(r.Context(), uid, ifMatch(params.IfMatch))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	w.Header().Set("ETag", handler.ETag(u.Version))
+	render.Render(w, r, userFromHandler(u))
+}
+
+type UserPage openapi.UserPage
+
+func (UserPage) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (rt *RouterOpenAPI) ListUsers(w http.ResponseWriter, r *http.Request, params openapi.ListUsersParams) {
+	limit, cursor := 0, ""
+	if params.Limit != nil {
+		limit = *params.Limit
+	}
+	if params.Cursor != nil {
+		cursor = *params.Cursor
+	}
+
+	up, err := rt.hs.ListUsers(r.Context(), cursor, limit)
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	page := UserPage{
+		Users: make([]openapi.User, 0, len(up.Users)),
+	}
+	for _, u := range up.Users {
+		page.Users = append(page.Users, openapi.User(userFromHandler(u)))
+	}
+	if up.NextCursor != "" {
+		page.NextCursor = &up.NextCursor
+	}
+
+	render.Render(w, r, page)
+}
+
+func (rt *RouterOpenAPI) FindUsers(w http.ResponseWriter, r *http.Request, q string, params openapi.FindUsersParams) {
+	mode := ""
+	if params.Mode != nil {
+		mode = string(*params.Mode)
+	}
+	stream.Users(w, r, func(f func(handler.User) error) error {
+		return rt.hs.SearchUser(r.Context(), q, mode, f)
+	}, func(w http.ResponseWriter, r *http.Request, err error) {
+		render.Render(w, r, errs.ErrFromHandler(err))
 	})
+}
+
+func (rt *RouterOpenAPI) QueryUsers(w http.ResponseWriter, r *http.Request) {
+	uq := UserQuery{}
+	if err := render.Bind(r, &uq); err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+	stream.Users(w, r, func(f func(handler.User) error) error {
+		return rt.hs.QueryUsers(r.Context(), uq.query(), f)
+	}, func(w http.ResponseWriter, r *http.Request, err error) {
+		render.Render(w, r, errs.ErrFromHandler(err))
+	})
+}
+
+func (rt *RouterOpenAPI) Compact(w http.ResponseWriter, r *http.Request) {
+	if err := rt.hs.Compact(r.Context()); err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+func (rt *RouterOpenAPI) RestoreUser(w http.ResponseWriter, r *http.Request, id openapi.UserID, params openapi.RestoreUserParams) {
+	uid, err := parseUserID(id)
 	if err != nil {
-		if comma {
-			fmt.Fprint(w, ",")
-		}
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	u, err := rt.hs.RestoreUser(r.Context(), uid, ifMatch(params.IfMatch))
+	if err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
 	}
-	fmt.Fprintln(w, "]")
+
+	w.Header().Set("ETag", handler.ETag(u.Version))
+	render.Render(w, r, userFromHandler(u))
+}
+
+func (rt *RouterOpenAPI) PurgeUser(w http.ResponseWriter, r *http.Request, id openapi.UserID, params openapi.PurgeUserParams) {
+	uid, err := parseUserID(id)
+	if err != nil {
+		render.Render(w, r, errs.ErrInvalidRequest(err))
+		return
+	}
+
+	if err := rt.hs.PurgeUser(r.Context(), uid, ifMatch(params.IfMatch)); err != nil {
+		render.Render(w, r, errs.ErrFromHandler(err))
+		return
+	}
+
+	render.NoContent(w, r)
 }
@@ -0,0 +1,218 @@
+package routeroapi_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/larikhide/reguser/api/auth"
+	"github.com/larikhide/reguser/api/handler"
+	"github.com/larikhide/reguser/api/routeroapi"
+	"github.com/larikhide/reguser/app/repos/user"
+	"github.com/larikhide/reguser/db/fstore/userfstore"
+)
+
+type client struct {
+	t  *testing.T
+	h  http.Handler
+	tk string
+}
+
+// newClient поднимает роутер над файловым хранилищем с проверкой ответов
+// и входит администратором
+func newClient(t *testing.T) *client {
+	t.Helper()
+	st, err := userfstore.NewUserFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(st.Close)
+	tokens, err := auth.NewTokens(auth.TokenConfig{Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := handler.NewHandlers(user.NewUsers(st), tokens)
+	if _, err := hs.CreateUser(context.Background(), handler.User{Name: "admin", Permission: user.PermAdmin, Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &client{t: t}
+	c.h = routeroapi.NewRouterOpenAPI(hs, routeroapi.WithResponseValidation(func(r *http.Request, err error) {
+		t.Errorf("response validation: %v", err)
+	}))
+
+	tp := auth.TokenPair{}
+	c.decode(c.check(c.do(http.MethodPost, "/login", `{"name":"admin","password":"pw"}`), http.StatusOK), &tp)
+	c.tk = tp.AccessToken
+	return c
+}
+
+// do выполняет запрос, заголовки - пары имя, значение
+func (c *client) do(method, path, body string, hdr ...string) *httptest.ResponseRecorder {
+	var br io.Reader
+	if body != "" {
+		br = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, path, br)
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if c.tk != "" {
+		r.Header.Set("Authorization", "Bearer "+c.tk)
+	}
+	for i := 0; i+1 < len(hdr); i += 2 {
+		r.Header.Set(hdr[i], hdr[i+1])
+	}
+	w := httptest.NewRecorder()
+	c.h.ServeHTTP(w, r)
+	return w
+}
+
+func (c *client) check(w *httptest.ResponseRecorder, status int) *httptest.ResponseRecorder {
+	c.t.Helper()
+	if w.Code != status {
+		c.t.Fatalf("status %d, want %d, body %s", w.Code, status, w.Body)
+	}
+	return w
+}
+
+func (c *client) decode(w *httptest.ResponseRecorder, v interface{}) {
+	c.t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		c.t.Fatalf("decode %s: %v", w.Body, err)
+	}
+}
+
+func (c *client) user(w *httptest.ResponseRecorder) (handler.User, string) {
+	c.t.Helper()
+	u := handler.User{}
+	c.decode(w, &u)
+	etag := w.Header().Get("ETag")
+	if etag != handler.ETag(u.Version) {
+		c.t.Errorf("ETag %q, want %q", etag, handler.ETag(u.Version))
+	}
+	return u, etag
+}
+
+func TestRoutes(t *testing.T) {
+	c := newClient(t)
+
+	tp := auth.TokenPair{}
+	c.decode(c.check(c.do(http.MethodPost, "/login", `{"name":"admin","password":"pw"}`), http.StatusOK), &tp)
+	c.check(c.do(http.MethodPost, "/login", `{"name":"admin","password":"bad"}`), http.StatusUnauthorized)
+	c.check(c.do(http.MethodPost, "/refresh", `{"refresh_token":"`+tp.RefreshToken+`"}`), http.StatusOK)
+	c.check(c.do(http.MethodPost, "/refresh", `{"refresh_token":"`+tp.RefreshToken+`"}`), http.StatusUnauthorized)
+
+	u, etag := c.user(c.check(c.do(http.MethodPost, "/create", `{"name":"kate","data":"d","perms":1,"password":"pw"}`), http.StatusOK))
+	c.check(c.do(http.MethodPost, "/create", `{"name":"Kate"}`), http.StatusConflict)
+	id := u.ID.String()
+
+	c.user(c.check(c.do(http.MethodGet, "/read/"+id, ""), http.StatusOK))
+	c.check(c.do(http.MethodGet, "/read/"+id, "", "If-None-Match", etag), http.StatusNotModified)
+	c.check(c.do(http.MethodGet, "/read/"+strings.ToUpper(id), ""), http.StatusOK)
+
+	c.check(c.do(http.MethodPut, "/update/"+id, `{"name":"kate","data":"new"}`), http.StatusPreconditionRequired)
+	c.check(c.do(http.MethodPut, "/update/"+id, `{"name":"kate","data":"new"}`, "If-Match", `"0"`), http.StatusPreconditionFailed)
+	c.check(c.do(http.MethodPut, "/update/"+id, `{"name":"admin"}`, "If-Match", etag), http.StatusConflict)
+	u, etag = c.user(c.check(c.do(http.MethodPut, "/update/"+id, `{"name":"kate","data":"new"}`, "If-Match", etag), http.StatusOK))
+	if u.Data != "new" {
+		t.Errorf("updated data %q", u.Data)
+	}
+	c.check(c.do(http.MethodPatch, "/update/"+id, `{"data":"patched"}`), http.StatusPreconditionRequired)
+	_, etag = c.user(c.check(c.do(http.MethodPatch, "/update/"+id, `{"data":"patched"}`, "If-Match", etag), http.StatusOK))
+
+	for _, accept := range []string{"application/json", "application/x-ndjson", "text/event-stream"} {
+		w := c.check(c.do(http.MethodGet, "/search/ka", "", "Accept", accept), http.StatusOK)
+		if !strings.Contains(w.Body.String(), `"name":"kate"`) {
+			t.Errorf("search %s: %s", accept, w.Body)
+		}
+		w = c.check(c.do(http.MethodPost, "/users/query", `{"name":"ka","mode":"substring","sort":"-name"}`, "Accept", accept), http.StatusOK)
+		if !strings.Contains(w.Body.String(), `"name":"kate"`) {
+			t.Errorf("query %s: %s", accept, w.Body)
+		}
+	}
+	c.check(c.do(http.MethodGet, "/search/ka", "", "Accept", "text/html"), http.StatusNotAcceptable)
+
+	page := handler.UserPage{}
+	c.decode(c.check(c.do(http.MethodGet, "/users?limit=1", ""), http.StatusOK), &page)
+	if len(page.Users) != 1 || page.NextCursor == "" {
+		t.Fatalf("first page %+v", page)
+	}
+	c.decode(c.check(c.do(http.MethodGet, "/users?limit=1&cursor="+page.NextCursor, ""), http.StatusOK), &page)
+	if len(page.Users) != 1 {
+		t.Errorf("second page %+v", page)
+	}
+
+	_, etag = c.user(c.check(c.do(http.MethodDelete, "/delete/"+id, "", "If-Match", etag), http.StatusOK))
+	c.check(c.do(http.MethodGet, "/read/"+id, ""), http.StatusNotFound)
+	c.check(c.do(http.MethodDelete, "/delete/"+id, "", "If-Match", "*"), http.StatusNotFound)
+	c.check(c.do(http.MethodPost, "/admin/restore/"+id, ""), http.StatusPreconditionRequired)
+	_, etag = c.user(c.check(c.do(http.MethodPost, "/admin/restore/"+id, "", "If-Match", etag), http.StatusOK))
+	c.check(c.do(http.MethodPost, "/admin/restore/"+id, "", "If-Match", etag), http.StatusConflict)
+	c.check(c.do(http.MethodDelete, "/admin/purge/"+id, "", "If-Match", etag), http.StatusConflict)
+
+	_, etag = c.user(c.check(c.do(http.MethodDelete, "/delete/"+id, "", "If-Match", etag), http.StatusOK))
+	c.check(c.do(http.MethodDelete, "/admin/purge/"+id, ""), http.StatusPreconditionRequired)
+	c.check(c.do(http.MethodDelete, "/admin/purge/"+id, "", "If-Match", `"1"`), http.StatusPreconditionFailed)
+	c.check(c.do(http.MethodDelete, "/admin/purge/"+id, "", "If-Match", etag), http.StatusNoContent)
+	c.check(c.do(http.MethodPost, "/admin/restore/"+id, "", "If-Match", "*"), http.StatusNotFound)
+
+	c.check(c.do(http.MethodPost, "/admin/compact", ""), http.StatusNoContent)
+}
+
+func TestPermissions(t *testing.T) {
+	c := newClient(t)
+	c.check(c.do(http.MethodPost, "/create", `{"name":"reader","perms":1,"password":"pw"}`), http.StatusOK)
+
+	tp := auth.TokenPair{}
+	c.decode(c.check(c.do(http.MethodPost, "/login", `{"name":"reader","password":"pw"}`), http.StatusOK), &tp)
+	c.tk = tp.AccessToken
+	c.check(c.do(http.MethodGet, "/users", ""), http.StatusOK)
+	c.check(c.do(http.MethodPost, "/create", `{"name":"x"}`), http.StatusForbidden)
+	c.check(c.do(http.MethodPost, "/admin/compact", ""), http.StatusForbidden)
+	c.check(c.do(http.MethodPost, "/users/query", `{"include_deleted":true}`), http.StatusForbidden)
+
+	c.tk = ""
+	c.check(c.do(http.MethodGet, "/users", ""), http.StatusUnauthorized)
+}
+
+func TestRequestValidation(t *testing.T) {
+	c := newClient(t)
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"bad uuid", http.MethodGet, "/read/not-a-uuid", "", http.StatusBadRequest},
+		{"short uuid", http.MethodGet, "/read/00000000-0000-0000-0000-00000000000", "", http.StatusBadRequest},
+		{"bad uuid in delete", http.MethodDelete, "/delete/xyz", "", http.StatusBadRequest},
+		// uuid не версий 1-5 проверяется как в chi и gin
+		{"uuid version 0", http.MethodGet, "/read/00000000-0000-0000-0000-000000000001", "", http.StatusNotFound},
+		// нулевой uuid отклоняет обработчик
+		{"nil uuid", http.MethodGet, "/read/00000000-0000-0000-0000-000000000000", "", http.StatusBadRequest},
+		{"uuid version 7", http.MethodGet, "/read/017f22e2-79b0-7cc3-98c4-dc0c0c07398f", "", http.StatusNotFound},
+		{"limit 0", http.MethodGet, "/users?limit=0", "", http.StatusBadRequest},
+		{"limit over max", http.MethodGet, "/users?limit=1001", "", http.StatusBadRequest},
+		{"limit not a number", http.MethodGet, "/users?limit=ten", "", http.StatusBadRequest},
+		{"limit max", http.MethodGet, "/users?limit=1000", "", http.StatusOK},
+		{"unknown search mode", http.MethodGet, "/search/a?mode=regexp", "", http.StatusBadRequest},
+		{"unknown query mode", http.MethodPost, "/users/query", `{"mode":"regexp"}`, http.StatusBadRequest},
+		{"unknown sort", http.MethodPost, "/users/query", `{"sort":"id"}`, http.StatusBadRequest},
+		{"negative perms", http.MethodPost, "/users/query", `{"perms_all":-1}`, http.StatusBadRequest},
+		{"perms over int2", http.MethodPost, "/create", `{"name":"x","perms":32768}`, http.StatusBadRequest},
+		{"missing name", http.MethodPost, "/create", `{"data":"x"}`, http.StatusBadRequest},
+		{"bad json", http.MethodPost, "/create", `{"name":`, http.StatusBadRequest},
+		{"missing login body", http.MethodPost, "/login", "", http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c.t = t
+			c.check(c.do(tc.method, tc.path, tc.body), tc.status)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package routeroapi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/larikhide/reguser/api/errs"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+func init() {
+	// по умолчанию kin-openapi формат uuid не проверяет, а его RFC 4122 шаблон
+	// не пускает версии кроме 1-5 и верхний регистр; проверяем как chi и gin
+	openapi3.DefineStringFormatCallback("uuid", func(s string) error {
+		_, err := uuid.Parse(s)
+		return err
+	})
+
+	// потоковые ответы поиска проверяются как строка
+	openapi3filter.RegisterBodyDecoder("application/x-ndjson", plainBodyDecoder)
+	openapi3filter.RegisterBodyDecoder("text/event-stream", plainBodyDecoder)
+}
+
+func plainBodyDecoder(body io.Reader, _ http.Header, _ *openapi3.SchemaRef, _ openapi3filter.EncodingFn) (interface{}, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+type Option func(*RouterOpenAPI)
+
+// WithResponseValidation проверяет ответы обработчиков по спецификации,
+// onErr вызывается на каждое расхождение. Ответ буферизуется целиком,
+// поэтому режим для тестов, а не для продакшена.
+func WithResponseValidation(onErr func(r *http.Request, err error)) Option {
+	if onErr == nil {
+		panic("routeroapi: nil response validation callback")
+	}
+	return func(rt *RouterOpenAPI) {
+		rt.onRespErr = onErr
+	}
+}
+
+// validator проверяет запросы, а при включенном режиме и ответы, по спецификации
+type validator struct {
+	router    routers.Router
+	onRespErr func(r *http.Request, err error)
+}
+
+func newValidator(swg *openapi3.T, onRespErr func(r *http.Request, err error)) (*validator, error) {
+	router, err := legacy.NewRouter(swg)
+	if err != nil {
+		return nil, fmt.Errorf("openapi router error: %w", err)
+	}
+	return &validator{
+		router:    router,
+		onRespErr: onRespErr,
+	}, nil
+}
+
+func (v *validator) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := v.router.FindRoute(r)
+		if err != nil {
+			render.Render(w, r, errs.ErrInvalidRequest(err))
+			return
+		}
+
+		in := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				// аутентификация уже пройдена в authenticate
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), in); err != nil {
+			render.Render(w, r, errs.ErrInvalidRequest(err))
+			return
+		}
+
+		if v.onRespErr == nil {
+			next(w, r)
+			return
+		}
+
+		bw := &bufferedWriter{header: make(http.Header)}
+		next(bw, r)
+
+		out := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: in,
+			Status:                 bw.status(),
+			Header:                 bw.header,
+			Options: &openapi3filter.Options{
+				IncludeResponseStatus: true,
+			},
+		}
+		out.SetBodyBytes(bw.body.Bytes())
+		if err := openapi3filter.ValidateResponse(r.Context(), out); err != nil {
+			v.onRespErr(r, fmt.Errorf("%s %s: %w", r.Method, r.URL.Path, err))
+		}
+
+		bw.copyTo(w)
+	}
+}
+
+// bufferedWriter копит ответ для проверки
+type bufferedWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (bw *bufferedWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *bufferedWriter) WriteHeader(code int) {
+	if bw.code == 0 {
+		bw.code = code
+	}
+}
+
+func (bw *bufferedWriter) Write(b []byte) (int, error) {
+	if bw.code == 0 {
+		bw.code = http.StatusOK
+	}
+	return bw.body.Write(b)
+}
+
+// Flush ничего не делает, ответ уйдет целиком после проверки
+func (bw *bufferedWriter) Flush() {}
+
+func (bw *bufferedWriter) status() int {
+	if bw.code == 0 {
+		return http.StatusOK
+	}
+	return bw.code
+}
+
+func (bw *bufferedWriter) copyTo(w http.ResponseWriter) {
+	h := w.Header()
+	for k, vv := range bw.header {
+		h[k] = vv
+	}
+	w.WriteHeader(bw.status())
+	_, _ = w.Write(bw.body.Bytes())
+}
+
+func paramError(w http.ResponseWriter, r *http.Request, err error) {
+	render.Render(w, r, errs.ErrInvalidRequest(err))
+}
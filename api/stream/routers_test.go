@@ -0,0 +1,158 @@
+package stream_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/larikhide/reguser/api/auth"
+	"github.com/larikhide/reguser/api/handler"
+	"github.com/larikhide/reguser/api/routerchi"
+	"github.com/larikhide/reguser/api/routergin"
+	"github.com/larikhide/reguser/api/routeroapi"
+	"github.com/larikhide/reguser/api/stream"
+	"github.com/larikhide/reguser/app/repos/user"
+	"github.com/larikhide/reguser/db/mem/usermemstore"
+
+	"github.com/gin-gonic/gin"
+)
+
+// failStore падает в SearchUsers после after найденных пользователей,
+// отрицательный after - не падает
+type failStore struct {
+	user.UserStore
+	after int
+}
+
+func (fs *failStore) SearchUsers(ctx context.Context, q user.Query, f func(user.User) error) error {
+	n := 0
+	return fs.UserStore.SearchUsers(ctx, q, func(u user.User) error {
+		if n == fs.after {
+			return errSearch
+		}
+		n++
+		return f(u)
+	})
+}
+
+type routerCase struct {
+	name string
+	new  func(t *testing.T, hs *handler.Handlers) http.Handler
+}
+
+var routers = []routerCase{
+	{"chi", func(t *testing.T, hs *handler.Handlers) http.Handler {
+		return routerchi.NewRouterChi(hs)
+	}},
+	{"gin", func(t *testing.T, hs *handler.Handlers) http.Handler {
+		gin.SetMode(gin.TestMode)
+		return routergin.NewRouterGin(hs)
+	}},
+	{"oapi", func(t *testing.T, hs *handler.Handlers) http.Handler {
+		return routeroapi.NewRouterOpenAPI(hs, routeroapi.WithResponseValidation(func(r *http.Request, err error) {
+			t.Errorf("response validation: %v", err)
+		}))
+	}},
+}
+
+// newSearchStore заводит admin и трех пользователей u1..u3
+// и возвращает access токен admin
+func newSearchStore(t *testing.T) (*handler.Handlers, *failStore, string) {
+	t.Helper()
+	ctx := context.Background()
+	tokens, err := auth.NewTokens(auth.TokenConfig{Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &failStore{UserStore: usermemstore.NewUsers(), after: -1}
+	hs := handler.NewHandlers(user.NewUsers(fs), tokens)
+	if _, err := hs.CreateUser(ctx, handler.User{Name: "admin", Permission: user.PermAdmin, Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"u1", "u2", "u3"} {
+		if _, err := hs.CreateUser(ctx, handler.User{Name: n, Permission: user.PermReadUsers}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// по токену, чтобы не считать bcrypt на каждый запрос
+	tp, err := hs.Login(ctx, handler.LoginRequest{Name: "admin", Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hs, fs, tp.AccessToken
+}
+
+func searchRequests() map[string]func() *http.Request {
+	return map[string]func() *http.Request{
+		"search": func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/search/u", nil)
+		},
+		"query": func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/users/query", strings.NewReader(`{"name":"u"}`))
+			r.Header.Set("Content-Type", "application/json")
+			return r
+		},
+	}
+}
+
+func TestRouterSearch(t *testing.T) {
+	hs, fs, tk := newSearchStore(t)
+	for _, rc := range routers {
+		h := rc.new(t, hs)
+		for rn, newReq := range searchRequests() {
+			for _, tc := range []struct {
+				name   string
+				after  int
+				accept string
+				status int
+				body   []string
+			}{
+				{"json", -1, stream.ContentJSON, http.StatusOK,
+					[]string{"[\n", `"name":"u1"`, `"name":"u3"`, "]\n"}},
+				{"ndjson", -1, stream.ContentNDJSON, http.StatusOK,
+					[]string{`"name":"u1"`, `"name":"u3"`}},
+				{"sse", -1, stream.ContentSSE, http.StatusOK,
+					[]string{"event: user\n", `"name":"u3"`, "event: end\n"}},
+				{"json error", 2, stream.ContentJSON, http.StatusOK,
+					[]string{`"name":"u2"`, `,{"error":"`, errSearch.Error(), "]\n"}},
+				{"ndjson error", 2, stream.ContentNDJSON, http.StatusOK,
+					[]string{`"name":"u2"`, `{"error":"`, errSearch.Error()}},
+				{"sse error", 2, stream.ContentSSE, http.StatusOK,
+					[]string{`"name":"u2"`, "event: error\n", errSearch.Error(), "event: end\n"}},
+				{"error before start", 0, stream.ContentNDJSON, http.StatusInternalServerError, nil},
+				{"not acceptable", -1, "text/html", http.StatusNotAcceptable, nil},
+			} {
+				t.Run(rc.name+"/"+rn+"/"+tc.name, func(t *testing.T) {
+					fs.after = tc.after
+					r := newReq()
+					r.Header.Set("Authorization", "Bearer "+tk)
+					r.Header.Set("Accept", tc.accept)
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, r)
+
+					if w.Code != tc.status {
+						t.Fatalf("status %d, want %d, body %s", w.Code, tc.status, w.Body)
+					}
+					if tc.status == http.StatusOK {
+						if ct := w.Header().Get("Content-Type"); ct != tc.accept {
+							t.Errorf("Content-Type %q, want %q", ct, tc.accept)
+						}
+					} else if strings.Contains(w.Header().Get("Content-Type"), tc.accept) {
+						t.Errorf("error sent as %s", tc.accept)
+					}
+					body := w.Body.String()
+					for _, s := range tc.body {
+						if !strings.Contains(body, s) {
+							t.Errorf("body has no %q:\n%s", s, body)
+						}
+					}
+					if tc.after > 0 && strings.Contains(body, `"name":"u3"`) {
+						t.Errorf("user after error:\n%s", body)
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Package stream отдает результаты поиска по мере их появления
+// в формате, выбранном по заголовку Accept:
+//
+//	application/json      - JSON массив
+//	application/x-ndjson  - по пользователю на строку, ошибка последней строкой {"error": "..."}
+//	text/event-stream     - SSE, события user, error и end в конце
+//
+// Пока ничего не отправлено, ошибка отдается через fail с нормальным кодом ответа.
+// Ошибка в середине JSON массива становится его последним элементом {"error": "..."}
+// и дублируется в трейлер Search-Error.
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/larikhide/reguser/api/handler"
+)
+
+const (
+	ContentJSON   = "application/json"
+	ContentNDJSON = "application/x-ndjson"
+	ContentSSE    = "text/event-stream"
+
+	TrailerError = "Search-Error"
+)
+
+// Search вызывает f для каждого найденного пользователя
+type Search func(f func(handler.User) error) error
+
+// ErrorFunc отдает ошибку, пока в ответ еще ничего не записано
+type ErrorFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+type errRecord struct {
+	Error string `json:"error"`
+}
+
+// Negotiate выбирает формат по Accept, пустая строка - ни один не подходит
+func Negotiate(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return ContentJSON
+	}
+
+	type mr struct {
+		mt string
+		q  float64
+	}
+	var mrs []mr
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if sq, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(sq, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			mrs = append(mrs, mr{mt: mt, q: q})
+		}
+	}
+	sort.SliceStable(mrs, func(i, j int) bool { return mrs[i].q > mrs[j].q })
+
+	for _, m := range mrs {
+		switch m.mt {
+		case ContentJSON, ContentNDJSON, ContentSSE:
+			return m.mt
+		case "*/*", "application/*":
+			return ContentJSON
+		case "text/*":
+			return ContentSSE
+		}
+	}
+	return ""
+}
+
+type writer interface {
+	begin()
+	user(u handler.User) error
+	fail(err error)
+	end()
+}
+
+// Users пишет результаты search в w
+func Users(w http.ResponseWriter, r *http.Request, search Search, fail ErrorFunc) {
+	ct := Negotiate(r.Header.Get("Accept"))
+	if ct == "" {
+		http.Error(w, fmt.Sprintf("not acceptable, supported: %s, %s, %s",
+			ContentJSON, ContentNDJSON, ContentSSE), http.StatusNotAcceptable)
+		return
+	}
+
+	fl, _ := w.(http.Flusher)
+	flush := func() {
+		if fl != nil {
+			fl.Flush()
+		}
+	}
+
+	var sw writer
+	enc := json.NewEncoder(w)
+	switch ct {
+	case ContentNDJSON:
+		sw = &ndjsonWriter{w: w, enc: enc}
+	case ContentSSE:
+		sw = &sseWriter{w: w}
+	default:
+		sw = &jsonWriter{w: w, enc: enc}
+	}
+
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		h := w.Header()
+		h.Set("Content-Type", ct)
+		h.Set("Cache-Control", "no-cache")
+		h.Set("X-Content-Type-Options", "nosniff")
+		if ct == ContentJSON {
+			h.Set("Trailer", TrailerError)
+		}
+		w.WriteHeader(http.StatusOK)
+		sw.begin()
+	}
+
+	err := search(func(u handler.User) error {
+		start()
+		if err := sw.user(u); err != nil {
+			return err
+		}
+		flush()
+		return nil
+	})
+	if err != nil && !started {
+		fail(w, r, err)
+		return
+	}
+	start()
+	if err != nil {
+		sw.fail(err)
+	}
+	sw.end()
+	flush()
+}
+
+type jsonWriter struct {
+	w     http.ResponseWriter
+	enc   *json.Encoder
+	comma bool
+}
+
+func (jw *jsonWriter) begin() {
+	fmt.Fprint(jw.w, "[\n")
+}
+
+func (jw *jsonWriter) user(u handler.User) error {
+	if jw.comma {
+		fmt.Fprint(jw.w, ",")
+	}
+	jw.comma = true
+	return jw.enc.Encode(u)
+}
+
+func (jw *jsonWriter) fail(err error) {
+	jw.w.Header().Set(TrailerError, err.Error())
+	if jw.comma {
+		fmt.Fprint(jw.w, ",")
+	}
+	_ = jw.enc.Encode(errRecord{Error: err.Error()})
+}
+
+func (jw *jsonWriter) end() {
+	fmt.Fprint(jw.w, "]\n")
+}
+
+type ndjsonWriter struct {
+	w   http.ResponseWriter
+	enc *json.Encoder
+}
+
+func (nw *ndjsonWriter) begin() {}
+
+func (nw *ndjsonWriter) user(u handler.User) error {
+	return nw.enc.Encode(u)
+}
+
+func (nw *ndjsonWriter) fail(err error) {
+	_ = nw.enc.Encode(errRecord{Error: err.Error()})
+}
+
+func (nw *ndjsonWriter) end() {}
+
+type sseWriter struct {
+	w http.ResponseWriter
+}
+
+func (sw *sseWriter) event(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(sw.w, "event: %s\ndata: %s\n\n", name, b)
+	return err
+}
+
+func (sw *sseWriter) begin() {}
+
+func (sw *sseWriter) user(u handler.User) error {
+	return sw.event("user", u)
+}
+
+func (sw *sseWriter) fail(err error) {
+	_ = sw.event("error", errRecord{Error: err.Error()})
+}
+
+// end нужен чтобы EventSource не переподключался и не повторял поиск
+func (sw *sseWriter) end() {
+	_ = sw.event("end", struct{}{})
+}
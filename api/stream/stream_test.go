@@ -0,0 +1,320 @@
+package stream_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/larikhide/reguser/api/handler"
+	"github.com/larikhide/reguser/api/stream"
+
+	"github.com/google/uuid"
+)
+
+func TestNegotiate(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"", stream.ContentJSON},
+		{"  ", stream.ContentJSON},
+		{"application/json", stream.ContentJSON},
+		{"application/x-ndjson", stream.ContentNDJSON},
+		{"text/event-stream", stream.ContentSSE},
+		{"*/*", stream.ContentJSON},
+		{"application/*", stream.ContentJSON},
+		{"text/*", stream.ContentSSE},
+		{"text/html, */*;q=0.1", stream.ContentJSON},
+		{"application/json;q=0.5, application/x-ndjson", stream.ContentNDJSON},
+		{"application/json;q=0.5, text/event-stream;q=0.9", stream.ContentSSE},
+		// при равном q побеждает первый
+		{"application/x-ndjson, application/json", stream.ContentNDJSON},
+		{"text/event-stream;q=0.8, application/json;q=0.8", stream.ContentSSE},
+		// q=0 - формат запрещен
+		{"application/json;q=0, application/x-ndjson;q=0.1", stream.ContentNDJSON},
+		{"application/json;q=0", ""},
+		// битые части пропускаются
+		{"application/json;q=abc, text/event-stream", stream.ContentSSE},
+		{";;;, application/x-ndjson", stream.ContentNDJSON},
+		{"text/html", ""},
+		{"image/*, text/plain", ""},
+	} {
+		if got := stream.Negotiate(tc.accept); got != tc.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+var errSearch = errors.New("search failed")
+
+func testUsers(n int) []handler.User {
+	ret := make([]handler.User, n)
+	for i := range ret {
+		ret[i] = handler.User{ID: uuid.New(), Name: "user" + string(rune('a'+i)), Version: 1}
+	}
+	return ret
+}
+
+// search отдает users, затем возвращает err
+func search(users []handler.User, err error) stream.Search {
+	return func(f func(handler.User) error) error {
+		for _, u := range users {
+			if err := f(u); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+}
+
+// serve пишет результат search в ответ на запрос с заголовком Accept,
+// fail отвечает кодом 500
+func serve(accept string, s stream.Search) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/search/user", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	stream.Users(w, r, s, func(w http.ResponseWriter, r *http.Request, err error) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	})
+	return w
+}
+
+func checkHeaders(t *testing.T, w *httptest.ResponseRecorder, ct string) {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Content-Type"); got != ct {
+		t.Errorf("Content-Type %q, want %q", got, ct)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control %q", got)
+	}
+}
+
+func names(users []handler.User) []string {
+	ret := make([]string, len(users))
+	for i, u := range users {
+		ret[i] = u.Name
+	}
+	return ret
+}
+
+func checkNames(t *testing.T, got []handler.User, want []handler.User) {
+	t.Helper()
+	if g, w := strings.Join(names(got), ","), strings.Join(names(want), ","); g != w {
+		t.Errorf("users %s, want %s", g, w)
+	}
+}
+
+// item - элемент JSON массива или строка NDJSON: пользователь или ошибка
+type item struct {
+	handler.User
+	Error string `json:"error"`
+}
+
+func splitItems(t *testing.T, items []item) ([]handler.User, []string) {
+	t.Helper()
+	var users []handler.User
+	var errs []string
+	for _, it := range items {
+		if it.Error != "" {
+			errs = append(errs, it.Error)
+			continue
+		}
+		if len(errs) > 0 {
+			t.Errorf("user %s after error", it.Name)
+		}
+		users = append(users, it.User)
+	}
+	return users, errs
+}
+
+func TestJSON(t *testing.T) {
+	users := testUsers(3)
+	for _, tc := range []struct {
+		name  string
+		users []handler.User
+		err   error
+	}{
+		{"empty", nil, nil},
+		{"users", users, nil},
+		{"error after users", users, errSearch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve("application/json", search(tc.users, tc.err))
+			checkHeaders(t, w, stream.ContentJSON)
+
+			var items []item
+			if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+				t.Fatalf("body is not a JSON array: %v\n%s", err, w.Body)
+			}
+			got, errs := splitItems(t, items)
+			checkNames(t, got, tc.users)
+
+			trailer := w.Result().Trailer.Get(stream.TrailerError)
+			if tc.err == nil {
+				if len(errs) != 0 || trailer != "" {
+					t.Errorf("errors %q, trailer %q without a failure", errs, trailer)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0] != tc.err.Error() {
+				t.Errorf("error items %q, want [%q]", errs, tc.err)
+			}
+			if trailer != tc.err.Error() {
+				t.Errorf("trailer %q, want %q", trailer, tc.err)
+			}
+		})
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	users := testUsers(3)
+	for _, tc := range []struct {
+		name  string
+		users []handler.User
+		err   error
+	}{
+		{"empty", nil, nil},
+		{"users", users, nil},
+		{"error after users", users, errSearch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve("application/x-ndjson", search(tc.users, tc.err))
+			checkHeaders(t, w, stream.ContentNDJSON)
+
+			var items []item
+			sc := bufio.NewScanner(w.Body)
+			for sc.Scan() {
+				var it item
+				if err := json.Unmarshal(sc.Bytes(), &it); err != nil {
+					t.Fatalf("line %q: %v", sc.Text(), err)
+				}
+				items = append(items, it)
+			}
+			got, errs := splitItems(t, items)
+			checkNames(t, got, tc.users)
+			if tc.err == nil && len(errs) != 0 {
+				t.Errorf("errors %q without a failure", errs)
+			}
+			if tc.err != nil && (len(errs) != 1 || errs[0] != tc.err.Error()) {
+				t.Errorf("error lines %q, want [%q]", errs, tc.err)
+			}
+		})
+	}
+}
+
+type event struct {
+	name string
+	data string
+}
+
+func readEvents(t *testing.T, body string) []event {
+	t.Helper()
+	var ret []event
+	for _, block := range strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n") {
+		if block == "" {
+			continue
+		}
+		ev := event{}
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				ev.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				ev.data = strings.TrimPrefix(line, "data: ")
+			default:
+				t.Errorf("unexpected line %q", line)
+			}
+		}
+		ret = append(ret, ev)
+	}
+	return ret
+}
+
+func TestSSE(t *testing.T) {
+	users := testUsers(2)
+	for _, tc := range []struct {
+		name  string
+		users []handler.User
+		err   error
+	}{
+		{"empty", nil, nil},
+		{"users", users, nil},
+		{"error after users", users, errSearch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve("text/event-stream", search(tc.users, tc.err))
+			checkHeaders(t, w, stream.ContentSSE)
+
+			evs := readEvents(t, w.Body.String())
+			var got []handler.User
+			var errs []string
+			for i, ev := range evs {
+				switch ev.name {
+				case "user":
+					u := handler.User{}
+					if err := json.Unmarshal([]byte(ev.data), &u); err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, u)
+				case "error":
+					var e struct{ Error string }
+					if err := json.Unmarshal([]byte(ev.data), &e); err != nil {
+						t.Fatal(err)
+					}
+					errs = append(errs, e.Error)
+				case "end":
+					if i != len(evs)-1 {
+						t.Errorf("end is event %d of %d", i, len(evs))
+					}
+				default:
+					t.Errorf("unexpected event %q", ev.name)
+				}
+			}
+			if len(evs) == 0 || evs[len(evs)-1].name != "end" {
+				t.Errorf("no end event in %q", w.Body)
+			}
+			checkNames(t, got, tc.users)
+			if tc.err == nil && len(errs) != 0 {
+				t.Errorf("errors %q without a failure", errs)
+			}
+			if tc.err != nil && (len(errs) != 1 || errs[0] != tc.err.Error()) {
+				t.Errorf("error events %q, want [%q]", errs, tc.err)
+			}
+		})
+	}
+}
+
+func TestErrorBeforeStart(t *testing.T) {
+	for _, accept := range []string{stream.ContentJSON, stream.ContentNDJSON, stream.ContentSSE} {
+		w := serve(accept, search(nil, errSearch))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status %d, want %d", accept, w.Code, http.StatusInternalServerError)
+		}
+		if got := w.Header().Get("Content-Type"); got == accept {
+			t.Errorf("%s: error sent as %s", accept, got)
+		}
+	}
+}
+
+func TestNotAcceptable(t *testing.T) {
+	called := false
+	w := serve("text/html", func(f func(handler.User) error) error {
+		called = true
+		return nil
+	})
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("status %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+	if called {
+		t.Error("search was called for a not acceptable request")
+	}
+}
@@ -0,0 +1,65 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrBadCredentials = errors.New("bad credentials")
+
+// хеш для сравнения когда пользователь не найден, чтобы время ответа не выдавало
+// существует ли такое имя
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func hashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password error: %w", err)
+	}
+	return string(h), nil
+}
+
+// findByName возвращает пользователя с точно таким именем, ErrNotFound если его нет
+func (us *Users) findByName(ctx context.Context, name string) (*User, error) {
+	u, err := us.ustore.ReadByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if u.Name != name {
+		return nil, ErrNotFound
+	}
+	return u, nil
+}
+
+// Authenticate проверяет пару имя/пароль по хранилищу
+func (us *Users) Authenticate(ctx context.Context, name, password string) (*User, error) {
+	u, err := us.findByName(ctx, name)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("authenticate error: %w", err)
+		}
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrBadCredentials
+	}
+	if u.PassHash == "" || bcrypt.CompareHashAndPassword([]byte(u.PassHash), []byte(password)) != nil {
+		return nil, ErrBadCredentials
+	}
+	return u, nil
+}
+
+// EnsureUser создает пользователя если пользователя с таким именем еще нет,
+// нужен для заведения первого администратора
+func (us *Users) EnsureUser(ctx context.Context, u User, password string) (*User, error) {
+	// имя уникально без учета регистра, так что точного совпадения не требуется
+	eu, err := us.ustore.ReadByName(ctx, u.Name)
+	if err == nil {
+		return eu, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("ensure user error: %w", err)
+	}
+	return us.Create(ctx, u, password)
+}
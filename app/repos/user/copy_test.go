@@ -0,0 +1,94 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/larikhide/reguser/app/repos/user"
+	"github.com/larikhide/reguser/db/mem/usermemstore"
+)
+
+// bulkStore вставляет пачки по одному и запоминает их размеры
+type bulkStore struct {
+	user.UserStore
+	batches []int
+}
+
+func (bs *bulkStore) CreateMany(ctx context.Context, uu []user.User) (int, error) {
+	bs.batches = append(bs.batches, len(uu))
+	for i, u := range uu {
+		if _, err := bs.Create(ctx, u); err != nil {
+			return i, err
+		}
+	}
+	return len(uu), nil
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	src := usermemstore.NewUsers()
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var want []user.User
+	for i := 0; i < 7; i++ {
+		u := user.User{
+			Name:        fmt.Sprintf("user%d", i),
+			Data:        "data",
+			Permissions: user.PermReadUsers,
+			PassHash:    "hash",
+			CreatedAt:   created,
+		}
+		id, err := src.Create(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.ID = *id
+		want = append(want, u)
+	}
+	if err := src.Delete(ctx, want[3].ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	deleted := want[3]
+	want = append(want[:3], want[4:]...)
+
+	for _, tc := range []struct {
+		name string
+		dst  user.UserStore
+	}{
+		{"one by one", usermemstore.NewUsers()},
+		{"bulk", &bulkStore{UserStore: usermemstore.NewUsers()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := user.Copy(ctx, tc.dst, src, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(want) {
+				t.Errorf("copied %d, want %d", n, len(want))
+			}
+			for _, w := range want {
+				got, err := tc.dst.Read(ctx, w.ID)
+				if err != nil {
+					t.Fatalf("read %s: %v", w.Name, err)
+				}
+				if got.Name != w.Name || got.Data != w.Data || got.Permissions != w.Permissions ||
+					got.PassHash != w.PassHash || !got.CreatedAt.Equal(created) || got.Version != 1 {
+					t.Errorf("copied %+v, want %+v", *got, w)
+				}
+			}
+			if _, err := tc.dst.Read(ctx, deleted.ID); !errors.Is(err, user.ErrNotFound) {
+				t.Errorf("deleted user copied: %v", err)
+			}
+			if bs, ok := tc.dst.(*bulkStore); ok && fmt.Sprint(bs.batches) != "[4 2]" {
+				t.Errorf("batches %v, want [4 2]", bs.batches)
+			}
+
+			// повторный перенос упирается в занятые ID
+			if _, err := user.Copy(ctx, tc.dst, src, 4); !errors.Is(err, user.ErrConflict) {
+				t.Errorf("second copy returned %v, want %v", err, user.ErrConflict)
+			}
+		})
+	}
+}
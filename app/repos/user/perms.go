@@ -0,0 +1,21 @@
+package user
+
+// Биты User.Permissions. Их не больше 15: pgstore хранит права в int2,
+// файловое хранилище пишет их varint и не ограничивает
+const (
+	PermReadUsers = 1 << iota
+	PermCreateUsers
+	PermUpdateUsers
+	PermDeleteUsers
+
+	// PermAdmin разрешает все
+	PermAdmin
+)
+
+// Can проверяет что у пользователя есть все биты perms
+func (u User) Can(perms int) bool {
+	if u.Permissions&PermAdmin != 0 {
+		return true
+	}
+	return u.Permissions&perms == perms
+}
@@ -0,0 +1,206 @@
+package user
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// TimeRange - интервал [From, To), нулевая граница не ограничивает
+type TimeRange struct {
+	From time.Time
+	To   time.Time
+}
+
+func (tr TimeRange) IsZero() bool {
+	return tr.From.IsZero() && tr.To.IsZero()
+}
+
+func (tr TimeRange) Contains(t time.Time) bool {
+	return (tr.From.IsZero() || !t.Before(tr.From)) && (tr.To.IsZero() || t.Before(tr.To))
+}
+
+// QuerySort - поле сортировки, с минусом впереди - по убыванию
+type QuerySort string
+
+const (
+	// SortDefault - в режимах с релевантностью по ней, затем по времени создания,
+	// в SearchPrefix по имени, в остальных по времени создания.
+	// Во всех хранилищах одинаково, см. Query.order.
+	SortDefault     QuerySort = ""
+	SortName        QuerySort = "name"
+	SortNameDesc    QuerySort = "-name"
+	SortCreated     QuerySort = "created_at"
+	SortCreatedDesc QuerySort = "-created_at"
+	SortUpdated     QuerySort = "updated_at"
+	SortUpdatedDesc QuerySort = "-updated_at"
+)
+
+var ErrBadQuery = errors.New("bad query")
+
+// Query - условия SearchUsers, нулевые поля не ограничивают
+type Query struct {
+	// Name сравнивается с пользователями по правилам Mode, пустое не ограничивает
+	Name string
+	Mode SearchMode
+	// у пользователя есть все права PermsAll, хотя бы одно из PermsAny
+	// и ни одного из PermsNone
+	PermsAll  int
+	PermsAny  int
+	PermsNone int
+	Created   TimeRange
+	Updated   TimeRange
+	// Deleted отбирает только удаленных в этом интервале, IncludeDeleted
+	// для него не нужен
+	Deleted        TimeRange
+	IncludeDeleted bool
+	Sort           QuerySort
+	// Limit - сколько отдать, 0 - всех
+	Limit int
+}
+
+// Validate проверяет запрос и заполняет Mode по умолчанию
+func (q *Query) Validate() error {
+	mode, err := ParseSearchMode(string(q.Mode))
+	if err != nil {
+		return fmt.Errorf("%w: %v %q", ErrBadQuery, err, q.Mode)
+	}
+	q.Mode = mode
+	switch q.Sort {
+	case SortDefault, SortName, SortNameDesc, SortCreated, SortCreatedDesc, SortUpdated, SortUpdatedDesc:
+	default:
+		return fmt.Errorf("%w: bad sort %q", ErrBadQuery, q.Sort)
+	}
+	for name, tr := range map[string]TimeRange{"created": q.Created, "updated": q.Updated, "deleted": q.Deleted} {
+		if !tr.From.IsZero() && !tr.To.IsZero() && !tr.To.After(tr.From) {
+			return fmt.Errorf("%w: empty %s range", ErrBadQuery, name)
+		}
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("%w: negative limit", ErrBadQuery)
+	}
+	return nil
+}
+
+// WithDeleted - нужно ли хранилищу смотреть удаленных
+func (q Query) WithDeleted() bool {
+	return q.IncludeDeleted || !q.Deleted.IsZero()
+}
+
+// matchFilters проверяет все условия кроме Name
+func (q Query) matchFilters(u User) bool {
+	if u.DeletedAt.IsZero() {
+		if !q.Deleted.IsZero() {
+			return false
+		}
+	} else if !q.WithDeleted() || !q.Deleted.Contains(u.DeletedAt) {
+		return false
+	}
+	if u.Permissions&q.PermsAll != q.PermsAll ||
+		(q.PermsAny != 0 && u.Permissions&q.PermsAny == 0) ||
+		u.Permissions&q.PermsNone != 0 {
+		return false
+	}
+	return q.Created.Contains(u.CreatedAt) && q.Updated.Contains(u.UpdatedAt)
+}
+
+// Filter отбирает из uu подходящих под запрос, сортирует и обрезает по Limit.
+// Хранилища без своего языка запросов передают сюда всех кандидатов,
+// порядок uu на выдачу не влияет.
+func (q Query) Filter(uu []User) []User {
+	s := q.Name
+	if q.Mode != SearchPrefix {
+		s = normalize(s)
+	}
+	type ranked struct {
+		u    User
+		rank float64
+	}
+	var rr []ranked
+	for _, u := range uu {
+		if !q.matchFilters(u) {
+			continue
+		}
+		if q.Name == "" {
+			rr = append(rr, ranked{u, 0})
+		} else if rank, ok := match(u, s, q.Mode); ok {
+			rr = append(rr, ranked{u, rank})
+		}
+	}
+
+	less := q.order().less()
+	byRank := q.Sort == SortDefault && q.Mode.Ranked()
+	sort.Slice(rr, func(i, j int) bool {
+		if byRank && rr[i].rank != rr[j].rank {
+			return rr[i].rank > rr[j].rank
+		}
+		return less(rr[i].u, rr[j].u)
+	})
+	if q.Limit > 0 && len(rr) > q.Limit {
+		rr = rr[:q.Limit]
+	}
+
+	ret := make([]User, 0, len(rr))
+	for _, r := range rr {
+		ret = append(ret, r.u)
+	}
+	return ret
+}
+
+// order - поле сортировки запроса с учетом SortDefault: в SearchPrefix
+// по имени, как идет индекс имен, иначе по времени создания.
+// В режимах с релевантностью это порядок при равной релевантности.
+func (q Query) order() QuerySort {
+	switch {
+	case q.Sort != SortDefault:
+		return q.Sort
+	case q.Mode == SearchPrefix:
+		return SortName
+	}
+	return SortCreated
+}
+
+// less сравнивает по полю сортировки, равных - по ID, как ORDER BY поле, id
+func (qs QuerySort) less() func(a, b User) bool {
+	var cmp func(a, b User) int
+	switch qs {
+	case SortName, SortNameDesc:
+		// побайтово, как COLLATE "C"
+		cmp = func(a, b User) int {
+			switch {
+			case a.Name < b.Name:
+				return -1
+			case a.Name > b.Name:
+				return 1
+			}
+			return 0
+		}
+	case SortCreated, SortCreatedDesc:
+		cmp = func(a, b User) int { return cmpTime(a.CreatedAt, b.CreatedAt) }
+	default:
+		cmp = func(a, b User) int { return cmpTime(a.UpdatedAt, b.UpdatedAt) }
+	}
+	desc := qs[0] == '-'
+	return func(a, b User) bool {
+		c := cmp(a, b)
+		if c == 0 {
+			c = bytes.Compare(a.ID[:], b.ID[:])
+		}
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	}
+}
+
+func cmpTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
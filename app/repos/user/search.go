@@ -0,0 +1,127 @@
+package user
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SearchMode - как SearchUsers сравнивает строку поиска с пользователями
+type SearchMode string
+
+const (
+	// SearchPrefix - имя начинается со строки, с учетом регистра
+	SearchPrefix SearchMode = "prefix"
+	// SearchSubstring - строка входит в имя или данные,
+	// без учета регистра и диакритики
+	SearchSubstring SearchMode = "substring"
+	// SearchFuzzy - имя похоже на строку по триграммам, как pg_trgm,
+	// лучшие совпадения первыми
+	SearchFuzzy SearchMode = "fuzzy"
+	// SearchFulltext - все слова строки есть среди слов имени и данных,
+	// чем чаще они встречаются, тем выше пользователь
+	SearchFulltext SearchMode = "fulltext"
+)
+
+var ErrBadSearchMode = errors.New("bad search mode")
+
+// ParseSearchMode разбирает режим поиска, пустой - SearchPrefix
+func ParseSearchMode(s string) (SearchMode, error) {
+	switch m := SearchMode(s); m {
+	case "":
+		return SearchPrefix, nil
+	case SearchPrefix, SearchSubstring, SearchFuzzy, SearchFulltext:
+		return m, nil
+	}
+	return "", ErrBadSearchMode
+}
+
+// Ranked - режим, в котором результаты упорядочены по релевантности
+func (m SearchMode) Ranked() bool {
+	return m == SearchFuzzy || m == SearchFulltext
+}
+
+// порог похожести, как pg_trgm.similarity_threshold по умолчанию
+const fuzzyThreshold = 0.3
+
+// normalize приводит строку к нижнему регистру и убирает диакритику,
+// так строки сравниваются в режимах кроме SearchPrefix
+func normalize(s string) string {
+	// у цепочки есть состояние, одну на всех из разных горутин использовать нельзя
+	unaccent := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	r, _, err := transform.String(unaccent, strings.ToLower(s))
+	if err != nil {
+		return strings.ToLower(s)
+	}
+	return r
+}
+
+// words - слова из букв и цифр, как их понимают pg_trgm и to_tsvector('simple')
+func words(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// trigrams - множество триграмм строки по правилам pg_trgm:
+// каждое слово дополняется двумя пробелами спереди и одним сзади
+func trigrams(s string) map[string]struct{} {
+	ret := make(map[string]struct{})
+	for _, w := range words(s) {
+		r := []rune("  " + w + " ")
+		for i := 0; i+3 <= len(r); i++ {
+			ret[string(r[i:i+3])] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// similarity - доля общих триграмм, как similarity() из pg_trgm
+func similarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	common := 0
+	for t := range ta {
+		if _, ok := tb[t]; ok {
+			common++
+		}
+	}
+	return float64(common) / float64(len(ta)+len(tb)-common)
+}
+
+// match проверяет пользователя по строке поиска s, которая уже прошла normalize
+// (кроме SearchPrefix), и возвращает его вес для упорядочивания
+func match(u User, s string, mode SearchMode) (float64, bool) {
+	switch mode {
+	case SearchSubstring:
+		return 1, strings.Contains(normalize(u.Name), s) || strings.Contains(normalize(u.Data), s)
+	case SearchFuzzy:
+		sim := similarity(normalize(u.Name), s)
+		return sim, sim >= fuzzyThreshold
+	case SearchFulltext:
+		qw := words(s)
+		if len(qw) == 0 {
+			return 0, false
+		}
+		count := make(map[string]int)
+		for _, w := range words(normalize(u.Name + " " + u.Data)) {
+			count[w]++
+		}
+		rank := 0
+		for _, w := range qw {
+			if count[w] == 0 {
+				return 0, false
+			}
+			rank += count[w]
+		}
+		return float64(rank), true
+	default:
+		return 1, strings.HasPrefix(u.Name, s)
+	}
+}
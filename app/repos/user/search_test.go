@@ -0,0 +1,23 @@
+package user
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNormalizeConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if got := normalize("José Álvarez"); got != "jose alvarez" {
+					t.Errorf("normalize returned %q", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,1011 @@
+// Package storetest - общие проверки поведения user.UserStore.
+// Каждое хранилище должно их проходить, тогда слой выше не зависит
+// от того, какое хранилище выбрано.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+// Factory возвращает новое пустое хранилище и функцию, которая его закрывает
+type Factory func() (user.UserStore, func(), error)
+
+type check struct {
+	name string
+	fn   func(ctx context.Context, us user.UserStore) error
+}
+
+var checks = []check{
+	{"create and read", checkCreateRead},
+	{"read not found", checkNotFound},
+	{"read by name", checkReadByName},
+	{"update", checkUpdate},
+	{"duplicate id", checkDuplicate},
+	{"unique names", checkUniqueName},
+	{"soft delete", checkDelete},
+	{"restore and purge", checkRestorePurge},
+	{"versions", checkVersions},
+	{"purge deleted", checkPurgeDeleted},
+	{"search by prefix", checkSearch},
+	{"search modes", checkSearchModes},
+	{"search stops on error", checkSearchStop},
+	{"timestamps", checkTimestamps},
+	{"query filters", checkQuery},
+	{"default order", checkDefaultOrder},
+	{"list pages", checkList},
+	{"canceled context", checkCanceled},
+	{"concurrent access", checkConcurrent},
+}
+
+// Run прогоняет все проверки подтестами t, каждую на своем хранилище
+// из newStore, так что отдельную можно выбрать через -run
+func Run(t *testing.T, newStore Factory) {
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			if err := runCheck(newStore, c); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func runCheck(newStore Factory, c check) error {
+	us, closeStore, err := newStore()
+	if err != nil {
+		return fmt.Errorf("new store error: %w", err)
+	}
+	defer closeStore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return c.fn(ctx, us)
+}
+
+func newUser(name string) user.User {
+	return user.User{
+		ID:          uuid.New(),
+		Name:        name,
+		Data:        "data of " + name,
+		Permissions: user.PermReadUsers,
+		PassHash:    "hash of " + name,
+		CreatedAt:   user.Now(),
+		UpdatedAt:   user.Now(),
+	}
+}
+
+// sameUser сравнивает пользователей, время - как моменты, без учета зоны
+func sameUser(a, b user.User) bool {
+	return a.ID == b.ID && a.Name == b.Name && a.Data == b.Data &&
+		a.Permissions == b.Permissions && a.PassHash == b.PassHash &&
+		a.CreatedAt.Equal(b.CreatedAt) && a.UpdatedAt.Equal(b.UpdatedAt) &&
+		a.DeletedAt.Equal(b.DeletedAt)
+}
+
+func create(ctx context.Context, us user.UserStore, u user.User) error {
+	id, err := us.Create(ctx, u)
+	if err != nil {
+		return fmt.Errorf("create %s error: %w", u.Name, err)
+	}
+	if *id != u.ID {
+		return fmt.Errorf("create %s returned id %s, want %s", u.Name, id, u.ID)
+	}
+	return nil
+}
+
+func readEqual(ctx context.Context, us user.UserStore, want user.User) error {
+	got, err := us.Read(ctx, want.ID)
+	if err != nil {
+		return fmt.Errorf("read %s error: %w", want.Name, err)
+	}
+	if !sameUser(*got, want) {
+		return fmt.Errorf("read %+v, want %+v", *got, want)
+	}
+	return nil
+}
+
+func expectNotFound(ctx context.Context, us user.UserStore, id uuid.UUID) error {
+	if _, err := us.Read(ctx, id); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("read %s returned %v, want %v", id, err, user.ErrNotFound)
+	}
+	return nil
+}
+
+// search собирает имена найденных по префиксу s пользователей, по алфавиту
+func search(ctx context.Context, us user.UserStore, s string) ([]string, error) {
+	names, err := searchMode(ctx, us, s, user.SearchPrefix)
+	sort.Strings(names)
+	return names, err
+}
+
+// searchMode собирает имена найденных пользователей в порядке выдачи
+func searchMode(ctx context.Context, us user.UserStore, s string, mode user.SearchMode) ([]string, error) {
+	uu, err := query(ctx, us, user.Query{Name: s, Mode: mode})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, u := range uu {
+		names = append(names, u.Name)
+	}
+	return names, nil
+}
+
+// query собирает найденных по q пользователей в порядке выдачи
+func query(ctx context.Context, us user.UserStore, q user.Query) ([]user.User, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	var ret []user.User
+	err := us.SearchUsers(ctx, q, func(u user.User) error {
+		ret = append(ret, u)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("search %+v error: %w", q, err)
+	}
+	return ret, nil
+}
+
+// listAll проходит List страницами по limit и возвращает всех по порядку
+func listAll(ctx context.Context, us user.UserStore, limit int) ([]user.User, error) {
+	var ret []user.User
+	cursor := ""
+	for {
+		uu, next, err := us.List(ctx, cursor, limit)
+		if err != nil {
+			return nil, fmt.Errorf("list error: %w", err)
+		}
+		if len(uu) > limit {
+			return nil, fmt.Errorf("list returned %d users, limit %d", len(uu), limit)
+		}
+		ret = append(ret, uu...)
+		if next == "" {
+			return ret, nil
+		}
+		if len(uu) == 0 {
+			return nil, fmt.Errorf("list returned empty page with next cursor %q", next)
+		}
+		cursor = next
+	}
+}
+
+func checkCreateRead(ctx context.Context, us user.UserStore) error {
+	u := newUser("alice")
+	if err := create(ctx, us, u); err != nil {
+		return err
+	}
+	if err := readEqual(ctx, us, u); err != nil {
+		return err
+	}
+
+	// пустые поля тоже должны читаться как были, кроме времени,
+	// его хранилище заполняет само
+	e := user.User{ID: uuid.New(), Name: "empty"}
+	if err := create(ctx, us, e); err != nil {
+		return err
+	}
+	got, err := us.Read(ctx, e.ID)
+	if err != nil {
+		return fmt.Errorf("read %s error: %w", e.Name, err)
+	}
+	if got.CreatedAt.IsZero() || !got.UpdatedAt.Equal(got.CreatedAt) {
+		return fmt.Errorf("create with zero time stored created %v, updated %v", got.CreatedAt, got.UpdatedAt)
+	}
+	e.CreatedAt, e.UpdatedAt = got.CreatedAt, got.UpdatedAt
+	return readEqual(ctx, us, e)
+}
+
+func checkNotFound(ctx context.Context, us user.UserStore) error {
+	if err := expectNotFound(ctx, us, uuid.New()); err != nil {
+		return err
+	}
+	u := newUser("ghost")
+	if err := us.Update(ctx, u); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("update of missing user returned %v, want %v", err, user.ErrNotFound)
+	}
+	if err := expectNotFound(ctx, us, u.ID); err != nil {
+		return fmt.Errorf("update created missing user: %w", err)
+	}
+	if err := us.Delete(ctx, u.ID, 0); err != nil {
+		return fmt.Errorf("delete of missing user error: %w", err)
+	}
+	return nil
+}
+
+func checkReadByName(ctx context.Context, us user.UserStore) error {
+	u, other := newUser("Quinn"), newUser("quincy")
+	for _, u := range []user.User{u, other} {
+		if err := create(ctx, us, u); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{"Quinn", "QUINN"} {
+		got, err := us.ReadByName(ctx, name)
+		if err != nil {
+			return fmt.Errorf("read by name %s error: %w", name, err)
+		}
+		if !sameUser(*got, u) {
+			return fmt.Errorf("read by name %s returned %+v, want %+v", name, *got, u)
+		}
+	}
+	if _, err := us.ReadByName(ctx, "quin"); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("read by name prefix returned %v, want %v", err, user.ErrNotFound)
+	}
+
+	if err := us.Delete(ctx, u.ID, 0); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	if _, err := us.ReadByName(ctx, "Quinn"); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("read by name of deleted user returned %v, want %v", err, user.ErrNotFound)
+	}
+	return nil
+}
+
+func checkUpdate(ctx context.Context, us user.UserStore) error {
+	u := newUser("bob")
+	if err := create(ctx, us, u); err != nil {
+		return err
+	}
+	u.Name = "robert"
+	u.Data = "new data"
+	u.Permissions = user.PermReadUsers | user.PermUpdateUsers
+	u.PassHash = "new hash"
+	if err := us.Update(ctx, u); err != nil {
+		return fmt.Errorf("update error: %w", err)
+	}
+	if err := readEqual(ctx, us, u); err != nil {
+		return err
+	}
+	names, err := search(ctx, us, "bob")
+	if err != nil {
+		return err
+	}
+	if len(names) != 0 {
+		return fmt.Errorf("search by old name found %v", names)
+	}
+	return nil
+}
+
+func checkDuplicate(ctx context.Context, us user.UserStore) error {
+	u := newUser("carol")
+	if err := create(ctx, us, u); err != nil {
+		return err
+	}
+	d := u
+	d.Name = "carol2"
+	if _, err := us.Create(ctx, d); !errors.Is(err, user.ErrConflict) || user.ConflictField(err) != "id" {
+		return fmt.Errorf("create with taken id returned %v, want %v on id", err, user.ErrConflict)
+	}
+	return readEqual(ctx, us, u)
+}
+
+// expectNameConflict проверяет, что err - ErrConflict из-за имени
+func expectNameConflict(op string, err error) error {
+	if !errors.Is(err, user.ErrConflict) || user.ConflictField(err) != "name" {
+		return fmt.Errorf("%s returned %v, want %v on name", op, err, user.ErrConflict)
+	}
+	return nil
+}
+
+// checkUniqueName - имена живых уникальны без учета регистра,
+// имя удаленного свободно
+func checkUniqueName(ctx context.Context, us user.UserStore) error {
+	zoe, other := newUser("Zoe"), newUser("yan")
+	for _, u := range []user.User{zoe, other} {
+		if err := create(ctx, us, u); err != nil {
+			return err
+		}
+	}
+
+	_, err := us.Create(ctx, newUser("zoe"))
+	if err := expectNameConflict("create with taken name", err); err != nil {
+		return err
+	}
+	ren := other
+	ren.Name = "ZOE"
+	if err := expectNameConflict("rename to taken name", us.Update(ctx, ren)); err != nil {
+		return err
+	}
+	if err := readEqual(ctx, us, other); err != nil {
+		return err
+	}
+	// свое имя в другом регистре - не конфликт
+	zoe.Name = "zoe"
+	if err := us.Update(ctx, zoe); err != nil {
+		return fmt.Errorf("update of own name case error: %w", err)
+	}
+
+	if err := us.Delete(ctx, zoe.ID, 0); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	nz := newUser("ZoE")
+	if err := create(ctx, us, nz); err != nil {
+		return fmt.Errorf("name of deleted user is not free: %w", err)
+	}
+	_, err = us.Restore(ctx, zoe.ID, 0)
+	if err := expectNameConflict("restore with taken name", err); err != nil {
+		return err
+	}
+	if err := expectNotFound(ctx, us, zoe.ID); err != nil {
+		return err
+	}
+
+	// после переименования нового старое имя можно вернуть
+	nz.Name = "zed"
+	if err := us.Update(ctx, nz); err != nil {
+		return fmt.Errorf("update error: %w", err)
+	}
+	if _, err := us.Restore(ctx, zoe.ID, 0); err != nil {
+		return fmt.Errorf("restore error: %w", err)
+	}
+	return nil
+}
+
+func checkDelete(ctx context.Context, us user.UserStore) error {
+	u := newUser("dave")
+	if err := create(ctx, us, u); err != nil {
+		return err
+	}
+	if err := us.Delete(ctx, u.ID, 0); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	if err := expectNotFound(ctx, us, u.ID); err != nil {
+		return err
+	}
+	if err := us.Delete(ctx, u.ID, 0); err != nil {
+		return fmt.Errorf("second delete error: %w", err)
+	}
+	if err := us.Update(ctx, u); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("update of deleted user returned %v, want %v", err, user.ErrNotFound)
+	}
+
+	names, err := search(ctx, us, "dave")
+	if err != nil {
+		return err
+	}
+	if len(names) != 0 {
+		return fmt.Errorf("search found deleted user")
+	}
+	uu, err := listAll(ctx, us, 10)
+	if err != nil {
+		return err
+	}
+	if len(uu) != 0 {
+		return fmt.Errorf("list returned deleted user")
+	}
+
+	// удаление мягкое, ID удаленного занят
+	if _, err := us.Create(ctx, u); !errors.Is(err, user.ErrConflict) {
+		return fmt.Errorf("create with id of deleted user returned %v, want %v", err, user.ErrConflict)
+	}
+	return nil
+}
+
+func checkRestorePurge(ctx context.Context, us user.UserStore) error {
+	u := newUser("gina")
+	if err := create(ctx, us, u); err != nil {
+		return err
+	}
+	if _, err := us.Restore(ctx, u.ID, 0); !errors.Is(err, user.ErrConflict) {
+		return fmt.Errorf("restore of live user returned %v, want %v", err, user.ErrConflict)
+	}
+	if err := us.Purge(ctx, u.ID, 0); !errors.Is(err, user.ErrConflict) {
+		return fmt.Errorf("purge of live user returned %v, want %v", err, user.ErrConflict)
+	}
+	if _, err := us.Restore(ctx, uuid.New(), 0); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("restore of missing user returned %v, want %v", err, user.ErrNotFound)
+	}
+	if err := us.Purge(ctx, uuid.New(), 0); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("purge of missing user returned %v, want %v", err, user.ErrNotFound)
+	}
+
+	if err := us.Delete(ctx, u.ID, 0); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	ru, err := us.Restore(ctx, u.ID, 0)
+	if err != nil {
+		return fmt.Errorf("restore error: %w", err)
+	}
+	if ru.UpdatedAt.Before(u.UpdatedAt) {
+		return fmt.Errorf("restore set updated %v, before %v", ru.UpdatedAt, u.UpdatedAt)
+	}
+	u.UpdatedAt = ru.UpdatedAt
+	if !sameUser(*ru, u) {
+		return fmt.Errorf("restore returned %+v, want %+v", *ru, u)
+	}
+	if err := readEqual(ctx, us, u); err != nil {
+		return err
+	}
+	names, err := search(ctx, us, "gina")
+	if err != nil {
+		return err
+	}
+	if len(names) != 1 {
+		return fmt.Errorf("search after restore found %v", names)
+	}
+
+	if err := us.Delete(ctx, u.ID, 0); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	if err := us.Purge(ctx, u.ID, 0); err != nil {
+		return fmt.Errorf("purge error: %w", err)
+	}
+	if _, err := us.Restore(ctx, u.ID, 0); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("restore of purged user returned %v, want %v", err, user.ErrNotFound)
+	}
+	if err := expectNotFound(ctx, us, u.ID); err != nil {
+		return err
+	}
+
+	// после стирания ID свободен
+	if err := create(ctx, us, u); err != nil {
+		return fmt.Errorf("create with id of purged user: %w", err)
+	}
+	return readEqual(ctx, us, u)
+}
+
+// expectVersion проверяет версию живого пользователя
+func expectVersion(ctx context.Context, us user.UserStore, id uuid.UUID, want int64) error {
+	got, err := us.Read(ctx, id)
+	if err != nil {
+		return fmt.Errorf("read %s error: %w", id, err)
+	}
+	if got.Version != want {
+		return fmt.Errorf("read version %d, want %d", got.Version, want)
+	}
+	return nil
+}
+
+// checkVersions - каждое изменение увеличивает версию, а изменение
+// с устаревшей версией не проходит
+func checkVersions(ctx context.Context, us user.UserStore) error {
+	u := newUser("kate")
+	if err := create(ctx, us, u); err != nil {
+		return err
+	}
+	if err := expectVersion(ctx, us, u.ID, 1); err != nil {
+		return err
+	}
+
+	u.Version = 1
+	u.Data = "v2"
+	if err := us.Update(ctx, u); err != nil {
+		return fmt.Errorf("update with current version error: %w", err)
+	}
+	stale := u
+	stale.Data = "stale"
+	if err := us.Update(ctx, stale); !errors.Is(err, user.ErrVersionMismatch) {
+		return fmt.Errorf("update with stale version returned %v, want %v", err, user.ErrVersionMismatch)
+	}
+	if err := readEqual(ctx, us, u); err != nil {
+		return err
+	}
+	// без версии изменение проходит всегда
+	u.Version = 0
+	u.Data = "v3"
+	if err := us.Update(ctx, u); err != nil {
+		return fmt.Errorf("update without version error: %w", err)
+	}
+	if err := expectVersion(ctx, us, u.ID, 3); err != nil {
+		return err
+	}
+
+	if err := us.Delete(ctx, u.ID, 2); !errors.Is(err, user.ErrVersionMismatch) {
+		return fmt.Errorf("delete with stale version returned %v, want %v", err, user.ErrVersionMismatch)
+	}
+	if err := expectVersion(ctx, us, u.ID, 3); err != nil {
+		return fmt.Errorf("delete with stale version: %w", err)
+	}
+	if err := us.Delete(ctx, u.ID, 3); err != nil {
+		return fmt.Errorf("delete with current version error: %w", err)
+	}
+	if err := us.Delete(ctx, u.ID, 3); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("delete of deleted user with version returned %v, want %v", err, user.ErrNotFound)
+	}
+	if err := us.Delete(ctx, uuid.New(), 1); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("delete of missing user with version returned %v, want %v", err, user.ErrNotFound)
+	}
+
+	// удаление - тоже изменение, Restore сверяет версию удаленного
+	if _, err := us.Restore(ctx, u.ID, 3); !errors.Is(err, user.ErrVersionMismatch) {
+		return fmt.Errorf("restore with stale version returned %v, want %v", err, user.ErrVersionMismatch)
+	}
+	if _, err := us.Restore(ctx, uuid.New(), 4); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("restore of missing user with version returned %v, want %v", err, user.ErrNotFound)
+	}
+	ru, err := us.Restore(ctx, u.ID, 4)
+	if err != nil {
+		return fmt.Errorf("restore with current version error: %w", err)
+	}
+	if ru.Version != 5 {
+		return fmt.Errorf("restore returned version %d, want 5", ru.Version)
+	}
+	if _, err := us.Restore(ctx, u.ID, 5); !errors.Is(err, user.ErrConflict) {
+		return fmt.Errorf("restore of live user with version returned %v, want %v", err, user.ErrConflict)
+	}
+	if err := expectVersion(ctx, us, u.ID, 5); err != nil {
+		return err
+	}
+
+	// Purge тоже сверяет версию удаленного
+	if err := us.Delete(ctx, u.ID, 5); err != nil {
+		return fmt.Errorf("delete with current version error: %w", err)
+	}
+	if err := us.Purge(ctx, u.ID, 5); !errors.Is(err, user.ErrVersionMismatch) {
+		return fmt.Errorf("purge with stale version returned %v, want %v", err, user.ErrVersionMismatch)
+	}
+	if err := us.Purge(ctx, u.ID, 6); err != nil {
+		return fmt.Errorf("purge with current version error: %w", err)
+	}
+	if _, err := us.Restore(ctx, u.ID, 0); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("restore of purged user returned %v, want %v", err, user.ErrNotFound)
+	}
+	return nil
+}
+
+func checkPurgeDeleted(ctx context.Context, us user.UserStore) error {
+	live, old := newUser("henry"), newUser("ivan")
+	for _, u := range []user.User{live, old} {
+		if err := create(ctx, us, u); err != nil {
+			return err
+		}
+	}
+	if err := us.Delete(ctx, old.ID, 0); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+
+	n, err := us.PurgeDeleted(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		return fmt.Errorf("purge deleted error: %w", err)
+	}
+	if n != 0 {
+		return fmt.Errorf("purge deleted before an hour ago purged %d users", n)
+	}
+
+	n, err = us.PurgeDeleted(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		return fmt.Errorf("purge deleted error: %w", err)
+	}
+	if n != 1 {
+		return fmt.Errorf("purge deleted purged %d users, want 1", n)
+	}
+	if _, err := us.Restore(ctx, old.ID, 0); !errors.Is(err, user.ErrNotFound) {
+		return fmt.Errorf("restore of purged user returned %v, want %v", err, user.ErrNotFound)
+	}
+	return readEqual(ctx, us, live)
+}
+
+func checkSearch(ctx context.Context, us user.UserStore) error {
+	for _, n := range []string{"alice", "alicia", "ali", "bob", "malice", "Alina"} {
+		if err := create(ctx, us, newUser(n)); err != nil {
+			return err
+		}
+	}
+
+	for s, want := range map[string][]string{
+		"ali":   {"ali", "alice", "alicia"},
+		"alic":  {"alice", "alicia"},
+		"alice": {"alice"},
+		"z":     nil,
+	} {
+		got, err := search(ctx, us, s)
+		if err != nil {
+			return err
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			return fmt.Errorf("search %q found %v, want %v", s, got, want)
+		}
+	}
+
+	all, err := search(ctx, us, "")
+	if err != nil {
+		return err
+	}
+	if len(all) != 6 {
+		return fmt.Errorf("search by empty prefix found %v, want all 6 users", all)
+	}
+	return nil
+}
+
+// checkSearchModes сверяет режимы поиска кроме префиксного: у хранилищ
+// разные движки, но на простых данных результаты должны совпадать
+var errStop = errors.New("stop")
+
+// checkSearchStop - ошибка f останавливает поиск и возвращается из SearchUsers
+func checkSearchStop(ctx context.Context, us user.UserStore) error {
+	for _, n := range []string{"stop1", "stop2", "stop3"} {
+		if err := create(ctx, us, newUser(n)); err != nil {
+			return err
+		}
+	}
+	calls := 0
+	err := us.SearchUsers(ctx, user.Query{Name: "stop", Mode: user.SearchPrefix}, func(user.User) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		return fmt.Errorf("search returned %v, want error of callback", err)
+	}
+	if calls != 1 {
+		return fmt.Errorf("search called back %d times after error, want 1", calls)
+	}
+	return nil
+}
+
+func checkSearchModes(ctx context.Context, us user.UserStore) error {
+	for _, nd := range [][2]string{
+		{"José Álvarez", "Madrid office"},
+		{"jose alvarez", "Lisbon"},
+		{"Alvarez", ""},
+		{"Marta", "madrid office, office team"},
+		{"Percy", "100% done"},
+	} {
+		u := newUser(nd[0])
+		u.Data = nd[1]
+		if err := create(ctx, us, u); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range []struct {
+		mode  user.SearchMode
+		s     string
+		first string // у режимов с релевантностью
+		want  []string
+	}{
+		{user.SearchPrefix, "jos", "", []string{"jose alvarez"}},
+		{user.SearchSubstring, "ALVAR", "", []string{"Alvarez", "José Álvarez", "jose alvarez"}},
+		{user.SearchSubstring, "madrid", "", []string{"José Álvarez", "Marta"}},
+		{user.SearchSubstring, "%", "", []string{"Percy"}},
+		{user.SearchSubstring, "_", "", nil},
+		{user.SearchFuzzy, "Mrta", "Marta", []string{"Marta"}},
+		{user.SearchFuzzy, "alvarez", "Alvarez", []string{"Alvarez", "José Álvarez", "jose alvarez"}},
+		{user.SearchFulltext, "office", "Marta", []string{"José Álvarez", "Marta"}},
+		{user.SearchFulltext, "MADRID Office", "", []string{"José Álvarez", "Marta"}},
+		{user.SearchFulltext, "jose", "", []string{"José Álvarez", "jose alvarez"}},
+		{user.SearchFulltext, "office lisbon", "", nil},
+	} {
+		got, err := searchMode(ctx, us, c.s, c.mode)
+		if err != nil {
+			return err
+		}
+		if c.first != "" && (len(got) == 0 || got[0] != c.first) {
+			return fmt.Errorf("search %s %q found %v, want %s first", c.mode, c.s, got, c.first)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			return fmt.Errorf("search %s %q found %v, want %v", c.mode, c.s, got, c.want)
+		}
+	}
+	return nil
+}
+
+// checkTimestamps - время создания и изменения ставит хранилище, если его нет,
+// а время удаления - всегда. Все время хранится с точностью до микросекунды.
+func checkTimestamps(ctx context.Context, us user.UserStore) error {
+	start := user.Now()
+	u := user.User{ID: uuid.New(), Name: "kate"}
+	if err := create(ctx, us, u); err != nil {
+		return err
+	}
+	got, err := us.Read(ctx, u.ID)
+	if err != nil {
+		return fmt.Errorf("read error: %w", err)
+	}
+	if got.CreatedAt.Before(start) || got.CreatedAt.After(user.Now()) {
+		return fmt.Errorf("created %v, want between %v and now", got.CreatedAt, start)
+	}
+	if !got.DeletedAt.IsZero() {
+		return fmt.Errorf("live user deleted at %v", got.DeletedAt)
+	}
+
+	// время создания Update не меняет, даже если передали другое
+	created := got.CreatedAt
+	u = *got
+	u.Data = "changed"
+	u.CreatedAt = created.Add(time.Hour)
+	u.UpdatedAt = time.Time{}
+	if err := us.Update(ctx, u); err != nil {
+		return fmt.Errorf("update error: %w", err)
+	}
+	if got, err = us.Read(ctx, u.ID); err != nil {
+		return fmt.Errorf("read error: %w", err)
+	}
+	if !got.CreatedAt.Equal(created) {
+		return fmt.Errorf("update changed created from %v to %v", created, got.CreatedAt)
+	}
+	if got.UpdatedAt.Before(created) {
+		return fmt.Errorf("update set updated %v, before created %v", got.UpdatedAt, created)
+	}
+
+	if err := us.Delete(ctx, u.ID, 0); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	uu, err := query(ctx, us, user.Query{IncludeDeleted: true})
+	if err != nil {
+		return err
+	}
+	if len(uu) != 1 {
+		return fmt.Errorf("search with deleted found %d users, want 1", len(uu))
+	}
+	if d := uu[0].DeletedAt; d.Before(got.UpdatedAt) || d.After(user.Now()) {
+		return fmt.Errorf("deleted %v, want between update at %v and now", d, got.UpdatedAt)
+	}
+	ru, err := us.Restore(ctx, u.ID, 0)
+	if err != nil {
+		return fmt.Errorf("restore error: %w", err)
+	}
+	if !ru.DeletedAt.IsZero() || !ru.CreatedAt.Equal(created) {
+		return fmt.Errorf("restore returned deleted %v, created %v", ru.DeletedAt, ru.CreatedAt)
+	}
+	return nil
+}
+
+func checkQuery(ctx context.Context, us user.UserStore) error {
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, c := range []struct {
+		name    string
+		perms   int
+		updated time.Duration
+	}{
+		{"qa", user.PermReadUsers, 5 * time.Hour},
+		{"qb", user.PermReadUsers | user.PermUpdateUsers, time.Hour},
+		{"qc", user.PermAdmin, 2 * time.Hour},
+		{"qd", user.PermReadUsers | user.PermDeleteUsers, 3 * time.Hour},
+	} {
+		u := newUser(c.name)
+		u.Permissions = c.perms
+		u.CreatedAt = base.Add(time.Duration(i) * time.Hour)
+		u.UpdatedAt = base.Add(c.updated)
+		if err := create(ctx, us, u); err != nil {
+			return err
+		}
+		if c.name == "qd" {
+			if err := us.Delete(ctx, u.ID, 0); err != nil {
+				return fmt.Errorf("delete error: %w", err)
+			}
+		}
+	}
+	deletedFrom := user.Now().Add(-time.Minute)
+
+	for _, c := range []struct {
+		q       user.Query
+		ordered bool
+		want    []string
+	}{
+		{user.Query{}, false, []string{"qa", "qb", "qc"}},
+		{user.Query{PermsAll: user.PermReadUsers}, false, []string{"qa", "qb"}},
+		{user.Query{PermsAny: user.PermUpdateUsers | user.PermAdmin}, false, []string{"qb", "qc"}},
+		{user.Query{PermsNone: user.PermReadUsers}, false, []string{"qc"}},
+		{user.Query{Created: user.TimeRange{From: base.Add(time.Hour), To: base.Add(3 * time.Hour)}}, false, []string{"qb", "qc"}},
+		{user.Query{Updated: user.TimeRange{From: base.Add(4 * time.Hour)}}, false, []string{"qa"}},
+		{user.Query{IncludeDeleted: true}, false, []string{"qa", "qb", "qc", "qd"}},
+		{user.Query{Deleted: user.TimeRange{From: deletedFrom}}, false, []string{"qd"}},
+		{user.Query{Deleted: user.TimeRange{To: deletedFrom}}, false, nil},
+		{user.Query{Sort: user.SortNameDesc, Limit: 2}, true, []string{"qc", "qb"}},
+		{user.Query{Sort: user.SortCreatedDesc, IncludeDeleted: true, Limit: 3}, true, []string{"qd", "qc", "qb"}},
+		{user.Query{Sort: user.SortUpdated}, true, []string{"qb", "qc", "qa"}},
+		{user.Query{Name: "q", PermsAll: user.PermReadUsers, Sort: user.SortName}, true, []string{"qa", "qb"}},
+		{user.Query{Name: "QC", Mode: user.SearchSubstring}, false, []string{"qc"}},
+	} {
+		uu, err := query(ctx, us, c.q)
+		if err != nil {
+			return err
+		}
+		var got []string
+		for _, u := range uu {
+			got = append(got, u.Name)
+		}
+		if !c.ordered {
+			sort.Strings(got)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			return fmt.Errorf("query %+v found %v, want %v", c.q, got, c.want)
+		}
+	}
+
+	q := user.Query{Sort: "age"}
+	if err := q.Validate(); !errors.Is(err, user.ErrBadQuery) {
+		return fmt.Errorf("validate of bad sort returned %v, want %v", err, user.ErrBadQuery)
+	}
+	return nil
+}
+
+// checkDefaultOrder - порядок без Sort одинаков во всех хранилищах:
+// в SearchPrefix имена побайтово, в остальных режимах по времени создания
+func checkDefaultOrder(ctx context.Context, us user.UserStore) error {
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"b", "_x", "Zed", "alpha", "Ab"} {
+		u := newUser(name)
+		u.CreatedAt = base.Add(time.Duration(i) * time.Hour)
+		u.UpdatedAt = u.CreatedAt
+		if err := create(ctx, us, u); err != nil {
+			return err
+		}
+		if name == "Ab" {
+			if err := us.Delete(ctx, u.ID, 0); err != nil {
+				return fmt.Errorf("delete error: %w", err)
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		q    user.Query
+		want []string
+	}{
+		{user.Query{}, []string{"Zed", "_x", "alpha", "b"}},
+		{user.Query{IncludeDeleted: true}, []string{"Ab", "Zed", "_x", "alpha", "b"}},
+		{user.Query{Name: "Z"}, []string{"Zed"}},
+		{user.Query{Mode: user.SearchSubstring}, []string{"b", "_x", "Zed", "alpha"}},
+		{user.Query{Name: "B", Mode: user.SearchSubstring, IncludeDeleted: true}, []string{"b", "Ab"}},
+	} {
+		uu, err := query(ctx, us, c.q)
+		if err != nil {
+			return err
+		}
+		var got []string
+		for _, u := range uu {
+			got = append(got, u.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			return fmt.Errorf("query %+v found %v, want %v", c.q, got, c.want)
+		}
+	}
+	return nil
+}
+
+func checkList(ctx context.Context, us user.UserStore) error {
+	if _, _, err := us.List(ctx, "not a cursor", 10); !errors.Is(err, user.ErrBadCursor) {
+		return fmt.Errorf("list with bad cursor returned %v, want %v", err, user.ErrBadCursor)
+	}
+
+	want := make(map[uuid.UUID]user.User)
+	for i := 0; i < 7; i++ {
+		u := newUser(fmt.Sprintf("user%d", i))
+		if err := create(ctx, us, u); err != nil {
+			return err
+		}
+		want[u.ID] = u
+	}
+
+	for _, limit := range []int{1, 2, 3, 7, 100} {
+		uu, err := listAll(ctx, us, limit)
+		if err != nil {
+			return err
+		}
+		if len(uu) != len(want) {
+			return fmt.Errorf("list by %d returned %d users, want %d", limit, len(uu), len(want))
+		}
+		seen := make(map[uuid.UUID]bool)
+		for _, u := range uu {
+			if seen[u.ID] {
+				return fmt.Errorf("list by %d returned %s twice", limit, u.Name)
+			}
+			seen[u.ID] = true
+			if !sameUser(u, want[u.ID]) {
+				return fmt.Errorf("list by %d returned %+v, want %+v", limit, u, want[u.ID])
+			}
+		}
+	}
+	return nil
+}
+
+// checkCanceled - отмененный контекст не дает ничего изменить
+func checkCanceled(ctx context.Context, us user.UserStore) error {
+	u := newUser("erin")
+	if err := create(ctx, us, u); err != nil {
+		return err
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := us.Create(cctx, newUser("frank")); err == nil {
+		return fmt.Errorf("create with canceled context succeeded")
+	}
+	if _, err := us.Read(cctx, u.ID); err == nil {
+		return fmt.Errorf("read with canceled context succeeded")
+	}
+	nu := u
+	nu.Data = "changed"
+	if err := us.Update(cctx, nu); err == nil {
+		return fmt.Errorf("update with canceled context succeeded")
+	}
+	if err := us.Delete(cctx, u.ID, 0); err == nil {
+		return fmt.Errorf("delete with canceled context succeeded")
+	}
+	if _, _, err := us.List(cctx, "", 10); err == nil {
+		return fmt.Errorf("list with canceled context succeeded")
+	}
+	err := us.SearchUsers(cctx, user.Query{Mode: user.SearchPrefix}, func(user.User) error { return nil })
+	if !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("search with canceled context returned %v, want %v", err, context.Canceled)
+	}
+
+	names, err := search(ctx, us, "frank")
+	if err != nil {
+		return err
+	}
+	if len(names) != 0 {
+		return fmt.Errorf("create with canceled context left a user")
+	}
+	return readEqual(ctx, us, u)
+}
+
+// checkConcurrent - параллельные изменения не теряются и не портят хранилище
+func checkConcurrent(ctx context.Context, us user.UserStore) error {
+	const workers, perWorker = 8, 20
+
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				u := newUser(fmt.Sprintf("w%d-u%d", w, i))
+				if err := create(ctx, us, u); err != nil {
+					fail(err)
+					return
+				}
+				u.Data = "updated"
+				if err := us.Update(ctx, u); err != nil {
+					fail(fmt.Errorf("update error: %w", err))
+					return
+				}
+				if err := readEqual(ctx, us, u); err != nil {
+					fail(err)
+					return
+				}
+				if i%2 == 1 {
+					if err := us.Delete(ctx, u.ID, 0); err != nil {
+						fail(fmt.Errorf("delete error: %w", err))
+						return
+					}
+				}
+				if _, err := search(ctx, us, fmt.Sprintf("w%d-", w)); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	uu, err := listAll(ctx, us, 17)
+	if err != nil {
+		return err
+	}
+	if len(uu) != workers*perWorker/2 {
+		return fmt.Errorf("list returned %d users, want %d", len(uu), workers*perWorker/2)
+	}
+	for _, u := range uu {
+		if u.Data != "updated" {
+			return fmt.Errorf("user %s lost update", u.Name)
+		}
+	}
+	return nil
+}
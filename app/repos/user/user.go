@@ -2,7 +2,11 @@ package user
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -12,14 +16,97 @@ type User struct {
 	Name        string
 	Data        string
 	Permissions int
+	PassHash    string // bcrypt-хеш пароля, сам пароль не храним
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   time.Time // нулевое у живых
+	// Version растет на 1 с каждым изменением пользователя, начиная с 1
+	Version int64
 }
 
-// нужен только тут
+// ConflictError - ErrConflict с полем, значение которого занято: "id" или "name"
+type ConflictError struct {
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: %s is taken", ErrConflict, e.Field)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// ConflictField возвращает поле из ConflictError в цепочке err, "" если его нет
+func ConflictField(err error) string {
+	var ce *ConflictError
+	if errors.As(err, &ce) {
+		return ce.Field
+	}
+	return ""
+}
+
+// NameKey - ключ уникальности имени: имена живых пользователей
+// не должны совпадать без учета регистра
+func NameKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// Now - текущее время с точностью, которую сохраняют все хранилища
+func Now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// Ошибки хранилищ, хранилища возвращают их (или обернутыми) вместо своих
+var (
+	// ErrNotFound - пользователя нет или он удален
+	ErrNotFound = errors.New("user not found")
+	// ErrConflict - пользователь с таким ID или именем уже есть
+	// (тогда это *ConflictError) или не в том состоянии для операции
+	ErrConflict = errors.New("user conflict")
+	// ErrValidation - пользователь не проходит ограничения хранилища
+	ErrValidation = errors.New("invalid user")
+	// ErrVersionMismatch - пользователь уже изменен, его версия не та,
+	// которую ожидал вызывающий
+	ErrVersionMismatch = errors.New("user version mismatch")
+)
+
+// Read и Update возвращают ErrNotFound, если пользователя нет,
+// Create - ErrConflict на занятый ID, Create, Update и Restore - ErrConflict
+// на имя, занятое другим живым пользователем (см. NameKey),
+// Create и Update - ErrValidation, если пользователь не влезает в ограничения хранилища.
+// Delete несуществующего пользователя не ошибка.
+// Нулевые CreatedAt и UpdatedAt в Create хранилище заполняет текущим временем,
+// Update меняет UpdatedAt так же, но CreatedAt оставляет прежним.
+// Create сохраняет пользователя с Version 1, Update, Delete и Restore
+// увеличивают ее на 1. Update с ненулевой u.Version, Delete и Restore с ненулевой
+// version сначала сверяют ее с хранимой и возвращают ErrVersionMismatch,
+// если пользователя уже изменили, а Delete с version - ErrNotFound,
+// если живого пользователя нет. Restore и Purge сверяют версию удаленного.
+// Удаление мягкое: удаленного можно вернуть через Restore или стереть через Purge,
+// пока он не стерт, его ID занят. Restore и Purge возвращают ErrNotFound,
+// если удаленного с таким ID нет, и ErrConflict, если пользователь не удален.
 type UserStore interface {
 	Create(ctx context.Context, u User) (*uuid.UUID, error)
 	Read(ctx context.Context, uid uuid.UUID) (*User, error)
-	Delete(ctx context.Context, uid uuid.UUID) error
-	SearchUsers(ctx context.Context, s string) (chan User, error)
+	// ReadByName возвращает живого пользователя с именем name без учета
+	// регистра (см. NameKey), ErrNotFound если его нет. Если таких несколько,
+	// что бывает только у записанных до проверки имен, - с точно таким именем.
+	ReadByName(ctx context.Context, name string) (*User, error)
+	Update(ctx context.Context, u User) error
+	Delete(ctx context.Context, uid uuid.UUID, version int64) error
+	// SearchUsers вызывает f для пользователей, подходящих под уже
+	// проверенный Validate запрос, в его порядке сортировки. Ошибку f,
+	// отмену ctx или свою ошибку возвращает, не дойдя до конца.
+	SearchUsers(ctx context.Context, q Query, f func(User) error) error
+	// List возвращает до limit пользователей после cursor в стабильном порядке
+	// и курсор следующей страницы, пустой если страница последняя.
+	// Пустой cursor - с начала, формат курсора знает только хранилище.
+	List(ctx context.Context, cursor string, limit int) ([]User, string, error)
+	Restore(ctx context.Context, uid uuid.UUID, version int64) (*User, error)
+	Purge(ctx context.Context, uid uuid.UUID, version int64) error
+	// PurgeDeleted стирает удаленных раньше before и возвращает, сколько стерто
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
 }
 
 type Users struct {
@@ -32,8 +119,19 @@ func NewUsers(ustore UserStore) *Users {
 	}
 }
 
-func (us *Users) Create(ctx context.Context, u User) (*User, error) {
+func (us *Users) Create(ctx context.Context, u User, password string) (*User, error) {
 	u.ID = uuid.New()
+	u.CreatedAt = Now()
+	u.UpdatedAt = u.CreatedAt
+	u.DeletedAt = time.Time{}
+	u.Version = 1
+	if password != "" {
+		h, err := hashPassword(password)
+		if err != nil {
+			return nil, fmt.Errorf("create user error: %w", err)
+		}
+		u.PassHash = h
+	}
 	id, err := us.ustore.Create(ctx, u)
 	if err != nil {
 		return nil, fmt.Errorf("create user error: %w", err)
@@ -50,36 +148,187 @@ func (us *Users) Read(ctx context.Context, uid uuid.UUID) (*User, error) {
 	return u, nil
 }
 
-func (us *Users) Delete(ctx context.Context, uid uuid.UUID) (*User, error) {
+// Update заменяет пользователя целиком, пустой password оставляет прежний.
+// Ненулевая u.Version - версия, которую видел вызывающий, с нулевой
+// Update не затирает только изменения, сделанные после его же чтения.
+func (us *Users) Update(ctx context.Context, u User, password string) (*User, error) {
+	ou, err := us.ustore.Read(ctx, u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("search user error: %w", err)
+	}
+	if u.Version != 0 && u.Version != ou.Version {
+		return nil, fmt.Errorf("update user error: %w", ErrVersionMismatch)
+	}
+	u.Version = ou.Version
+	u.PassHash = ou.PassHash
+	u.CreatedAt = ou.CreatedAt
+	u.UpdatedAt = Now()
+	u.DeletedAt = time.Time{}
+	if password != "" {
+		h, err := hashPassword(password)
+		if err != nil {
+			return nil, fmt.Errorf("update user error: %w", err)
+		}
+		u.PassHash = h
+	}
+	if err := us.ustore.Update(ctx, u); err != nil {
+		return nil, fmt.Errorf("update user error: %w", err)
+	}
+	u.Version++
+	return &u, nil
+}
+
+// Delete удаляет пользователя и возвращает его таким, каким он был до удаления,
+// но с версией надгробия: по ней удаленного возвращают и стирают.
+// Ненулевая version - версия, которую видел вызывающий.
+func (us *Users) Delete(ctx context.Context, uid uuid.UUID, version int64) (*User, error) {
 	u, err := us.ustore.Read(ctx, uid)
 	if err != nil {
 		return nil, fmt.Errorf("search user error: %w", err)
 	}
-	return u, us.ustore.Delete(ctx, uid)
+	if version != 0 && version != u.Version {
+		return nil, fmt.Errorf("delete user error: %w", ErrVersionMismatch)
+	}
+	// удаляем ровно ту версию, которую отдаем
+	if err := us.ustore.Delete(ctx, uid, u.Version); err != nil {
+		return nil, fmt.Errorf("delete user error: %w", err)
+	}
+	u.Version++
+	return u, nil
+}
+
+// Restore возвращает мягко удаленного пользователя.
+// Ненулевая version - версия удаленного, которую видел вызывающий.
+func (us *Users) Restore(ctx context.Context, uid uuid.UUID, version int64) (*User, error) {
+	u, err := us.ustore.Restore(ctx, uid, version)
+	if err != nil {
+		return nil, fmt.Errorf("restore user error: %w", err)
+	}
+	return u, nil
+}
+
+// Purge окончательно стирает удаленного пользователя.
+// Ненулевая version - версия удаленного, которую видел вызывающий.
+func (us *Users) Purge(ctx context.Context, uid uuid.UUID, version int64) error {
+	if err := us.ustore.Purge(ctx, uid, version); err != nil {
+		return fmt.Errorf("purge user error: %w", err)
+	}
+	return nil
+}
+
+// PurgeDeleted стирает пользователей, удаленных больше retention назад
+func (us *Users) PurgeDeleted(ctx context.Context, retention time.Duration) (int, error) {
+	n, err := us.ustore.PurgeDeleted(ctx, time.Now().Add(-retention))
+	if err != nil {
+		return n, fmt.Errorf("purge deleted users error: %w", err)
+	}
+	return n, nil
+}
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 1000
+)
+
+var ErrBadCursor = errors.New("bad cursor")
+
+// List отдает страницу пользователей, курсор для клиента непрозрачный
+func (us *Users) List(ctx context.Context, cursor string, limit int) ([]User, string, error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	var scur string
+	if cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", ErrBadCursor
+		}
+		scur = string(b)
+	}
+	uu, next, err := us.ustore.List(ctx, scur, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("list users error: %w", err)
+	}
+	if next != "" {
+		next = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+	return uu, next, nil
 }
 
-func (us *Users) SearchUsers(ctx context.Context, s string) (chan User, error) {
+func (us *Users) SearchUsers(ctx context.Context, q Query, f func(User) error) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
 	// FIXME: здесь нужно использвоать паттерн Unit of Work
 	// бизнес-транзакция
-	chin, err := us.ustore.SearchUsers(ctx, s)
-	if err != nil {
-		return nil, err
-	}
-	chout := make(chan User, 100)
-	go func() {
-		defer close(chout)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case u, ok := <-chin:
-				if !ok {
-					return
+	return us.ustore.SearchUsers(ctx, q, f)
+}
+
+// Compactor реализуют хранилища, которым нужно сжатие данных
+type Compactor interface {
+	Compact(ctx context.Context) error
+}
+
+var ErrNotSupported = errors.New("not supported by store")
+
+// Compact сжимает данные хранилища, если оно это умеет
+func (us *Users) Compact(ctx context.Context) error {
+	c, ok := us.ustore.(Compactor)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := c.Compact(ctx); err != nil {
+		return fmt.Errorf("compact error: %w", err)
+	}
+	return nil
+}
+
+// BulkCreator реализуют хранилища, которые вставляют пачку пользователей
+// быстрее, чем по одному
+type BulkCreator interface {
+	// CreateMany сохраняет пользователей с их ID, временем и паролем,
+	// всех или никого, и возвращает, сколько вставлено
+	CreateMany(ctx context.Context, uu []User) (int, error)
+}
+
+// Copy переносит живых пользователей из src в dst пачками по batch
+// и возвращает, сколько перенесено. Пачка уходит в CreateMany, если dst
+// его умеет, иначе пользователи создаются по одному. Удаленные не переносятся,
+// версии в dst начинаются заново с 1.
+func Copy(ctx context.Context, dst, src UserStore, batch int) (int, error) {
+	if batch <= 0 {
+		batch = DefaultListLimit
+	}
+	bc, bulk := dst.(BulkCreator)
+	n := 0
+	cursor := ""
+	for {
+		uu, next, err := src.List(ctx, cursor, batch)
+		if err != nil {
+			return n, fmt.Errorf("list error: %w", err)
+		}
+		switch {
+		case len(uu) == 0:
+		case bulk:
+			k, err := bc.CreateMany(ctx, uu)
+			if err != nil {
+				return n, fmt.Errorf("create many error: %w", err)
+			}
+			n += k
+		default:
+			for _, u := range uu {
+				if _, err := dst.Create(ctx, u); err != nil {
+					return n, fmt.Errorf("create user %s error: %w", u.ID, err)
 				}
-				u.Permissions = 0755
-				chout <- u
+				n++
 			}
 		}
-	}()
-	return chout, nil
+		if next == "" {
+			return n, nil
+		}
+		cursor = next
+	}
 }
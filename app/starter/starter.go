@@ -2,7 +2,10 @@ package starter
 
 import (
 	"context"
+	"errors"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/larikhide/reguser/app/repos/user"
 )
@@ -29,3 +32,45 @@ func (a *App) Serve(ctx context.Context, wg *sync.WaitGroup, hs HTTPServer) {
 	<-ctx.Done()
 	hs.Stop()
 }
+
+// CompactEvery периодически сжимает хранилище, если оно это умеет
+func (a *App) CompactEvery(ctx context.Context, wg *sync.WaitGroup, d time.Duration) {
+	defer wg.Done()
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := a.us.Compact(ctx); err != nil {
+				log.Println(err)
+				if errors.Is(err, user.ErrNotSupported) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// PurgeEvery раз в d стирает пользователей, удаленных больше retention назад
+func (a *App) PurgeEvery(ctx context.Context, wg *sync.WaitGroup, d, retention time.Duration) {
+	defer wg.Done()
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := a.us.PurgeDeleted(ctx, retention)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("purged %d deleted users", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/larikhide/reguser/app/repos/user"
+	"github.com/larikhide/reguser/db/fstore/userfstore"
+	"github.com/larikhide/reguser/db/sql/pgstore"
+)
+
+const importUsage = "usage: reguser import <data dir>, database from DATABASE_URL"
+
+// пачка на один COPY
+const importBatch = 1000
+
+// importUsers - подкоманда reguser import, переносит живых пользователей
+// файлового хранилища в postgres, например при переходе с REGUSER_STORE=file на pg
+func importUsers(args []string) {
+	if len(args) != 1 {
+		log.Fatal(importUsage)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	fst, err := userfstore.NewUserFileStore(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fst.Close()
+
+	popts, err := pgOptionsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pgst, err := pgstore.NewUsers(os.Getenv("DATABASE_URL"), popts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pgst.Close()
+
+	n, err := user.Copy(ctx, pgst, fst, importBatch)
+	log.Printf("imported %d users", n)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
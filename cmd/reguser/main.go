@@ -2,22 +2,36 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/larikhide/reguser/api/auth"
 	"github.com/larikhide/reguser/api/handler"
 	"github.com/larikhide/reguser/api/routeroapi"
 	"github.com/larikhide/reguser/api/server"
 	"github.com/larikhide/reguser/app/repos/user"
 	"github.com/larikhide/reguser/app/starter"
+	"github.com/larikhide/reguser/db/fstore/userfstore"
 	"github.com/larikhide/reguser/db/mem/usermemstore"
 	"github.com/larikhide/reguser/db/sql/pgstore"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		importUsers(os.Args[2:])
+		return
+	}
+
 	if tz := os.Getenv("TZ"); tz != "" {
 		var err error
 		time.Local, err = time.LoadLocation(tz)
@@ -42,21 +56,60 @@ func main() {
 		ust = usermemstore.NewUsers()
 	case "pg":
 		dsn := os.Getenv("DATABASE_URL")
-		pgst, err := pgstore.NewUsers(dsn)
+		popts, err := pgOptionsFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		pgst, err := pgstore.NewUsers(dsn, popts...)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer pgst.Close()
 		ust = pgst
+	case "file":
+		dir := os.Getenv("REGUSER_DATA_DIR")
+		if dir == "" {
+			dir = "data"
+		}
+		var fopts []userfstore.Option
+		if os.Getenv("REGUSER_FILE_MMAP") != "" {
+			fopts = append(fopts, userfstore.WithMmap())
+		}
+		fst, err := userfstore.NewUserFileStore(dir, fopts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fst.Close()
+		ust = fst
 	default:
 		log.Fatal("unknown REGUSER_STORE = ", stu)
 	}
 
 	a := starter.NewApp(ust)
 	us := user.NewUsers(ust)
-	h := handler.NewHandlers(us)
 
-	rh := routeroapi.NewRouterOpenAPI(h)
+	// первый пользователь, без него к API не попасть
+	if an, ap := os.Getenv("REGUSER_ADMIN_NAME"), os.Getenv("REGUSER_ADMIN_PASSWORD"); an != "" && ap != "" {
+		if _, err := us.EnsureUser(ctx, user.User{Name: an, Permissions: user.PermAdmin}, ap); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	tokens, err := tokensFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	h := handler.NewHandlers(us, tokens)
+
+	var ropts []routeroapi.Option
+	// проверка ответов по спецификации, для отладки
+	if os.Getenv("REGUSER_VALIDATE_RESPONSES") != "" {
+		ropts = append(ropts, routeroapi.WithResponseValidation(func(r *http.Request, err error) {
+			log.Printf("response does not match spec: %v", err)
+		}))
+	}
+	rh := routeroapi.NewRouterOpenAPI(h, ropts...)
 
 	srv := server.NewServer(":"+os.Getenv("PORT"), rh)
 
@@ -65,7 +118,91 @@ func main() {
 
 	go a.Serve(ctx, wg, srv)
 
+	// периодическое сжатие, имеет смысл для REGUSER_STORE=file
+	if v := os.Getenv("REGUSER_COMPACT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatal("bad REGUSER_COMPACT_INTERVAL = ", v)
+		}
+		wg.Add(1)
+		go a.CompactEvery(ctx, wg, d)
+	}
+
+	// удаленные пользователи хранятся REGUSER_RETENTION_DAYS дней, потом стираются
+	if v := os.Getenv("REGUSER_RETENTION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 {
+			log.Fatal("bad REGUSER_RETENTION_DAYS = ", v)
+		}
+		wg.Add(1)
+		go a.PurgeEvery(ctx, wg, time.Hour, time.Duration(days)*24*time.Hour)
+	}
+
 	<-ctx.Done()
 	cancel()
 	wg.Wait()
 }
+
+// tokensFromEnv настраивает JWT, без ключа вход по токенам выключен
+func tokensFromEnv() (*auth.Tokens, error) {
+	secret, keyFile := os.Getenv("REGUSER_JWT_SECRET"), os.Getenv("REGUSER_JWT_KEY_FILE")
+	if secret == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	cfg := auth.TokenConfig{
+		Method:   os.Getenv("REGUSER_JWT_ALG"),
+		Secret:   []byte(secret),
+		KeyFile:  keyFile,
+		Issuer:   "reguser",
+		Audience: "reguser",
+	}
+	if cfg.Method == "" && keyFile != "" {
+		cfg.Method = "RS256"
+	}
+	if aud := os.Getenv("REGUSER_JWT_AUDIENCE"); aud != "" {
+		cfg.Audience = aud
+	}
+	for env, d := range map[string]*time.Duration{
+		"REGUSER_JWT_ACCESS_TTL":  &cfg.AccessTTL,
+		"REGUSER_JWT_REFRESH_TTL": &cfg.RefreshTTL,
+	} {
+		if v := os.Getenv(env); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("bad %s: %w", env, err)
+			}
+		}
+	}
+
+	return auth.NewTokens(cfg)
+}
+
+// pgOptionsFromEnv настраивает пул postgres, то же можно задать параметрами DATABASE_URL
+func pgOptionsFromEnv() ([]pgstore.Option, error) {
+	var opts []pgstore.Option
+	for env, opt := range map[string]func(n int) pgstore.Option{
+		"REGUSER_PG_MAX_CONNS":  func(n int) pgstore.Option { return pgstore.WithMaxConns(int32(n)) },
+		"REGUSER_PG_MIN_CONNS":  func(n int) pgstore.Option { return pgstore.WithMinConns(int32(n)) },
+		"REGUSER_PG_STMT_CACHE": pgstore.WithStatementCache,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad %s = %s", env, v)
+			}
+			opts = append(opts, opt(n))
+		}
+	}
+	if v := os.Getenv("REGUSER_PG_HEALTH_CHECK"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad REGUSER_PG_HEALTH_CHECK = %s", v)
+		}
+		opts = append(opts, pgstore.WithHealthCheckPeriod(d))
+	}
+	if os.Getenv("REGUSER_PG_TRACE") != "" {
+		opts = append(opts, pgstore.WithTracer(pgstore.LogTracer))
+	}
+	return opts, nil
+}
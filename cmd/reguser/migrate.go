@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/larikhide/reguser/db/sql/pgstore"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const migrateUsage = "usage: reguser migrate up|down|status, database from DATABASE_URL"
+
+// migrate - подкоманда reguser migrate, миграции схемы postgres
+func migrate(args []string) {
+	if len(args) != 1 {
+		log.Fatal(migrateUsage)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	db, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	m, err := pgstore.NewMigrator(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := m.Up(ctx)
+		for _, v := range done {
+			log.Printf("applied %04d", v)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(done) == 0 {
+			log.Println("schema is up to date")
+		}
+	case "down":
+		v, err := m.Down(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if v == 0 {
+			log.Println("nothing to roll back")
+			return
+		}
+		log.Printf("rolled back %04d", v)
+	case "status":
+		st, err := m.Status(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, ms := range st {
+			applied := "pending"
+			if ms.Applied() {
+				applied = "applied " + ms.AppliedAt.Format("2006-01-02T15:04:05 MST")
+			}
+			fmt.Printf("%04d_%s\t%s\n", ms.Version, ms.Name, applied)
+		}
+	default:
+		log.Fatal(migrateUsage)
+	}
+}
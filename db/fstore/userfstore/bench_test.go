@@ -0,0 +1,185 @@
+package userfstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+// Производительность чтения при разном GOMAXPROCS:
+//
+//	go test -run - -bench Parallel -cpu 1,2,4,8 ./db/fstore/userfstore
+
+const benchUsers = 100000
+
+// writeBenchStore пишет fdata.dat с n пользователями сразу, без журнала
+// и O_SYNC, индексы строит открытие. Имена - user и номер в случайном порядке.
+func writeBenchStore(b *testing.B, n int) (string, []uuid.UUID) {
+	b.Helper()
+	dir := b.TempDir()
+	f, err := os.Create(filepath.Join(dir, fdataName))
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	w.Write(fileHeader())
+	ids := make([]uuid.UUID, n)
+	now := user.Now()
+	for i, k := range rand.New(rand.NewSource(1)).Perm(n) {
+		ids[i] = uuid.New()
+		w.Write(encodeRecord(fileRecord{User: user.User{
+			ID:        ids[i],
+			Name:      fmt.Sprintf("user%07d", k),
+			Data:      "some user data",
+			CreatedAt: now,
+			UpdatedAt: now,
+			Version:   1,
+		}}))
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+	return dir, ids
+}
+
+func openBenchStore(b *testing.B, dir string, opts ...Option) *UserFileStore {
+	b.Helper()
+	st, err := NewUserFileStore(dir, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(st.Close)
+	return st
+}
+
+// searchCount отдает, сколько пользователей нашел SearchUsers
+func searchCount(ctx context.Context, st *UserFileStore, q user.Query) (int, error) {
+	n := 0
+	err := st.SearchUsers(ctx, q, func(user.User) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+var benchOpts = []struct {
+	name string
+	opts []Option
+}{
+	{"file", nil},
+	{"mmap", []Option{WithMmap()}},
+}
+
+func BenchmarkParallelRead(b *testing.B) {
+	dir, ids := writeBenchStore(b, benchUsers)
+	for _, bo := range benchOpts {
+		b.Run(bo.name, func(b *testing.B) {
+			st := openBenchStore(b, dir, bo.opts...)
+			ctx := context.Background()
+			var seed int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for pb.Next() {
+					if _, err := st.Read(ctx, ids[r.Intn(len(ids))]); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkParallelSearch(b *testing.B) {
+	dir, _ := writeBenchStore(b, benchUsers)
+	for _, bo := range benchOpts {
+		b.Run(bo.name, func(b *testing.B) {
+			st := openBenchStore(b, dir, bo.opts...)
+			ctx := context.Background()
+			var seed int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for pb.Next() {
+					// 10 пользователей на префикс
+					q := user.Query{Name: fmt.Sprintf("user%06d", r.Intn(benchUsers/10)), Mode: user.SearchPrefix}
+					if n, err := searchCount(ctx, st, q); err != nil || n != 10 {
+						b.Errorf("search %s: %d users, %v", q.Name, n, err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkParallelReadSearch - чтения вперемешку с поиском перебором по всем
+// пользователям: долгий поиск не должен останавливать чтения
+func BenchmarkParallelReadSearch(b *testing.B) {
+	dir, ids := writeBenchStore(b, benchUsers)
+	st := openBenchStore(b, dir, WithMmap())
+	ctx := context.Background()
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for i := 0; pb.Next(); i++ {
+			if i%1000 == 0 {
+				q := user.Query{Name: "user00", Mode: user.SearchSubstring, Limit: 10}
+				if _, err := searchCount(ctx, st, q); err != nil {
+					b.Error(err)
+					return
+				}
+				continue
+			}
+			if _, err := st.Read(ctx, ids[r.Intn(len(ids))]); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkParallelReadCompact - чтения, пока хранилище все время сжимается
+func BenchmarkParallelReadCompact(b *testing.B) {
+	dir, ids := writeBenchStore(b, benchUsers)
+	st := openBenchStore(b, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			if err := st.Compact(ctx); err != nil && ctx.Err() == nil {
+				b.Error(err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			if _, err := st.Read(context.Background(), ids[r.Intn(len(ids))]); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	cancel()
+	<-done
+}
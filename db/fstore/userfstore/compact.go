@@ -0,0 +1,309 @@
+package userfstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+var _ user.Compactor = &UserFileStore{}
+
+const (
+	fdataName    = "fdata.dat"
+	pkName       = "pk.dat"
+	fdataTmpName = "fdata.dat.tmp"
+	pkTmpName    = "pk.dat.tmp"
+	pkNewName    = "pk.dat.new" // появление этого файла - точка фиксации сжатия
+)
+
+// Compact переписывает fdata.dat без старых версий записей, а pk.dat - снимком индекса.
+// Удаленные пользователи остаются надгробиями, чтобы их ID оставался занят.
+// Новые файлы пишутся во временные и подменяются переименованием.
+// Копия строится по снимку индекса без блокировки, чтения и изменения
+// ждут только дописывания записей, сделанных за это время, и подмены файлов.
+func (st *UserFileStore) Compact(ctx context.Context) error {
+	st.compactMu.Lock()
+	defer st.compactMu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	st.RLock()
+	recs := st.compactRecs()
+	from := st.end
+	st.RUnlock()
+
+	// записи до from уже не меняются, а fdata.dat подменяет только сжатие,
+	// поэтому читать их можно без блокировки
+	c, err := writeCompacted(ctx, st.dir, st.fdata, recs)
+	if err != nil {
+		os.Remove(filepath.Join(st.dir, fdataTmpName))
+		os.Remove(filepath.Join(st.dir, pkTmpName))
+		return err
+	}
+
+	st.Lock()
+	defer st.Unlock()
+
+	// журнал индекса должен быть дописан до подмены pk.dat
+	st.stopPK()
+	defer st.startPK()
+
+	err = c.finish(st.fdata, from, st.end)
+	// записи журнала ссылаются на старые позиции, до фиксации он должен быть пуст
+	if err == nil {
+		err = st.wal.truncate()
+	}
+	if err != nil {
+		os.Remove(filepath.Join(st.dir, fdataTmpName))
+		os.Remove(filepath.Join(st.dir, pkTmpName))
+		return err
+	}
+
+	if err := commitCompact(st.dir); err != nil {
+		return err
+	}
+
+	fdata, err := os.OpenFile(filepath.Join(st.dir, fdataName), os.O_RDWR|os.O_SYNC, 0644)
+	if err != nil {
+		return fmt.Errorf("reopen data after compact, store must be reopened: %w", err)
+	}
+	pk, err := os.OpenFile(filepath.Join(st.dir, pkName), os.O_WRONLY|os.O_SYNC|os.O_APPEND, 0644)
+	if err != nil {
+		fdata.Close()
+		return fmt.Errorf("reopen pk after compact, store must be reopened: %w", err)
+	}
+
+	if st.mm != nil {
+		st.mm.unmap()
+		if st.mm, err = newMmapData(fdata, int64(c.end)); err != nil {
+			log.Println("mmap fdata.dat, reading from file: ", err)
+			st.mm = nil
+		}
+	}
+	st.fdata.Close()
+	st.fdata = fdata
+	st.pk.Close()
+	st.pk = pk
+	st.pkmap = c.pkmap
+	st.idxRecs = c.idxRecs
+	st.deleted = c.deleted
+	st.end = c.end
+
+	return nil
+}
+
+// compactRecs - последние версии живых записей и надгробия в порядке позиций
+func (st *UserFileStore) compactRecs() SortedUserIndexRecords {
+	recs := make(SortedUserIndexRecords, 0, len(st.pkmap)+len(st.deleted))
+	for _, ir := range st.idxRecs {
+		if pp, ok := st.pkmap[ir.UserID]; ok && pp == ir.Position {
+			recs = append(recs, ir)
+		}
+	}
+	for id, p := range st.deleted {
+		recs = append(recs, UserIndexRecord{UserID: id, Position: p, Delete: true})
+	}
+	sort.Sort(recs)
+	return recs
+}
+
+// compacted - fdata.dat.tmp, pk.dat.tmp и индекс по ним
+type compacted struct {
+	f       *os.File
+	pk      *os.File
+	pkmap   map[uuid.UUID]Position
+	idxRecs SortedUserIndexRecords
+	deleted map[uuid.UUID]Position
+	end     Position
+}
+
+// writeCompacted копирует записи recs в fdata.dat.tmp, а индекс по ним
+// в pk.dat.tmp. Порядок записей сохраняется.
+func writeCompacted(ctx context.Context, dir string, fdata io.ReaderAt, recs SortedUserIndexRecords) (*compacted, error) {
+	fd, err := os.OpenFile(filepath.Join(dir, fdataTmpName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := os.OpenFile(filepath.Join(dir, pkTmpName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	c := &compacted{
+		f:       fd,
+		pk:      pk,
+		pkmap:   make(map[uuid.UUID]Position, len(recs)),
+		idxRecs: make(SortedUserIndexRecords, 0, len(recs)),
+		deleted: make(map[uuid.UUID]Position),
+	}
+	if err := c.copyRecs(ctx, fdata, recs); err != nil {
+		c.close()
+		return nil, err
+	}
+	if err := c.writePK(c.idxRecs); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *compacted) close() {
+	c.f.Close()
+	c.pk.Close()
+}
+
+// writePK дописывает записи индекса в pk.dat.tmp
+func (c *compacted) writePK(idxRecs SortedUserIndexRecords) error {
+	w := bufio.NewWriter(c.pk)
+	for _, ir := range idxRecs {
+		if err := binary.Write(w, binary.LittleEndian, ir); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (c *compacted) copyRecs(ctx context.Context, fdata io.ReaderAt, recs SortedUserIndexRecords) error {
+	wd := bufio.NewWriter(c.f)
+	if _, err := wd.Write(fileHeader()); err != nil {
+		return err
+	}
+	p := Position(headerLen)
+	for i, ir := range recs {
+		if i%1000 == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+		// запись копируется как есть, вместе с полями, которых этот код не знает
+		b, err := readRaw(fdata, ir.Position)
+		if err != nil {
+			return fmt.Errorf("read record error: %w", err)
+		}
+		if _, err := wd.Write(b); err != nil {
+			return err
+		}
+		if ir.Delete {
+			c.deleted[ir.UserID] = p
+		} else {
+			c.pkmap[ir.UserID] = p
+			c.idxRecs = append(c.idxRecs, UserIndexRecord{
+				UserID:   ir.UserID,
+				Position: p,
+			})
+		}
+		p += Position(len(b))
+	}
+	c.end = p
+	return wd.Flush()
+}
+
+// finish дописывает записи fdata.dat с from до end, сделанные во время
+// копирования, применяет их к индексу так же, как восстановление,
+// и сбрасывает временные файлы на диск
+func (c *compacted) finish(fdata io.ReaderAt, from, end Position) error {
+	defer c.close()
+
+	if _, err := c.f.Seek(int64(c.end), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(c.f, io.NewSectionReader(fdata, int64(from), int64(end-from))); err != nil {
+		return err
+	}
+	var tail SortedUserIndexRecords
+	err := scanRecords(fdata, from, end, func(p Position, fr fileRecord) error {
+		np := p - from + c.end
+		switch {
+		case fr.Purged:
+			delete(c.pkmap, fr.ID)
+			delete(c.deleted, fr.ID)
+			tail = append(tail, UserIndexRecord{UserID: fr.ID, Position: np, Delete: true})
+		case !fr.DeletedAt.IsZero():
+			delete(c.pkmap, fr.ID)
+			c.deleted[fr.ID] = np
+			tail = append(tail, UserIndexRecord{UserID: fr.ID, Position: np, Delete: true})
+		default:
+			c.pkmap[fr.ID] = np
+			delete(c.deleted, fr.ID)
+			c.idxRecs = append(c.idxRecs, UserIndexRecord{UserID: fr.ID, Position: np})
+			tail = append(tail, UserIndexRecord{UserID: fr.ID, Position: np})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("read new records error: %w", err)
+	}
+	c.end += end - from
+
+	if err := c.writePK(tail); err != nil {
+		return err
+	}
+	if err := c.f.Sync(); err != nil {
+		return err
+	}
+	return c.pk.Sync()
+}
+
+// commitCompact фиксирует подготовленные fdata.dat.tmp и pk.dat.tmp
+func commitCompact(dir string) error {
+	if err := os.Rename(filepath.Join(dir, pkTmpName), filepath.Join(dir, pkNewName)); err != nil {
+		os.Remove(filepath.Join(dir, fdataTmpName))
+		os.Remove(filepath.Join(dir, pkTmpName))
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	return finishCompact(dir)
+}
+
+// finishCompact доводит до конца сжатие, прерванное после точки фиксации,
+// или удаляет временные файлы, если до нее не дошли
+func finishCompact(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, pkNewName)); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		for _, n := range []string{fdataTmpName, pkTmpName} {
+			if err := os.Remove(filepath.Join(dir, n)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// fdata.dat.tmp уже нет, если его успели переименовать до сбоя
+	err := os.Rename(filepath.Join(dir, fdataTmpName), filepath.Join(dir, fdataName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(filepath.Join(dir, pkNewName), filepath.Join(dir, pkName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,195 @@
+package userfstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+func fdataSize(t testing.TB, dir string) int64 {
+	t.Helper()
+	fi, err := os.Stat(filepath.Join(dir, fdataName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestCompact(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithMmap()}} {
+		dir := t.TempDir()
+		st, err := NewUserFileStore(dir, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillStore(t, st, "a")
+		want := stateOf(t, st)
+		size := fdataSize(t, dir)
+
+		if err := st.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		checkState(t, st, want)
+		if fdataSize(t, dir) >= size {
+			t.Errorf("fdata.dat is %d bytes after compact, was %d", fdataSize(t, dir), size)
+		}
+
+		// после сжатия хранилище пишет в новые файлы
+		fillStore(t, st, "b")
+		want = stateOf(t, st)
+		st.Close()
+		if st, err = NewUserFileStore(dir, opts...); err != nil {
+			t.Fatal(err)
+		}
+		checkState(t, st, want)
+		st.Close()
+	}
+}
+
+// TestCompactOnline сжимает хранилище, пока в него пишут:
+// изменения, сделанные во время сжатия, не должны потеряться
+func TestCompactOnline(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	st, err := NewUserFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		u := user.User{ID: uuid.New(), Name: fmt.Sprintf("base%04d", i), Data: "data"}
+		if _, err := st.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				u := user.User{ID: uuid.New(), Name: fmt.Sprintf("w%d-%d", w, i), Data: "data"}
+				if _, err := st.Create(ctx, u); err != nil {
+					t.Error(err)
+					return
+				}
+				u.Data = "changed"
+				if err := st.Update(ctx, u); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%3 == 0 {
+					if err := st.Delete(ctx, u.ID, 0); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				if i%9 == 0 {
+					if err := st.Purge(ctx, u.ID, 0); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	for i := 0; i < 5; i++ {
+		if err := st.Compact(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	want := stateOf(t, st)
+	for id, u := range want.Live {
+		if u.Name[0] == 'w' && (u.Data != "changed" || u.Version != 2) {
+			t.Fatalf("user %s lost its update: %+v", id, u)
+		}
+	}
+	flushPK(st)
+	files := readFiles(t, dir)
+	st.Close()
+
+	// и после закрытия, и после сбоя открывается то же самое
+	st, err = NewUserFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, st, want)
+	st.Close()
+	got, err := reopenState(t, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("state after crash\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+// TestListAcrossCompact листает хранилище, сжимая его между страницами:
+// курсор, выданный до сжатия, должен вести туда же и после
+func TestListAcrossCompact(t *testing.T) {
+	ctx := context.Background()
+	st, err := NewUserFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	want := map[uuid.UUID]bool{}
+	for i := 0; i < 20; i++ {
+		u := user.User{ID: uuid.New(), Name: fmt.Sprintf("user%02d", i), Data: "data"}
+		if _, err := st.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err := st.Delete(ctx, u.ID, 0); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want[u.ID] = true
+	}
+
+	got := map[uuid.UUID]bool{}
+	cursor := ""
+	for page := 0; ; page++ {
+		uu, next, err := st.List(ctx, cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range uu {
+			if got[u.ID] {
+				t.Fatalf("user %s listed twice", u.Name)
+			}
+			got[u.ID] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+		if page == 0 {
+			if err := st.Compact(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("listed %d users across compact, want %d", len(got), len(want))
+	}
+}
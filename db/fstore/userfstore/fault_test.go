@@ -0,0 +1,222 @@
+package userfstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+// Проверки на сбои: состояние файлов после падения посреди записи
+// или порчи любого байта должно открываться без потери записанного.
+
+// storeFiles - содержимое файлов хранилища по именам
+type storeFiles map[string][]byte
+
+// flushPK дожидается записи в pk.dat всего, что уже в канале
+func flushPK(st *UserFileStore) {
+	st.Lock()
+	defer st.Unlock()
+	st.stopPK()
+	st.startPK()
+}
+
+func readFiles(t testing.TB, dir string) storeFiles {
+	t.Helper()
+	ee, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ff := storeFiles{}
+	for _, e := range ee {
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ff[e.Name()] = b
+	}
+	return ff
+}
+
+func writeFiles(t testing.TB, ff storeFiles) string {
+	t.Helper()
+	dir := t.TempDir()
+	for n, b := range ff {
+		if err := os.WriteFile(filepath.Join(dir, n), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// reopenState открывает копию файлов и возвращает состояние хранилища.
+// Хранилище открывается дважды, чтобы проверить и то, что оставило восстановление.
+func reopenState(t testing.TB, ff storeFiles) (storeState, error) {
+	t.Helper()
+	dir := writeFiles(t, ff)
+	st, err := NewUserFileStore(dir)
+	if err != nil {
+		return storeState{}, err
+	}
+	first := stateOf(t, st)
+	st.Close()
+	if st, err = NewUserFileStore(dir); err != nil {
+		t.Fatalf("second open after recovery: %v", err)
+	}
+	defer st.Close()
+	if s := stateOf(t, st); !reflect.DeepEqual(s, first) {
+		t.Fatalf("second open state\n%+v\nwant\n%+v", s, first)
+	}
+	return first, nil
+}
+
+// faultOps - последняя операция, посреди которой падает хранилище
+var faultOps = []struct {
+	name string
+	prep func(ctx context.Context, st *UserFileStore, id uuid.UUID) error
+	do   func(ctx context.Context, st *UserFileStore, id uuid.UUID) error
+}{
+	{"create", nil, func(ctx context.Context, st *UserFileStore, _ uuid.UUID) error {
+		_, err := st.Create(ctx, user.User{ID: uuid.New(), Name: "torn", Data: "torn data"})
+		return err
+	}},
+	{"update", nil, func(ctx context.Context, st *UserFileStore, id uuid.UUID) error {
+		u, err := st.Read(ctx, id)
+		if err != nil {
+			return err
+		}
+		u.Name, u.Data = "renamed", "changed"
+		return st.Update(ctx, *u)
+	}},
+	{"delete", nil, func(ctx context.Context, st *UserFileStore, id uuid.UUID) error {
+		return st.Delete(ctx, id, 0)
+	}},
+	{"purge", func(ctx context.Context, st *UserFileStore, id uuid.UUID) error {
+		return st.Delete(ctx, id, 0)
+	}, func(ctx context.Context, st *UserFileStore, id uuid.UUID) error {
+		return st.Purge(ctx, id, 0)
+	}},
+}
+
+// faultStore открывает хранилище с несколькими записанными пользователями
+func faultStore(t testing.TB) (*UserFileStore, string, uuid.UUID) {
+	t.Helper()
+	dir := t.TempDir()
+	st, err := NewUserFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last uuid.UUID
+	for i := 0; i < 3; i++ {
+		u := user.User{ID: uuid.New(), Name: fmt.Sprintf("user%d", i), Data: "data", Permissions: i}
+		if _, err := st.Create(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+		last = u.ID
+	}
+	flushPK(st)
+	return st, dir, last
+}
+
+// TestCrashPoints роняет хранилище после каждого байта последней операции.
+// Файлы пишутся по порядку: журнал, fdata.dat, pk.dat. Пока запись журнала
+// не дописана, операции нет, после этого она есть, что бы ни было дальше.
+func TestCrashPoints(t *testing.T) {
+	ctx := context.Background()
+	for _, op := range faultOps {
+		st, dir, id := faultStore(t)
+		if op.prep != nil {
+			if err := op.prep(ctx, st, id); err != nil {
+				t.Fatalf("%s: %v", op.name, err)
+			}
+			flushPK(st)
+		}
+		before, beforeState := readFiles(t, dir), stateOf(t, st)
+		if err := op.do(ctx, st, id); err != nil {
+			t.Fatalf("%s: %v", op.name, err)
+		}
+		flushPK(st)
+		after, afterState := readFiles(t, dir), stateOf(t, st)
+		st.Close()
+		if reflect.DeepEqual(beforeState, afterState) {
+			t.Fatalf("%s changed nothing", op.name)
+		}
+
+		crash := storeFiles{}
+		for n, b := range before {
+			crash[n] = b
+		}
+		for _, n := range []string{walName, fdataName, pkName} {
+			b, a := before[n], after[n]
+			if !bytes.HasPrefix(a, b) {
+				t.Fatalf("%s: %s is not appended to", op.name, n)
+			}
+			for k := len(b); k <= len(a); k++ {
+				crash[n] = a[:k]
+				want := afterState
+				if n == walName && k < len(a) {
+					want = beforeState
+				}
+				got, err := reopenState(t, crash)
+				if err != nil {
+					t.Fatalf("%s: crash at %s byte %d of %d: open: %v", op.name, n, k, len(a), err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s: crash at %s byte %d of %d: state\n%+v\nwant\n%+v", op.name, n, k, len(a), got, want)
+				}
+			}
+		}
+	}
+}
+
+// checkCorruption портит по очереди каждый байт каждого файла. Хранилище
+// должно либо не открыться, либо открыться со всеми пользователями.
+func checkCorruption(t *testing.T, ff storeFiles, want storeState) {
+	for n, b := range ff {
+		for i := range b {
+			bad := storeFiles{}
+			for n2, b2 := range ff {
+				bad[n2] = b2
+			}
+			bad[n] = flip(b, i)
+			got, err := reopenState(t, bad)
+			if err != nil {
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s byte %d corrupted: state\n%+v\nwant\n%+v", n, i, got, want)
+			}
+		}
+	}
+}
+
+func TestCorruptionAfterClose(t *testing.T) {
+	st, dir, id := faultStore(t)
+	for _, op := range faultOps[1:3] {
+		if err := op.do(context.Background(), st, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := stateOf(t, st)
+	st.Close()
+	checkCorruption(t, readFiles(t, dir), want)
+}
+
+func TestCorruptionAfterCrash(t *testing.T) {
+	st, dir, id := faultStore(t)
+	defer st.Close()
+	for _, op := range faultOps[1:3] {
+		if err := op.do(context.Background(), st, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushPK(st)
+	checkCorruption(t, readFiles(t, dir), stateOf(t, st))
+}
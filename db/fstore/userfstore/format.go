@@ -0,0 +1,386 @@
+package userfstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+// Формат fdata.dat версии 2:
+//
+//	заголовок: [4]"RUFS" [2]версия [2]резерв
+//	запись:    [4]длина тела [4]crc32c тела [тело]
+//	тело:      поля [1]тег [uvarint]длина [значение]
+//
+// Записи только дописываются: изменение - новая версия записи, удаление - запись
+// с DeletedAt, стирание - запись с DeletedAt и Purged без данных пользователя.
+// CreatedAt, UpdatedAt и DeletedAt хранятся в микросекундах unix, у записей,
+// сделанных до появления этих полей, они нулевые. DeletedAt сначала хранился
+// в секундах, этот тег пишется и дальше, чтобы удаление видели старые версии.
+// Такие записи без Version читаются как версия 1.
+// Неизвестные теги пропускаются, поэтому новое поле User - это новый тег,
+// а не новая версия формата.
+// Версия 1 - записи DBFileUserV0 или DBFileUser фиксированной длины
+// без заголовка, при открытии такой файл переписывается в версию 2.
+
+const (
+	fileMagic   = "RUFS"
+	fileVersion = 2
+	headerLen   = 8
+	recHdrLen   = 8
+	recMaxLen   = 1 << 20
+)
+
+const (
+	tagID byte = 1 + iota
+	tagDeletedAt
+	tagName
+	tagData
+	tagPermissions
+	tagPassHash
+	tagPurged
+	tagCreatedAt
+	tagUpdatedAt
+	tagVersion
+	tagDeletedAtMicro
+)
+
+var ErrCorrupted = errors.New("corrupted record")
+
+// fileRecord - версия пользователя в fdata.dat, у удаленных User.DeletedAt не нулевое
+type fileRecord struct {
+	user.User
+	Purged bool // пользователь стерт, прежние версии уйдут при сжатии
+}
+
+func fileHeader() []byte {
+	h := make([]byte, headerLen)
+	copy(h, fileMagic)
+	binary.LittleEndian.PutUint16(h[4:], fileVersion)
+	return h
+}
+
+// fileVersionOf возвращает версию формата по заголовку, 1 если заголовка нет
+func fileVersionOf(r io.ReaderAt) (int, error) {
+	h := make([]byte, headerLen)
+	n, err := r.ReadAt(h, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if n < len(fileMagic) || string(h[:len(fileMagic)]) != fileMagic {
+		return 1, nil
+	}
+	if n < headerLen {
+		return 0, fmt.Errorf("%w: short header", ErrCorrupted)
+	}
+	return int(binary.LittleEndian.Uint16(h[4:])), nil
+}
+
+func appendField(b []byte, tag byte, v []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(v)))
+	b = append(b, tag)
+	b = append(b, buf[:n]...)
+	return append(b, v...)
+}
+
+func appendVarintField(b []byte, tag byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return appendField(b, tag, buf[:n])
+}
+
+// encodeRecord возвращает запись целиком, с длиной и контрольной суммой
+func encodeRecord(fr fileRecord) []byte {
+	b := make([]byte, recHdrLen, recHdrLen+16+len(fr.Name)+len(fr.Data)+len(fr.PassHash)+32)
+	b = appendField(b, tagID, fr.ID[:])
+	if !fr.DeletedAt.IsZero() {
+		b = appendVarintField(b, tagDeletedAt, fr.DeletedAt.Unix())
+		b = appendVarintField(b, tagDeletedAtMicro, fr.DeletedAt.UnixMicro())
+	}
+	b = appendField(b, tagName, []byte(fr.Name))
+	b = appendField(b, tagData, []byte(fr.Data))
+	b = appendVarintField(b, tagPermissions, int64(fr.Permissions))
+	if fr.PassHash != "" {
+		b = appendField(b, tagPassHash, []byte(fr.PassHash))
+	}
+	if fr.Purged {
+		b = appendField(b, tagPurged, nil)
+	}
+	if !fr.CreatedAt.IsZero() {
+		b = appendVarintField(b, tagCreatedAt, fr.CreatedAt.UnixMicro())
+	}
+	if !fr.UpdatedAt.IsZero() {
+		b = appendVarintField(b, tagUpdatedAt, fr.UpdatedAt.UnixMicro())
+	}
+	if fr.Version != 0 {
+		b = appendVarintField(b, tagVersion, fr.Version)
+	}
+
+	body := b[recHdrLen:]
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(body, crcTable))
+	return b
+}
+
+func decodeBody(body []byte) (fileRecord, error) {
+	fr := fileRecord{}
+	for len(body) > 0 {
+		tag := body[0]
+		ln, n := binary.Uvarint(body[1:])
+		if n <= 0 || uint64(len(body)-1-n) < ln {
+			return fileRecord{}, fmt.Errorf("%w: bad field %d", ErrCorrupted, tag)
+		}
+		v := body[1+n : 1+n+int(ln)]
+		body = body[1+n+int(ln):]
+
+		switch tag {
+		case tagID:
+			id, err := uuid.FromBytes(v)
+			if err != nil {
+				return fileRecord{}, fmt.Errorf("%w: %v", ErrCorrupted, err)
+			}
+			fr.ID = id
+		case tagDeletedAt:
+			// tagDeletedAtMicro, если он есть, идет после и уточняет время
+			sec, _ := binary.Varint(v)
+			fr.DeletedAt = time.Unix(sec, 0).UTC()
+		case tagName:
+			fr.Name = string(v)
+		case tagData:
+			fr.Data = string(v)
+		case tagPermissions:
+			p, _ := binary.Varint(v)
+			fr.Permissions = int(p)
+		case tagPassHash:
+			fr.PassHash = string(v)
+		case tagPurged:
+			fr.Purged = true
+		case tagCreatedAt:
+			us, _ := binary.Varint(v)
+			fr.CreatedAt = time.UnixMicro(us).UTC()
+		case tagUpdatedAt:
+			us, _ := binary.Varint(v)
+			fr.UpdatedAt = time.UnixMicro(us).UTC()
+		case tagDeletedAtMicro:
+			us, _ := binary.Varint(v)
+			fr.DeletedAt = time.UnixMicro(us).UTC()
+		case tagVersion:
+			fr.Version, _ = binary.Varint(v)
+		default:
+			// поле из более новой версии
+		}
+	}
+	if fr.ID == uuid.Nil {
+		return fileRecord{}, fmt.Errorf("%w: no id", ErrCorrupted)
+	}
+	if fr.Version == 0 {
+		fr.Version = 1
+	}
+	return fr, nil
+}
+
+// readRaw читает запись в позиции p целиком и проверяет контрольную сумму.
+// Из отображения возвращается его кусок, менять его нельзя.
+func readRaw(r io.ReaderAt, p Position) ([]byte, error) {
+	var hdr [recHdrLen]byte
+	if _, err := r.ReadAt(hdr[:], int64(p)); err != nil {
+		return nil, err
+	}
+	ln := binary.LittleEndian.Uint32(hdr[0:])
+	if ln > recMaxLen {
+		return nil, fmt.Errorf("%w: length %d", ErrCorrupted, ln)
+	}
+	var b []byte
+	if mm, ok := r.(*mmapData); ok {
+		// прямо из отображения, без копирования
+		b, _ = mm.slice(int64(p), recHdrLen+int64(ln))
+	}
+	if b == nil {
+		b = make([]byte, recHdrLen+int(ln))
+		copy(b, hdr[:])
+		if _, err := r.ReadAt(b[recHdrLen:], int64(p)+recHdrLen); err != nil {
+			return nil, err
+		}
+	}
+	if crc32.Checksum(b[recHdrLen:], crcTable) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return nil, fmt.Errorf("%w: bad checksum at %d", ErrCorrupted, p)
+	}
+	return b, nil
+}
+
+func readRecord(r io.ReaderAt, p Position) (fileRecord, error) {
+	b, err := readRaw(r, p)
+	if err != nil {
+		return fileRecord{}, err
+	}
+	return decodeBody(b[recHdrLen:])
+}
+
+// scanRecords читает записи подряд с from до end и вызывает fn для каждой.
+// После проигрывания журнала fdata.dat недописанных записей не содержит:
+// запись попадает в fdata.dat только целой записью журнала. Поэтому любая
+// битая или недописанная запись - это ErrCorrupted.
+func scanRecords(r io.ReaderAt, from, end Position, fn func(p Position, fr fileRecord) error) error {
+	br := bufio.NewReader(io.NewSectionReader(r, int64(from), int64(end-from)))
+	p := from
+	var hdr [recHdrLen]byte
+	for p < end {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return fmt.Errorf("%w: short header at %d", ErrCorrupted, p)
+		}
+		ln := binary.LittleEndian.Uint32(hdr[0:])
+		if ln > recMaxLen || int64(p)+recHdrLen+int64(ln) > int64(end) {
+			return fmt.Errorf("%w: length %d at %d", ErrCorrupted, ln, p)
+		}
+		body := make([]byte, ln)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return err
+		}
+		if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(hdr[4:]) {
+			return fmt.Errorf("%w: bad checksum at %d", ErrCorrupted, p)
+		}
+		fr, err := decodeBody(body)
+		if err != nil {
+			return fmt.Errorf("record at %d: %w", p, err)
+		}
+		if err := fn(p, fr); err != nil {
+			return err
+		}
+		p += Position(recHdrLen + len(body))
+	}
+	return nil
+}
+
+// Формат версии 1
+
+// У версии 1 две раскладки записи: исходная без хеша пароля (DBFileUserV0)
+// и с хешем в конце (DBFileUser). Заголовка у файла нет, раскладка
+// определяется по самим записям, см. v1RecordLen.
+const (
+	DBFileUserV0Len = 16 + 8 + 1 + 250 + 2 + 1000 + 2
+	DBFileUserLen   = DBFileUserV0Len + 60
+)
+
+// DBFileUserV0 - исходная запись fdata.dat версии 1, нужна только для миграции
+type DBFileUserV0 struct {
+	ID          [16]byte
+	DeletedAt   [8]byte
+	NameLen     [1]byte
+	Name        [250]byte
+	DataLen     [2]byte
+	Data        [1000]byte
+	Permissions [2]byte
+}
+
+// DBFileUser - запись fdata.dat версии 1 с хешем пароля, нужна только для миграции
+type DBFileUser struct {
+	DBFileUserV0
+	PassHash [60]byte // bcrypt-хеш всегда 60 байт
+}
+
+func (dbu DBFileUserV0) user() user.User {
+	u := user.User{
+		ID:          dbu.ID,
+		Name:        string(dbu.Name[:dbu.NameLen[0]]),
+		Data:        string(dbu.Data[:binary.LittleEndian.Uint16(dbu.DataLen[:])]),
+		Permissions: int(binary.LittleEndian.Uint16(dbu.Permissions[:])),
+	}
+	// версия 1 пишет время удаления секундами Unix
+	if dbu.DeletedAt != [8]byte{} {
+		u.DeletedAt = time.Unix(int64(binary.LittleEndian.Uint64(dbu.DeletedAt[:])), 0).UTC()
+	}
+	return u
+}
+
+func (dbu DBFileUser) user() user.User {
+	u := dbu.DBFileUserV0.user()
+	u.PassHash = string(bytes.TrimRight(dbu.PassHash[:], "\x00"))
+	return u
+}
+
+// plausibleV1 - похожа ли b на запись раскладки длины len(b): длины в пределах
+// полей, хвосты полей нулевые, хеш пустой или bcrypt
+func plausibleV1(b []byte) bool {
+	nameLen := int(b[24])
+	dataLen := int(binary.LittleEndian.Uint16(b[275:]))
+	if nameLen > 250 || dataLen > 1000 {
+		return false
+	}
+	zero := func(z []byte) bool { return len(bytes.Trim(z, "\x00")) == 0 }
+	if !zero(b[25+nameLen:275]) || !zero(b[277+dataLen:1277]) {
+		return false
+	}
+	if len(b) == DBFileUserLen {
+		h := b[DBFileUserV0Len:]
+		return zero(h) || bytes.HasPrefix(h, []byte("$2"))
+	}
+	return true
+}
+
+// v1RecordLen определяет раскладку файла версии 1: подходит та длина записи,
+// на которую делится размер файла и при которой все записи правдоподобны
+func v1RecordLen(r io.ReaderAt, size int64) (int, error) {
+	var found []int
+	for _, ln := range []int{DBFileUserV0Len, DBFileUserLen} {
+		if size%int64(ln) != 0 {
+			continue
+		}
+		ok := true
+		b := make([]byte, ln)
+		for off := int64(0); off < size && ok; off += int64(ln) {
+			if _, err := r.ReadAt(b, off); err != nil {
+				return 0, err
+			}
+			ok = plausibleV1(b)
+		}
+		if ok {
+			found = append(found, ln)
+		}
+	}
+	if len(found) != 1 {
+		return 0, fmt.Errorf("%w: can't tell v1 record layout of %d bytes", ErrCorrupted, size)
+	}
+	return found[0], nil
+}
+
+// scanV1 отдает записи файла версии 1 с записями длины recLen,
+// удаленные - с DeletedAt, чтобы их можно было вернуть и после миграции
+func scanV1(r io.Reader, recLen int, fn func(u user.User) error) error {
+	br := bufio.NewReader(r)
+	for {
+		var u user.User
+		var id [16]byte
+		var err error
+		if recLen == DBFileUserV0Len {
+			dbu := DBFileUserV0{}
+			err = binary.Read(br, binary.LittleEndian, &dbu)
+			u, id = dbu.user(), dbu.ID
+		} else {
+			dbu := DBFileUser{}
+			err = binary.Read(br, binary.LittleEndian, &dbu)
+			u, id = dbu.user(), dbu.ID
+		}
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		if id == [16]byte{} {
+			continue
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package userfstore
+
+import (
+	"bytes"
+
+	"github.com/google/btree"
+	"github.com/google/uuid"
+)
+
+// idItem - элемент индекса живых пользователей по ID
+type idItem uuid.UUID
+
+func (a idItem) Less(than btree.Item) bool {
+	b := than.(idItem)
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+// idIndex - живые пользователи по порядку ID, на нем держится курсор List.
+// В отличие от позиций в fdata.dat, ID не меняются ни при изменении
+// пользователя, ни при сжатии. Строится при открытии по pkmap, без чтения данных.
+type idIndex struct {
+	t *btree.BTree
+}
+
+func newIDIndex(pkmap map[uuid.UUID]Position) *idIndex {
+	ii := &idIndex{t: btree.New(32)}
+	for id := range pkmap {
+		ii.insert(id)
+	}
+	return ii
+}
+
+func (ii *idIndex) insert(id uuid.UUID) {
+	ii.t.ReplaceOrInsert(idItem(id))
+}
+
+func (ii *idIndex) remove(id uuid.UUID) {
+	ii.t.Delete(idItem(id))
+}
+
+// after возвращает до limit ID больше after по порядку
+func (ii *idIndex) after(after uuid.UUID, limit int) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, limit)
+	ii.t.AscendGreaterOrEqual(idItem(after), func(i btree.Item) bool {
+		id := uuid.UUID(i.(idItem))
+		if id == after {
+			return true
+		}
+		if len(ids) == limit {
+			return false
+		}
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
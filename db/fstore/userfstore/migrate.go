@@ -0,0 +1,108 @@
+package userfstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/larikhide/reguser/app/repos/user"
+)
+
+// migrateV1 переписывает fdata.dat версии 1 в текущий формат.
+// Новые файлы подменяют старые так же, как при сжатии,
+// поэтому прерванная миграция доводится или откатывается при следующем открытии.
+func migrateV1(dir string) error {
+	f, err := os.OpenFile(filepath.Join(dir, fdataName), os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return nil
+	}
+	v, err := fileVersionOf(f)
+	if err != nil {
+		return err
+	}
+	if v != 1 {
+		return nil
+	}
+
+	// журнал версии 1 пишет в позиции старого файла
+	if err := replayWAL(filepath.Join(dir, walName), f); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if fi, err = f.Stat(); err != nil {
+		return err
+	}
+	recLen, err := v1RecordLen(f, fi.Size())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	idxRecs, err := writeV2(filepath.Join(dir, fdataTmpName), f, recLen)
+	if err != nil {
+		os.Remove(filepath.Join(dir, fdataTmpName))
+		return err
+	}
+	if err := writePKFile(filepath.Join(dir, pkTmpName), idxRecs); err != nil {
+		os.Remove(filepath.Join(dir, fdataTmpName))
+		os.Remove(filepath.Join(dir, pkTmpName))
+		return err
+	}
+	if err := os.Truncate(filepath.Join(dir, walName), 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return commitCompact(dir)
+}
+
+// writeV2 пишет записи версии 1 длины recLen в новый файл текущего формата.
+// Удаленные становятся надгробиями, в индекс попадают только живые.
+func writeV2(name string, v1 io.Reader, recLen int) (SortedUserIndexRecords, error) {
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if _, err := w.Write(fileHeader()); err != nil {
+		return nil, err
+	}
+	idxRecs := make(SortedUserIndexRecords, 0, 1000)
+	p := Position(headerLen)
+	err = scanV1(v1, recLen, func(u user.User) error {
+		b := encodeRecord(fileRecord{User: u})
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if u.DeletedAt.IsZero() {
+			idxRecs = append(idxRecs, UserIndexRecord{UserID: u.ID, Position: p})
+		}
+		p += Position(len(b))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read v1 data error: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return idxRecs, out.Sync()
+}
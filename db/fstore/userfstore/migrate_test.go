@@ -0,0 +1,96 @@
+package userfstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+var v1DeletedAt = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func v1Record(id uuid.UUID, name, data string, perms int, passHash string, deleted bool) DBFileUser {
+	dbu := DBFileUser{}
+	dbu.ID = id
+	if deleted {
+		binary.LittleEndian.PutUint64(dbu.DeletedAt[:], uint64(v1DeletedAt.Unix()))
+	}
+	dbu.NameLen[0] = byte(len(name))
+	copy(dbu.Name[:], name)
+	binary.LittleEndian.PutUint16(dbu.DataLen[:], uint16(len(data)))
+	copy(dbu.Data[:], data)
+	binary.LittleEndian.PutUint16(dbu.Permissions[:], uint16(perms))
+	copy(dbu.PassHash[:], passHash)
+	return dbu
+}
+
+func TestMigrateV1Layouts(t *testing.T) {
+	hash := "$2a$10$" + string(bytes.Repeat([]byte("x"), 53))
+	for _, withHash := range []bool{false, true} {
+		live, gone := uuid.New(), uuid.New()
+		recs := []DBFileUser{
+			v1Record(live, "alice", "data of alice", 3, hash, false),
+			v1Record(gone, "bob", "", 1, hash, true),
+		}
+
+		var buf bytes.Buffer
+		for _, r := range recs {
+			var err error
+			if withHash {
+				err = binary.Write(&buf, binary.LittleEndian, r)
+			} else {
+				err = binary.Write(&buf, binary.LittleEndian, r.DBFileUserV0)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, fdataName), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		st, err := NewUserFileStore(dir)
+		if err != nil {
+			t.Fatalf("hash %v: open: %v", withHash, err)
+		}
+		u, err := st.Read(context.Background(), live)
+		if err != nil {
+			t.Fatalf("hash %v: read: %v", withHash, err)
+		}
+		wantHash := ""
+		if withHash {
+			wantHash = hash
+		}
+		if u.Name != "alice" || u.Data != "data of alice" || u.Permissions != 3 || u.PassHash != wantHash {
+			t.Errorf("hash %v: read %+v", withHash, *u)
+		}
+		// удаленный переезжает надгробием: прочитать нельзя, ID занят, вернуть можно
+		if _, err := st.Read(context.Background(), gone); !errors.Is(err, user.ErrNotFound) {
+			t.Errorf("hash %v: read of deleted returned %v, want %v", withHash, err, user.ErrNotFound)
+		}
+		if _, err := st.Create(context.Background(), user.User{ID: gone, Name: "eve"}); !errors.Is(err, user.ErrConflict) {
+			t.Errorf("hash %v: create with deleted ID returned %v, want %v", withHash, err, user.ErrConflict)
+		}
+		dd, err := st.deletedUsers()
+		if err != nil || len(dd) != 1 || !dd[0].DeletedAt.Equal(v1DeletedAt) {
+			t.Errorf("hash %v: deleted users %+v, %v, want deleted at %v", withHash, dd, err, v1DeletedAt)
+		}
+		ru, err := st.Restore(context.Background(), gone, 0)
+		if err != nil {
+			t.Fatalf("hash %v: restore of migrated deleted user: %v", withHash, err)
+		}
+		if ru.Name != "bob" || ru.Permissions != 1 || ru.PassHash != wantHash || !ru.DeletedAt.IsZero() {
+			t.Errorf("hash %v: restored %+v", withHash, *ru)
+		}
+		st.Close()
+	}
+}
@@ -0,0 +1,67 @@
+package userfstore
+
+import (
+	"errors"
+	"os"
+)
+
+// после стольких незамапленных байт в конце файла отображение обновляется
+const mmapRemapStep = 1 << 20
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// mmapData читает fdata.dat из отображения в память.
+// Записи только дописываются, поэтому отображенная часть не меняется,
+// а то, что дописано после последнего отображения, читается из файла.
+type mmapData struct {
+	f *os.File
+	b []byte
+}
+
+func newMmapData(f *os.File, size int64) (*mmapData, error) {
+	m := &mmapData{f: f}
+	if err := m.remap(size); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *mmapData) ReadAt(p []byte, off int64) (int, error) {
+	if b, ok := m.slice(off, int64(len(p))); ok {
+		return copy(p, b), nil
+	}
+	return m.f.ReadAt(p, off)
+}
+
+// slice возвращает кусок отображения без копирования, если он весь отображен
+func (m *mmapData) slice(off, n int64) ([]byte, bool) {
+	if off < 0 || n < 0 || off+n > int64(len(m.b)) {
+		return nil, false
+	}
+	return m.b[off : off+n], true
+}
+
+// remap отображает файл заново, size не больше размера файла
+func (m *mmapData) remap(size int64) error {
+	if err := m.unmap(); err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	b, err := mmapFile(m.f, int(size))
+	if err != nil {
+		return err
+	}
+	m.b = b
+	return nil
+}
+
+func (m *mmapData) unmap() error {
+	if m.b == nil {
+		return nil
+	}
+	err := munmapFile(m.b)
+	m.b = nil
+	return err
+}
@@ -0,0 +1,200 @@
+package userfstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/btree"
+	"github.com/google/uuid"
+)
+
+const nameIdxName = "name.idx"
+
+// nameItem - элемент индекса по имени, порядок по имени, затем по ID
+type nameItem struct {
+	name string
+	id   uuid.UUID
+}
+
+func (a nameItem) Less(than btree.Item) bool {
+	b := than.(nameItem)
+	if a.name != b.name {
+		return a.name < b.name
+	}
+	return bytes.Compare(a.id[:], b.id[:]) < 0
+}
+
+// nameIndex - индекс живых пользователей по имени для поиска по префиксу
+// и проверки уникальности имени без учета регистра.
+// Живет в памяти, при закрытии хранилища сохраняется в name.idx вместе
+// с концом fdata.dat, на который он построен. При открытии файл берется,
+// только если конец совпал, иначе индекс строится заново по данным.
+//
+// Формат name.idx:
+//
+//	[4]"RUNI" [8]конец fdata.dat [8]число записей
+//	записи:   [uvarint]длина имени [имя] [16]ID
+//	[4]crc32c всего, что выше
+type nameIndex struct {
+	t *btree.BTree
+	// ID по user.NameKey; больше одного бывает только у дублей,
+	// записанных до появления проверки
+	keys map[string][]uuid.UUID
+}
+
+const nameIdxMagic = "RUNI"
+
+func newNameIndex() *nameIndex {
+	return &nameIndex{
+		t:    btree.New(32),
+		keys: make(map[string][]uuid.UUID),
+	}
+}
+
+func (ni *nameIndex) insert(name string, id uuid.UUID) {
+	if ni.t.ReplaceOrInsert(nameItem{name: name, id: id}) == nil {
+		k := user.NameKey(name)
+		ni.keys[k] = append(ni.keys[k], id)
+	}
+}
+
+func (ni *nameIndex) remove(name string, id uuid.UUID) {
+	if ni.t.Delete(nameItem{name: name, id: id}) == nil {
+		return
+	}
+	k := user.NameKey(name)
+	ids := ni.keys[k][:0]
+	for _, kid := range ni.keys[k] {
+		if kid != id {
+			ids = append(ids, kid)
+		}
+	}
+	if len(ids) == 0 {
+		delete(ni.keys, k)
+		return
+	}
+	ni.keys[k] = ids
+}
+
+// taken - имя занято живым пользователем кроме id
+func (ni *nameIndex) taken(name string, id uuid.UUID) bool {
+	for _, kid := range ni.keys[user.NameKey(name)] {
+		if kid != id {
+			return true
+		}
+	}
+	return false
+}
+
+// byKey возвращает ID живых пользователей с именем name без учета регистра
+func (ni *nameIndex) byKey(name string) []uuid.UUID {
+	return ni.keys[user.NameKey(name)]
+}
+
+// prefix возвращает ID пользователей, у которых имя начинается с s, по порядку имен
+func (ni *nameIndex) prefix(s string) []uuid.UUID {
+	var ids []uuid.UUID
+	ni.t.AscendGreaterOrEqual(nameItem{name: s}, func(i btree.Item) bool {
+		it := i.(nameItem)
+		if len(it.name) < len(s) || it.name[:len(s)] != s {
+			return false
+		}
+		ids = append(ids, it.id)
+		return true
+	})
+	return ids
+}
+
+// save пишет индекс во временный файл и подменяет им name.idx
+func (ni *nameIndex) save(dir string, end Position) error {
+	tmp := filepath.Join(dir, nameIdxName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := crc32.New(crcTable)
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+
+	hdr := make([]byte, len(nameIdxMagic)+16)
+	copy(hdr, nameIdxMagic)
+	binary.LittleEndian.PutUint64(hdr[4:], uint64(end))
+	binary.LittleEndian.PutUint64(hdr[12:], uint64(ni.t.Len()))
+	w.Write(hdr)
+
+	var buf [binary.MaxVarintLen64]byte
+	ni.t.Ascend(func(i btree.Item) bool {
+		it := i.(nameItem)
+		n := binary.PutUvarint(buf[:], uint64(len(it.name)))
+		w.Write(buf[:n])
+		w.WriteString(it.name)
+		w.Write(it.id[:])
+		return true
+	})
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], h.Sum32())
+	if _, err := f.Write(sum[:]); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, nameIdxName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// loadNameIndex читает name.idx, если он построен на тот же конец fdata.dat
+func loadNameIndex(dir string, end Position) (*nameIndex, bool) {
+	b, err := os.ReadFile(filepath.Join(dir, nameIdxName))
+	if err != nil || len(b) < len(nameIdxMagic)+16+4 {
+		return nil, false
+	}
+	body, sum := b[:len(b)-4], b[len(b)-4:]
+	if string(body[:len(nameIdxMagic)]) != nameIdxMagic ||
+		crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(sum) ||
+		Position(binary.LittleEndian.Uint64(body[4:])) != end {
+		return nil, false
+	}
+
+	cnt := binary.LittleEndian.Uint64(body[12:])
+	body = body[len(nameIdxMagic)+16:]
+	ni := newNameIndex()
+	for i := uint64(0); i < cnt; i++ {
+		ln, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < ln+16 {
+			return nil, false
+		}
+		it := nameItem{name: string(body[n : n+int(ln)])}
+		copy(it.id[:], body[n+int(ln):])
+		body = body[n+int(ln)+16:]
+		ni.insert(it.name, it.id)
+	}
+	return ni, len(body) == 0
+}
+
+// buildNameIndex строит индекс по последним версиям живых записей
+func buildNameIndex(fdata io.ReaderAt, pkmap map[uuid.UUID]Position) (*nameIndex, error) {
+	ni := newNameIndex()
+	for _, p := range pkmap {
+		fr, err := readRecord(fdata, p)
+		if err != nil {
+			return nil, fmt.Errorf("build name index error: %w", err)
+		}
+		ni.insert(fr.Name, fr.ID)
+	}
+	return ni, nil
+}
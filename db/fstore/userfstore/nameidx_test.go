@@ -0,0 +1,100 @@
+package userfstore
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+// scanPrefix - поиск по префиксу перебором всех живых, как до индекса имен
+func scanPrefix(st *UserFileStore, s string) ([]user.User, error) {
+	uu, err := st.liveUsers()
+	if err != nil {
+		return nil, err
+	}
+	ret := uu[:0]
+	for _, u := range uu {
+		if strings.HasPrefix(u.Name, s) {
+			ret = append(ret, u)
+		}
+	}
+	return ret, nil
+}
+
+func TestNameIndexPrefix(t *testing.T) {
+	ni := newNameIndex()
+	names := map[uuid.UUID]string{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		id := uuid.New()
+		names[id] = fmt.Sprintf("%c%d", 'a'+r.Intn(3), r.Intn(500))
+		ni.insert(names[id], id)
+	}
+	for id, n := range names {
+		if r.Intn(4) == 0 {
+			ni.remove(n, id)
+			delete(names, id)
+		}
+	}
+
+	for _, s := range []string{"", "a", "b1", "c49", "c499", "d"} {
+		var want []uuid.UUID
+		for id, n := range names {
+			if strings.HasPrefix(n, s) {
+				want = append(want, id)
+			}
+		}
+		// по имени, затем по байтам ID
+		sort.Slice(want, func(i, j int) bool {
+			return nameItem{names[want[i]], want[i]}.Less(nameItem{names[want[j]], want[j]})
+		})
+		if got := ni.prefix(s); !(len(got) == 0 && len(want) == 0) && !reflect.DeepEqual(got, want) {
+			t.Errorf("prefix %q: %d ids, want %d", s, len(got), len(want))
+		}
+	}
+}
+
+// BenchmarkNamePrefix сравнивает поиск по префиксу по индексу имен
+// с перебором на миллионе пользователей:
+//
+//	go test -run - -bench NamePrefix ./db/fstore/userfstore
+func BenchmarkNamePrefix(b *testing.B) {
+	const n = 1000000
+	dir, _ := writeBenchStore(b, n)
+	st := openBenchStore(b, dir)
+
+	for _, bc := range []struct {
+		prefix string
+		found  int
+	}{
+		{"user0123456", 1},
+		{"user01234", 100},
+		{"user012", 10000},
+	} {
+		for _, m := range []struct {
+			name   string
+			search func(st *UserFileStore, s string) ([]user.User, error)
+		}{
+			{"index", (*UserFileStore).usersByName},
+			{"scan", scanPrefix},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", m.name, bc.found), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					st.RLock()
+					uu, err := m.search(st, bc.prefix)
+					st.RUnlock()
+					if err != nil || len(uu) != bc.found {
+						b.Fatalf("%s: %d users, %v", bc.prefix, len(uu), err)
+					}
+				}
+			})
+		}
+	}
+}
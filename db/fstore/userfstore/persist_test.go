@@ -0,0 +1,212 @@
+package userfstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+// storeState - все, что хранилище знает о пользователях
+type storeState struct {
+	Live    map[uuid.UUID]user.User
+	Deleted map[uuid.UUID]user.User
+	Names   []uuid.UUID // живые в порядке индекса имен
+}
+
+func stateOf(t testing.TB, st *UserFileStore) storeState {
+	t.Helper()
+	st.RLock()
+	defer st.RUnlock()
+
+	s := storeState{Live: map[uuid.UUID]user.User{}, Deleted: map[uuid.UUID]user.User{}}
+	live, err := st.liveUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range live {
+		s.Live[u.ID] = u
+	}
+	deleted, err := st.deletedUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range deleted {
+		s.Deleted[u.ID] = u
+	}
+	byName, err := st.usersByName("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range byName {
+		s.Names = append(s.Names, u.ID)
+	}
+	return s
+}
+
+func checkState(t testing.TB, st *UserFileStore, want storeState) {
+	t.Helper()
+	if got := stateOf(t, st); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened store state\n%+v\nwant\n%+v", got, want)
+	}
+	ctx := context.Background()
+	for id, u := range want.Live {
+		got, err := st.ReadByName(ctx, u.Name)
+		if err != nil || got.ID != id {
+			t.Fatalf("read by name %s: %v, %v", u.Name, got, err)
+		}
+	}
+	for id := range want.Deleted {
+		if _, err := st.Read(ctx, id); err != user.ErrNotFound {
+			t.Fatalf("read of deleted %s: %v", id, err)
+		}
+	}
+}
+
+// fillStore создает, меняет, удаляет, восстанавливает и стирает пользователей
+// с именами на prefix
+func fillStore(t testing.TB, st *UserFileStore, prefix string) {
+	t.Helper()
+	ctx := context.Background()
+	var ids []uuid.UUID
+	for i := 0; i < 50; i++ {
+		u := user.User{ID: uuid.New(), Name: fmt.Sprintf("%suser%02d", prefix, i), Data: "data", Permissions: i % 16}
+		if i%5 == 0 {
+			u.PassHash = "$2a$10$hash"
+		}
+		if _, err := st.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, u.ID)
+	}
+	for i, id := range ids {
+		switch i % 5 {
+		case 1:
+			u, err := st.Read(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.Name = fmt.Sprintf("%srenamed%02d", prefix, i)
+			u.Data = "changed"
+			if err := st.Update(ctx, *u); err != nil {
+				t.Fatal(err)
+			}
+		case 2:
+			if err := st.Delete(ctx, id, 0); err != nil {
+				t.Fatal(err)
+			}
+		case 3:
+			if err := st.Delete(ctx, id, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := st.Restore(ctx, id, 0); err != nil {
+				t.Fatal(err)
+			}
+		case 4:
+			if err := st.Delete(ctx, id, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.Purge(ctx, id, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithMmap()}} {
+		dir := t.TempDir()
+		st, err := NewUserFileStore(dir, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillStore(t, st, "a")
+		want := stateOf(t, st)
+		st.Close()
+
+		st, err = NewUserFileStore(dir, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkState(t, st, want)
+
+		// и еще раз, уже после изменений в открытом заново
+		fillStore(t, st, "b")
+		want = stateOf(t, st)
+		st.Close()
+		st, err = NewUserFileStore(dir, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkState(t, st, want)
+		st.Close()
+	}
+}
+
+// copyDir копирует файлы хранилища как есть, как будто процесс упал
+func copyDir(t testing.TB, from, to string) {
+	t.Helper()
+	ee, err := os.ReadDir(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(ee))
+	for _, e := range ee {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		src, err := os.Open(filepath.Join(from, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err := os.Create(filepath.Join(to, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			t.Fatal(err)
+		}
+		src.Close()
+		dst.Close()
+	}
+}
+
+func TestReopenWithoutClose(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewUserFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	fillStore(t, st, "a")
+	want := stateOf(t, st)
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+
+	st2, err := NewUserFileStore(crashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, st2, want)
+
+	// после восстановления хранилище работает как обычно
+	fillStore(t, st2, "b")
+	want = stateOf(t, st2)
+	st2.Close()
+	st2, err = NewUserFileStore(crashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, st2, want)
+	st2.Close()
+}
@@ -0,0 +1,28 @@
+package userfstore
+
+import (
+	"testing"
+
+	"github.com/larikhide/reguser/app/repos/user"
+	"github.com/larikhide/reguser/app/repos/user/storetest"
+)
+
+func TestStore(t *testing.T) {
+	for _, bo := range []struct {
+		name string
+		opts []Option
+	}{
+		{"file", nil},
+		{"mmap", []Option{WithMmap()}},
+	} {
+		t.Run(bo.name, func(t *testing.T) {
+			storetest.Run(t, func() (user.UserStore, func(), error) {
+				st, err := NewUserFileStore(t.TempDir(), bo.opts...)
+				if err != nil {
+					return nil, nil, err
+				}
+				return st, st.Close, nil
+			})
+		})
+	}
+}
@@ -1,10 +1,10 @@
 package userfstore
 
 import (
-	"bytes"
+	"bufio"
 	"context"
-	"database/sql"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -35,141 +35,296 @@ type UserIndexRecord struct {
 	Delete   bool
 }
 
+// UserFileStore читает только через ReadAt, поэтому чтения идут параллельно
+// под RLock, а изменения, конец сжатия и закрытие берут Lock.
 type UserFileStore struct {
-	sync.Mutex
-	fdata   *os.File
-	pkmap   map[uuid.UUID]Position
-	idxRecs SortedUserIndexRecords
-	pkchan  chan UserIndexRecord
-	pk      *os.File
+	sync.RWMutex
+	compactMu sync.Mutex // сжатия идут по одному, закрытие ждет сжатия
+	dir       string
+	fdata     *os.File
+	end       Position // конец последней целой записи, сюда пишется следующая
+	pkmap     map[uuid.UUID]Position
+	idxRecs   SortedUserIndexRecords
+	deleted   map[uuid.UUID]Position // надгробия удаленных, их ID занят
+	names     *nameIndex
+	ids       *idIndex
+	pkchan    chan UserIndexRecord
+	pkdone    chan struct{}
+	pk        *os.File
+	wal       *wal
+	mm        *mmapData // nil, если чтение идет из файла
 }
 
-func NewUserFileStore(dir string) (*UserFileStore, error) {
-	fdata, err := os.OpenFile(filepath.Join(dir, "fdata.dat"), os.O_RDWR|os.O_SYNC|os.O_CREATE, 0644)
+type options struct {
+	mmap bool
+}
+
+type Option func(*options)
+
+// WithMmap включает чтение fdata.dat через отображение в память.
+// Где mmap нет, хранилище молча читает из файла.
+func WithMmap() Option {
+	return func(o *options) {
+		o.mmap = true
+	}
+}
+
+func NewUserFileStore(dir string, opts ...Option) (*UserFileStore, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := finishCompact(dir); err != nil {
+		return nil, err
+	}
+	if err := migrateV1(dir); err != nil {
+		return nil, fmt.Errorf("migrate store error: %w", err)
+	}
+
+	fdata, err := os.OpenFile(filepath.Join(dir, fdataName), os.O_RDWR|os.O_SYNC|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
 
-	pkmap := make(map[uuid.UUID]Position)
-	idxRecs := make(SortedUserIndexRecords, 0, 1000)
+	if err := initHeader(fdata); err != nil {
+		fdata.Close()
+		return nil, err
+	}
 
-	pk, err := os.OpenFile(filepath.Join(dir, "pk.dat"), os.O_RDONLY, 0644)
+	pkmap, idxRecs, deleted, end, err := recoverStore(dir, fdata)
 	if err != nil {
-		if !os.IsNotExist(err) {
+		fdata.Close()
+		return nil, fmt.Errorf("recover store error: %w", err)
+	}
+
+	names, ok := loadNameIndex(dir, end)
+	if !ok {
+		if names, err = buildNameIndex(fdata, pkmap); err != nil {
+			fdata.Close()
 			return nil, err
 		}
-	} else {
-		var ir UserIndexRecord
-		for {
-			if err := binary.Read(pk, binary.LittleEndian, &ir); err == io.EOF {
-				break
-			}
-			if ir.Delete {
-				delete(pkmap, ir.UserID)
-			} else {
-				pkmap[ir.UserID] = ir.Position
-
-				idx := sort.Search(len(idxRecs), func(i int) bool {
-					return idxRecs[i].Position >= ir.Position
-				})
-				if idx == len(idxRecs) {
-					// добавление
-					idxRecs = append(idxRecs, ir)
-				} else {
-					if idxRecs[idx].Position == ir.Position {
-						if !ir.Delete {
-							// замена
-							idxRecs[idx].UserID = ir.UserID
-						} else {
-							// удаление
-							idxRecs = append(idxRecs[:idx], idxRecs[idx+1:]...)
-						}
-					} else {
-						// вставка
-						idxRecs = append(idxRecs[:idx], append(SortedUserIndexRecords{ir},
-							idxRecs[idx+1:]...)...)
-					}
-				}
+	}
+	// до закрытия индекс на диске устаревает, после сбоя его надо строить заново
+	if err := os.Remove(filepath.Join(dir, nameIdxName)); err != nil && !os.IsNotExist(err) {
+		fdata.Close()
+		return nil, err
+	}
 
-			}
-		}
+	w, err := openWAL(filepath.Join(dir, walName))
+	if err != nil {
+		fdata.Close()
+		return nil, err
+	}
+	// после восстановления журнал уже весь в fdata.dat
+	if err := w.truncate(); err != nil {
+		fdata.Close()
+		w.Close()
+		return nil, err
 	}
-	pk.Close()
 
-	pk, err = os.OpenFile(filepath.Join(dir, "pk.dat"),
-		os.O_WRONLY|os.O_SYNC|os.O_CREATE|os.O_APPEND|os.O_EXCL, 0644)
+	pk, err := os.OpenFile(filepath.Join(dir, pkName),
+		os.O_WRONLY|os.O_SYNC|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
+		fdata.Close()
+		w.Close()
 		return nil, err
 	}
 
 	st := &UserFileStore{
+		dir:     dir,
 		fdata:   fdata,
+		end:     end,
 		pkmap:   pkmap,
 		pk:      pk,
-		pkchan:  make(chan UserIndexRecord, 100),
+		wal:     w,
 		idxRecs: idxRecs,
+		deleted: deleted,
+		names:   names,
+		ids:     newIDIndex(pkmap),
 	}
 
-	go st.writePK()
+	if o.mmap {
+		if st.mm, err = newMmapData(fdata, int64(end)); err != nil {
+			log.Println("mmap fdata.dat, reading from file: ", err)
+			st.mm = nil
+		}
+	}
+
+	st.startPK()
 
 	return st, nil
 }
 
+// initHeader пишет заголовок в новый файл и проверяет версию существующего
+func initHeader(fdata *os.File) error {
+	fi, err := fdata.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		if _, err := fdata.WriteAt(fileHeader(), 0); err != nil {
+			return err
+		}
+		return nil
+	}
+	v, err := fileVersionOf(fdata)
+	if err != nil {
+		return err
+	}
+	if v != fileVersion {
+		return fmt.Errorf("unsupported fdata.dat version %d", v)
+	}
+	return nil
+}
+
+// loadPK читает индекс из журнала pk.dat,
+// недописанная последняя запись отбрасывается
+func loadPK(name string) (map[uuid.UUID]Position, SortedUserIndexRecords, error) {
+	pkmap := make(map[uuid.UUID]Position)
+	idxRecs := make(SortedUserIndexRecords, 0, 1000)
+
+	pk, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pkmap, idxRecs, nil
+		}
+		return nil, nil, err
+	}
+	defer pk.Close()
+
+	r := bufio.NewReader(pk)
+	var ir UserIndexRecord
+	for {
+		if err := binary.Read(r, binary.LittleEndian, &ir); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, nil, fmt.Errorf("read pk error: %w", err)
+		}
+		if ir.Delete {
+			delete(pkmap, ir.UserID)
+			continue
+		}
+		pkmap[ir.UserID] = ir.Position
+
+		idx := sort.Search(len(idxRecs), func(i int) bool {
+			return idxRecs[i].Position >= ir.Position
+		})
+		switch {
+		case idx == len(idxRecs):
+			// добавление
+			idxRecs = append(idxRecs, ir)
+		case idxRecs[idx].Position == ir.Position:
+			// замена
+			idxRecs[idx].UserID = ir.UserID
+		default:
+			// вставка
+			idxRecs = append(idxRecs, UserIndexRecord{})
+			copy(idxRecs[idx+1:], idxRecs[idx:])
+			idxRecs[idx] = ir
+		}
+	}
+	return pkmap, idxRecs, nil
+}
+
+// Close дожидается записи индекса и закрывает файлы
 func (st *UserFileStore) Close() {
+	st.compactMu.Lock()
+	defer st.compactMu.Unlock()
+	st.Lock()
+	defer st.Unlock()
+
+	st.stopPK()
+	if err := st.names.save(st.dir, st.end); err != nil {
+		log.Println("save name index: ", err)
+	}
+	// индекс дописан, журнал больше не нужен
+	if err := st.wal.truncate(); err != nil {
+		log.Println("truncate wal: ", err)
+	}
+	st.wal.Close()
+	if st.mm != nil {
+		st.mm.unmap()
+	}
 	st.fdata.Close()
 	st.pk.Close()
 }
 
-const DBFileUserLen = 16 + 8 + 1 + 250 + 2 + 1000 + 2
+// reader - откуда читать записи: отображение, если оно есть, или файл
+func (st *UserFileStore) reader() io.ReaderAt {
+	if st.mm != nil {
+		return st.mm
+	}
+	return st.fdata
+}
+
+func (st *UserFileStore) startPK() {
+	st.pkchan = make(chan UserIndexRecord, 100)
+	st.pkdone = make(chan struct{})
+	go st.writePK()
+}
 
-type DBFileUser struct {
-	ID          [16]byte
-	DeletedAt   [8]byte
-	NameLen     [1]byte
-	Name        [250]byte
-	DataLen     [2]byte
-	Data        [1000]byte
-	Permissions [2]byte
+// stopPK дожидается, пока writePK допишет все из pkchan
+func (st *UserFileStore) stopPK() {
+	close(st.pkchan)
+	<-st.pkdone
 }
 
-func (st *UserFileStore) addUserToFdata(u user.User) (Position, error) {
-	if len(u.Data) > 1000 {
-		return -1, fmt.Errorf("data too much")
+// writeAt пишет в fdata.dat через журнал
+func (st *UserFileStore) writeAt(b []byte, p Position) error {
+	if err := st.wal.append(int64(p), b); err != nil {
+		return fmt.Errorf("write wal error: %w", err)
 	}
-	st.fdata.Seek(0, io.SeekEnd) // O(1)
-	fi, err := st.fdata.Stat()
-	if err != nil {
-		return -1, err
+	if _, err := st.fdata.WriteAt(b, int64(p)); err != nil {
+		return err
 	}
-	p := Position(fi.Size())
-
-	ln := len(st.idxRecs)
-	idx := sort.Search(ln, func(i int) bool {
-		return st.idxRecs[i].Position >= p
-	})
-	st.idxRecs = append(st.idxRecs, UserIndexRecord{})
-	if idx < ln {
-		copy(st.idxRecs[idx+1:], st.idxRecs[idx:])
+	if st.wal.size > walCheckpointSize {
+		st.checkpoint()
 	}
-	st.idxRecs[idx] = UserIndexRecord{
-		UserID:   u.ID,
-		Position: p,
-		Delete:   false,
+	return nil
+}
+
+// checkpoint сбрасывает журнал, когда fdata.dat и pk.dat догнали его
+func (st *UserFileStore) checkpoint() {
+	st.stopPK()
+	defer st.startPK()
+	if err := st.wal.truncate(); err != nil {
+		log.Println("truncate wal: ", err)
 	}
+}
 
-	dbu := DBFileUser{
-		ID:      u.ID,
-		NameLen: [1]byte{byte(len(u.Name))},
+// appendRecord дописывает версию пользователя в конец fdata.dat
+func (st *UserFileStore) appendRecord(fr fileRecord) (Position, error) {
+	b := encodeRecord(fr)
+	if len(b)-recHdrLen > recMaxLen {
+		return -1, fmt.Errorf("%w: record too long", user.ErrValidation)
+	}
+	p := st.end
+	if err := st.writeAt(b, p); err != nil {
+		return -1, err
+	}
+	st.end += Position(len(b))
+	if st.mm != nil && int64(st.end)-int64(len(st.mm.b)) > mmapRemapStep {
+		if err := st.mm.remap(int64(st.end)); err != nil {
+			log.Println("remap fdata.dat, reading from file: ", err)
+			st.mm = nil
+		}
 	}
-	binary.LittleEndian.PutUint16(dbu.DataLen[:], uint16(len(u.Data)))
-	binary.LittleEndian.PutUint16(dbu.Permissions[:], uint16(u.Permissions))
-	copy(dbu.Data[:], []byte(u.Data))
-	copy(dbu.Name[:], []byte(u.Name))
 
-	return p, binary.Write(st.fdata, binary.LittleEndian, dbu)
+	// позиции только растут, индекс остается упорядоченным
+	st.idxRecs = append(st.idxRecs, UserIndexRecord{
+		UserID:   fr.ID,
+		Position: p,
+	})
+	return p, nil
 }
 
 func (st *UserFileStore) writePK() {
+	defer close(st.pkdone)
 	for v := range st.pkchan {
 		if err := binary.Write(st.pk, binary.LittleEndian, v); err != nil {
 			log.Println("writePK: ", err)
@@ -177,14 +332,15 @@ func (st *UserFileStore) writePK() {
 	}
 }
 
-func (st *UserFileStore) addUserToFdataAndPK(u user.User) error {
-	if _, ok := st.pkmap[u.ID]; ok {
-		return fmt.Errorf("user duplicates")
-	}
-	p, err := st.addUserToFdata(u)
+// putUser пишет новую версию пользователя и переключает на нее индекс
+func (st *UserFileStore) putUser(u user.User) error {
+	p, err := st.appendRecord(fileRecord{User: u})
 	if err != nil {
 		return err
 	}
+	if _, ok := st.pkmap[u.ID]; !ok {
+		st.ids.insert(u.ID) // O(log N)
+	}
 	st.pkmap[u.ID] = p // O(1)
 	st.pkchan <- UserIndexRecord{
 		UserID:   u.ID,
@@ -203,49 +359,48 @@ func (us *UserFileStore) Create(ctx context.Context, u user.User) (*uuid.UUID, e
 	default:
 	}
 
-	// uid := uuid.New()
-	// u.ID = uid
-	err := us.addUserToFdataAndPK(u) // O(1)
-	if err != nil {
+	if _, ok := us.pkmap[u.ID]; ok {
+		return nil, fmt.Errorf("%w: user duplicates", &user.ConflictError{Field: "id"})
+	}
+	if _, ok := us.deleted[u.ID]; ok {
+		return nil, fmt.Errorf("%w: user with this id was deleted", &user.ConflictError{Field: "id"})
+	}
+	if us.names.taken(u.Name, u.ID) { // O(1)
+		return nil, &user.ConflictError{Field: "name"}
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = user.Now()
+	}
+	if u.UpdatedAt.IsZero() {
+		u.UpdatedAt = u.CreatedAt
+	}
+	u.DeletedAt = time.Time{}
+	u.Version = 1
+	if err := us.putUser(u); err != nil { // O(1)
 		return nil, err
 	}
+	us.names.insert(u.Name, u.ID) // O(log N)
 	return &u.ID, nil
 }
 
-func (st *UserFileStore) readDBFileUserByID(id uuid.UUID) (DBFileUser, error) {
+func (st *UserFileStore) readUserByID(id uuid.UUID) (user.User, error) {
 	p, ok := st.pkmap[id] // O(1)
 	if !ok {
-		return DBFileUser{}, sql.ErrNoRows
+		return user.User{}, user.ErrNotFound
 	}
-	st.fdata.Seek(int64(p), io.SeekStart) // O(1)
-	dbu := DBFileUser{}
-	if err := binary.Read(st.fdata, binary.LittleEndian, &dbu); err != nil {
-		return dbu, err
-	}
-	return dbu, nil
-}
-
-func (st *UserFileStore) readUserByID(id uuid.UUID) (user.User, error) {
-	dbu, err := st.readDBFileUserByID(id)
+	fr, err := readRecord(st.reader(), p) // O(1)
 	if err != nil {
 		return user.User{}, err
 	}
-	if dbu.DeletedAt != [8]byte{} {
-		return user.User{}, sql.ErrNoRows
-	}
-
-	u := user.User{
-		ID:          dbu.ID,
-		Name:        string(dbu.Name[:dbu.NameLen[0]]),
-		Data:        string(dbu.Data[:binary.LittleEndian.Uint16(dbu.DataLen[:])]),
-		Permissions: int(binary.LittleEndian.Uint16(dbu.Permissions[:])),
+	if !fr.DeletedAt.IsZero() {
+		return user.User{}, user.ErrNotFound
 	}
-	return u, nil
+	return fr.User, nil
 }
 
 func (us *UserFileStore) Read(ctx context.Context, uid uuid.UUID) (*user.User, error) {
-	us.Lock()
-	defer us.Unlock()
+	us.RLock()
+	defer us.RUnlock()
 
 	select {
 	case <-ctx.Done():
@@ -259,17 +414,91 @@ func (us *UserFileStore) Read(ctx context.Context, uid uuid.UUID) (*user.User, e
 	return &u, nil
 }
 
-func (st *UserFileStore) deleteDBFileUserByID(id uuid.UUID) error {
-	p, ok := st.pkmap[id]
-	if !ok {
-		return nil
+func (us *UserFileStore) ReadByName(ctx context.Context, name string) (*user.User, error) {
+	us.RLock()
+	defer us.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	var ret *user.User
+	for _, id := range us.names.byKey(name) { // O(1)
+		u, err := us.readUserByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if ret == nil || u.Name == name {
+			ret = &u
+		}
+	}
+	if ret == nil {
+		return nil, user.ErrNotFound
+	}
+	return ret, nil
+}
+
+func (us *UserFileStore) Update(ctx context.Context, u user.User) error {
+	us.Lock()
+	defer us.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	old, err := us.readUserByID(u.ID)
+	if err != nil {
+		return err
+	}
+	if u.Version != 0 && u.Version != old.Version {
+		return user.ErrVersionMismatch
+	}
+	if us.names.taken(u.Name, u.ID) { // O(1)
+		return &user.ConflictError{Field: "name"}
 	}
-	st.fdata.Seek(int64(p)+16, io.SeekStart) // O(1)
-	if err := binary.Write(st.fdata, binary.LittleEndian, time.Now().Unix()); err != nil {
+	u.Version = old.Version + 1
+	u.CreatedAt = old.CreatedAt
+	if u.UpdatedAt.IsZero() {
+		u.UpdatedAt = user.Now()
+	}
+	u.DeletedAt = time.Time{}
+	if err := us.putUser(u); err != nil { // O(1)
+		return err
+	}
+	if old.Name != u.Name {
+		us.names.remove(old.Name, u.ID) // O(log N)
+		us.names.insert(u.Name, u.ID)
+	}
+	return nil
+}
+
+// deleteUserByID дописывает последнюю версию пользователя с DeletedAt,
+// ненулевая version должна совпасть с версией живого пользователя
+func (st *UserFileStore) deleteUserByID(id uuid.UUID, version int64) error {
+	u, err := st.readUserByID(id)
+	if err != nil {
+		if errors.Is(err, user.ErrNotFound) && version == 0 {
+			return nil
+		}
+		return err
+	}
+	if version != 0 && version != u.Version {
+		return user.ErrVersionMismatch
+	}
+	u.Version++
+	u.DeletedAt = user.Now()
+	p, err := st.appendRecord(fileRecord{User: u}) // O(1)
+	if err != nil {
 		return err
 	}
 
 	delete(st.pkmap, id) // O(1)
+	st.ids.remove(id)    // O(log N)
+	st.deleted[id] = p
+	st.names.remove(u.Name, id) // O(log N)
 	st.pkchan <- UserIndexRecord{
 		UserID: id,
 		Delete: true,
@@ -278,8 +507,8 @@ func (st *UserFileStore) deleteDBFileUserByID(id uuid.UUID) error {
 	return nil
 }
 
-// не возвращает ошибку если не нашли
-func (us *UserFileStore) Delete(ctx context.Context, uid uuid.UUID) error {
+// без version не возвращает ошибку если не нашли
+func (us *UserFileStore) Delete(ctx context.Context, uid uuid.UUID, version int64) error {
 	us.Lock()
 	defer us.Unlock()
 
@@ -289,129 +518,251 @@ func (us *UserFileStore) Delete(ctx context.Context, uid uuid.UUID) error {
 	default:
 	}
 
-	return us.deleteDBFileUserByID(uid)
+	return us.deleteUserByID(uid, version)
 }
 
-func (us *UserFileStore) iterateInFdata(ctx context.Context, s string) chan DBFileUser {
-	chout := make(chan DBFileUser, 100)
-	bs := []byte(s)
-	us.fdata.Seek(0, io.SeekStart)
-	p0 := 0
-	go func() {
-		defer close(chout)
-		var buf [DBFileUserLen * 100]byte
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
+func (us *UserFileStore) Restore(ctx context.Context, uid uuid.UUID, version int64) (*user.User, error) {
+	us.Lock()
+	defer us.Unlock()
 
-			us.fdata.Seek(int64(p0), io.SeekStart)
-			n, err := us.fdata.Read(buf[:])
-			if err == io.EOF {
-				return
-			}
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			b := buf[:n]
-
-			for len(b) > 0 {
-				pidx := bytes.Index(b, bs)
-				if pidx < 0 {
-					continue
-				}
-				pidx += p0
-				// TODO: проверяем что мы попали в границы поля Name
-
-				// var uir UserIndexRecord
-				// idx := sort.Search(len(us.idxRecs), func(i int) bool {
-				// 	return us.idxRecs[i].Position >= Position(pidx)
-				// })
-				// if idx == len(us.idxRecs) {
-				// 	uir = us.idxRecs[idx]
-				// } else {
-				// 	uir = us.idxRecs[idx-1]
-				// }
-
-				// TODO:
-				// b = b[uir.Position-0:]
-				// TODO: заменить на срез буфера со следующей записи, продолжить цикл если буфер пуст
-
-				// us.fdata.Seek(int64(uir.Position+DBFileUserLen), io.SeekStart)
-
-				// TODO: читать юзера из буфера, а не файла
-				pr := pidx % DBFileUserLen
-				pidx = -pr
-				us.fdata.Seek(int64(pidx), io.SeekStart)
-
-				dbu := DBFileUser{}
-				if err := binary.Read(us.fdata, binary.LittleEndian, &dbu); err != nil {
-					log.Println(err)
-					return
-				}
-
-				if dbu.DeletedAt != [8]byte{} {
-					continue
-				}
-
-				chout <- dbu
-			}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
 
-			p0 += n
-		}
-	}()
+	if _, ok := us.pkmap[uid]; ok {
+		return nil, fmt.Errorf("%w: user is not deleted", user.ErrConflict)
+	}
+	p, ok := us.deleted[uid]
+	if !ok {
+		return nil, user.ErrNotFound
+	}
+	// надгробие хранит пользователя целиком
+	fr, err := readRecord(us.reader(), p) // O(1)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && version != fr.Version {
+		return nil, user.ErrVersionMismatch
+	}
+	if us.names.taken(fr.Name, uid) { // O(1)
+		return nil, &user.ConflictError{Field: "name"}
+	}
+	fr.Version++
+	fr.UpdatedAt = user.Now()
+	fr.DeletedAt = time.Time{}
+	if err := us.putUser(fr.User); err != nil { // O(1)
+		return nil, err
+	}
+	delete(us.deleted, uid)
+	us.names.insert(fr.Name, uid) // O(log N)
+	return &fr.User, nil
+}
 
-	return chout
+// purgeByID дописывает отметку о стирании, данные пропадут из файла при сжатии
+func (st *UserFileStore) purgeByID(id uuid.UUID) error {
+	fr := fileRecord{
+		User:   user.User{ID: id, DeletedAt: user.Now()},
+		Purged: true,
+	}
+	if _, err := st.appendRecord(fr); err != nil { // O(1)
+		return err
+	}
+	delete(st.deleted, id)
+	return nil
 }
 
-func (us *UserFileStore) searchByName(ctx context.Context, s string, chout chan user.User) {
-	defer close(chout)
+// Purge стирает удаленного пользователя, после этого его ID свободен.
+// Из fdata.dat прежние версии пропадают при следующем Compact.
+func (us *UserFileStore) Purge(ctx context.Context, uid uuid.UUID, version int64) error {
 	us.Lock()
 	defer us.Unlock()
 
-	chin := us.iterateInFdata(ctx, s)
-	for {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	if _, ok := us.pkmap[uid]; ok {
+		return fmt.Errorf("%w: user is not deleted", user.ErrConflict)
+	}
+	p, ok := us.deleted[uid]
+	if !ok {
+		return user.ErrNotFound
+	}
+	if version != 0 {
+		fr, err := readRecord(us.reader(), p) // O(1)
+		if err != nil {
+			return err
+		}
+		if version != fr.Version {
+			return user.ErrVersionMismatch
+		}
+	}
+	return us.purgeByID(uid)
+}
+
+func (us *UserFileStore) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	us.Lock()
+	defer us.Unlock()
+
+	n := 0
+	for id, p := range us.deleted {
 		select {
 		case <-ctx.Done():
-			return
-		case <-time.After(2 * time.Second):
-			return
-		case dbu, ok := <-chin:
-			if !ok {
-				return
-			}
-			if dbu.DeletedAt != [8]byte{} {
+			return n, ctx.Err()
+		default:
+		}
+		fr, err := readRecord(us.reader(), p) // O(1)
+		if err != nil {
+			return n, err
+		}
+		if !fr.DeletedAt.Before(before) {
+			continue
+		}
+		if err := us.purgeByID(id); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// liveUsers читает всех живых пользователей в порядке позиций записей. O(N)
+func (st *UserFileStore) liveUsers() ([]user.User, error) {
+	ret := make([]user.User, 0, len(st.pkmap))
+	for _, ir := range st.idxRecs {
+		if p, ok := st.pkmap[ir.UserID]; !ok || p != ir.Position {
+			continue
+		}
+		u, err := st.readUserByID(ir.UserID)
+		if err != nil {
+			if errors.Is(err, user.ErrNotFound) {
 				continue
 			}
+			return nil, err
+		}
+		ret = append(ret, u)
+	}
+	return ret, nil
+}
 
-			u := user.User{
-				ID:          dbu.ID,
-				Name:        string(dbu.Name[:dbu.NameLen[0]]),
-				Data:        string(dbu.Data[:binary.LittleEndian.Uint16(dbu.DataLen[:])]),
-				Permissions: int(binary.LittleEndian.Uint16(dbu.Permissions[:])),
-			}
+// usersByName читает живых пользователей с именем на s по порядку имен. O(log N + M)
+func (st *UserFileStore) usersByName(s string) ([]user.User, error) {
+	ids := st.names.prefix(s)
+	ret := make([]user.User, 0, len(ids))
+	for _, id := range ids {
+		u, err := st.readUserByID(id)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, u)
+	}
+	return ret, nil
+}
+
+// deletedUsers читает надгробия в порядке позиций
+func (st *UserFileStore) deletedUsers() ([]user.User, error) {
+	ps := make([]Position, 0, len(st.deleted))
+	for _, p := range st.deleted {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i] < ps[j] })
 
-			chout <- u
+	ret := make([]user.User, 0, len(ps))
+	for _, p := range ps {
+		fr, err := readRecord(st.reader(), p) // O(1)
+		if err != nil {
+			return nil, err
 		}
+		ret = append(ret, fr.User)
 	}
+	return ret, nil
 }
 
-func (us *UserFileStore) SearchUsers(ctx context.Context, s string) (chan user.User, error) {
-	us.Lock()
-	defer us.Unlock()
+// candidates - пользователи, среди которых Query.Filter ищет подходящих.
+// Префикс по имени среди живых берется из индекса имен, остальное - перебором.
+func (st *UserFileStore) candidates(q user.Query) ([]user.User, error) {
+	if q.Mode == user.SearchPrefix && !q.WithDeleted() {
+		return st.usersByName(q.Name)
+	}
+	uu, err := st.liveUsers()
+	if err != nil {
+		return nil, err
+	}
+	if q.WithDeleted() {
+		du, err := st.deletedUsers()
+		if err != nil {
+			return nil, err
+		}
+		uu = append(uu, du...)
+	}
+	return uu, nil
+}
 
+// SearchUsers отбирает пользователей под блокировкой, а отдает уже без нее,
+// чтобы медленный читатель не держал хранилище
+func (us *UserFileStore) SearchUsers(ctx context.Context, q user.Query, f func(user.User) error) error {
 	select {
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return ctx.Err()
 	default:
 	}
 
-	chout := make(chan user.User, 100)
+	us.RLock()
+	uu, err := us.candidates(q)
+	us.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range q.Filter(uu) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List упорядочен по ID, как в usermemstore, курсор - последний отданный ID.
+// Позиции в fdata.dat меняет сжатие, поэтому курсором они быть не могут.
+func (us *UserFileStore) List(ctx context.Context, cursor string, limit int) ([]user.User, string, error) {
+	us.RLock()
+	defer us.RUnlock()
 
-	go us.searchByName(ctx, s, chout) // O(N)
+	select {
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	default:
+	}
+
+	var after uuid.UUID
+	if cursor != "" {
+		var err error
+		if after, err = uuid.Parse(cursor); err != nil {
+			return nil, "", user.ErrBadCursor
+		}
+	}
 
-	return chout, nil
+	// на один больше, чтобы знать, есть ли следующая страница
+	ids := us.ids.after(after, limit+1) // O(log N + limit)
+	next := ""
+	if len(ids) > limit {
+		ids = ids[:limit]
+		next = ids[limit-1].String()
+	}
+	ret := make([]user.User, 0, len(ids))
+	for _, id := range ids {
+		u, err := us.readUserByID(id)
+		if err != nil {
+			return nil, "", err
+		}
+		ret = append(ret, u)
+	}
+	return ret, next, nil
 }
@@ -0,0 +1,263 @@
+package userfstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+const walName = "wal.dat"
+
+// после такого размера журнал сбрасывается контрольной точкой
+const walCheckpointSize = 4 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// wal - журнал упреждающей записи для fdata.dat.
+// Каждая запись - это байты и позиция, куда их надо положить в fdata.dat:
+//
+//	[4]длина [4]crc32c [8]позиция [длина-8]байты
+//
+// Запись в fdata.dat делается только после записи в журнал, поэтому при старте
+// журнал можно просто проиграть заново. Недописанная последняя запись
+// отбрасывается, битая запись в середине журнала - ErrCorrupted.
+type wal struct {
+	f    *os.File
+	size int64
+}
+
+func openWAL(name string) (*wal, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_SYNC|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wal{f: f, size: fi.Size()}, nil
+}
+
+func (w *wal) append(p int64, b []byte) error {
+	rec := make([]byte, 4+4+8+len(b))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(8+len(b)))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(p))
+	copy(rec[16:], b)
+	binary.LittleEndian.PutUint32(rec[4:], crc32.Checksum(rec[8:], crcTable))
+	if _, err := w.f.Write(rec); err != nil {
+		// убираем недописанную запись, иначе следующие лягут за ней
+		if terr := w.f.Truncate(w.size); terr != nil {
+			log.Println("truncate wal: ", terr)
+		}
+		return err
+	}
+	w.size += int64(len(rec))
+	return nil
+}
+
+// truncate очищает журнал, все его записи должны уже быть в fdata.dat
+func (w *wal) truncate() error {
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	w.size = 0
+	return nil
+}
+
+func (w *wal) Close() error {
+	return w.f.Close()
+}
+
+// walMaxLen - предел длины тела записи журнала
+const walMaxLen = 8 + recHdrLen + recMaxLen
+
+// replayWAL повторяет целые записи журнала в fdata
+func replayWAL(name string, fdata *os.File) error {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := fi.Size()
+
+	r := bufio.NewReader(f)
+	var hdr [8]byte
+	var p int64
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return checkWALTail(f, p, end)
+		}
+		ln := binary.LittleEndian.Uint32(hdr[0:])
+		if ln < 8 || ln > walMaxLen || p+8+int64(ln) > end {
+			return checkWALTail(f, p, end)
+		}
+		body := make([]byte, ln)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(hdr[4:]) {
+			// при сбое последняя запись может оказаться целой по длине,
+			// но с мусором внутри
+			return checkWALTail(f, p, end)
+		}
+		if _, err := fdata.WriteAt(body[8:], int64(binary.LittleEndian.Uint64(body))); err != nil {
+			return fmt.Errorf("replay wal error: %w", err)
+		}
+		p += 8 + int64(ln)
+	}
+}
+
+// checkWALTail проверяет, что с позиции p до end только недописанная запись:
+// хвост не длиннее одной записи и целых записей в нем нет. Иначе журнал
+// испорчен в середине, и отбросить хвост - значит потерять записанное.
+func checkWALTail(r io.ReaderAt, p, end int64) error {
+	if end-p > 8+walMaxLen {
+		return fmt.Errorf("%w: bad wal record at %d, %d bytes follow", ErrCorrupted, p, end-p)
+	}
+	b := make([]byte, end-p)
+	if _, err := r.ReadAt(b, p); err != nil && err != io.EOF {
+		return err
+	}
+	for off := 1; off+8 <= len(b); off++ {
+		ln := binary.LittleEndian.Uint32(b[off:])
+		if ln < 8 || ln > walMaxLen || off+8+int(ln) > len(b) {
+			continue
+		}
+		if crc32.Checksum(b[off+8:off+8+int(ln)], crcTable) == binary.LittleEndian.Uint32(b[off+4:]) {
+			return fmt.Errorf("%w: bad wal record at %d, intact record follows at %d", ErrCorrupted, p, p+int64(off))
+		}
+	}
+	return nil
+}
+
+// scanFdata строит индекс по последним версиям живых записей fdata.dat,
+// позиции надгробий удаленных и возвращает конец файла
+func scanFdata(fdata *os.File) (map[uuid.UUID]Position, SortedUserIndexRecords, map[uuid.UUID]Position, Position, error) {
+	fi, err := fdata.Stat()
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	pkmap := make(map[uuid.UUID]Position)
+	deleted := make(map[uuid.UUID]Position)
+	end := Position(fi.Size())
+	err = scanRecords(fdata, headerLen, end, func(p Position, fr fileRecord) error {
+		switch {
+		case fr.Purged:
+			delete(pkmap, fr.ID)
+			delete(deleted, fr.ID)
+		case !fr.DeletedAt.IsZero():
+			delete(pkmap, fr.ID)
+			deleted[fr.ID] = p
+		default:
+			pkmap[fr.ID] = p
+			delete(deleted, fr.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	idxRecs := make(SortedUserIndexRecords, 0, len(pkmap))
+	for id, p := range pkmap {
+		idxRecs = append(idxRecs, UserIndexRecord{UserID: id, Position: p})
+	}
+	sort.Sort(idxRecs)
+	return pkmap, idxRecs, deleted, end, nil
+}
+
+// recoverStore проигрывает журнал и сверяет pk.dat с fdata.dat.
+// Если индекс расходится с данными, pk.dat переписывается снимком.
+// При порче fdata.dat или журнала хранилище не открывается.
+func recoverStore(dir string, fdata *os.File) (map[uuid.UUID]Position, SortedUserIndexRecords, map[uuid.UUID]Position, Position, error) {
+	if err := replayWAL(filepath.Join(dir, walName), fdata); err != nil {
+		return nil, nil, nil, 0, fmt.Errorf("replay wal error: %w", err)
+	}
+
+	pkmap, idxRecs, deleted, end, err := scanFdata(fdata)
+	if err != nil {
+		return nil, nil, nil, 0, fmt.Errorf("scan data error: %w", err)
+	}
+
+	pkmapOld, _, err := loadPK(filepath.Join(dir, pkName))
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	if samePK(pkmap, pkmapOld) {
+		return pkmap, idxRecs, deleted, end, truncatePK(filepath.Join(dir, pkName))
+	}
+
+	if err := writePKFile(filepath.Join(dir, pkTmpName), idxRecs); err != nil {
+		return nil, nil, nil, 0, err
+	}
+	if err := os.Rename(filepath.Join(dir, pkTmpName), filepath.Join(dir, pkName)); err != nil {
+		return nil, nil, nil, 0, err
+	}
+	return pkmap, idxRecs, deleted, end, syncDir(dir)
+}
+
+func samePK(a, b map[uuid.UUID]Position) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, p := range a {
+		if pb, ok := b[id]; !ok || pb != p {
+			return false
+		}
+	}
+	return true
+}
+
+// truncatePK отрезает недописанную последнюю запись, иначе следующие съедут
+func truncatePK(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if tail := fi.Size() % pkRecLen; tail != 0 {
+		return os.Truncate(name, fi.Size()-tail)
+	}
+	return nil
+}
+
+var pkRecLen = int64(binary.Size(UserIndexRecord{}))
+
+// writePKFile пишет снимок индекса и сбрасывает его на диск
+func writePKFile(name string, idxRecs SortedUserIndexRecords) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, ir := range idxRecs {
+		if err := binary.Write(w, binary.LittleEndian, ir); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,88 @@
+package userfstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/google/uuid"
+)
+
+// walRecord - запись журнала, как ее пишет wal.append
+func walRecord(p int64, b []byte) []byte {
+	rec := make([]byte, 16+len(b))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(8+len(b)))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(p))
+	copy(rec[16:], b)
+	binary.LittleEndian.PutUint32(rec[4:], crc32.Checksum(rec[8:], crcTable))
+	return rec
+}
+
+func TestCheckWALTail(t *testing.T) {
+	rec := walRecord(headerLen, encodeRecord(fileRecord{User: userWithName("alice")}))
+
+	for _, tc := range []struct {
+		name    string
+		tail    []byte
+		corrupt bool
+	}{
+		{"empty", nil, false},
+		{"torn header", rec[:5], false},
+		{"torn body", rec[:len(rec)-3], false},
+		{"zeros", make([]byte, 100), false},
+		{"intact record after garbage", append([]byte{1, 2, 3}, rec...), true},
+		{"longer than a record", make([]byte, 16+walMaxLen+1), true},
+	} {
+		err := checkWALTail(bytes.NewReader(tc.tail), 0, int64(len(tc.tail)))
+		if got := errors.Is(err, ErrCorrupted); got != tc.corrupt {
+			t.Errorf("%s: checkWALTail returned %v, want corrupted %v", tc.name, err, tc.corrupt)
+		}
+	}
+}
+
+func TestScanRecordsCorruption(t *testing.T) {
+	var b []byte
+	for _, n := range []string{"alice", "bob", "carol"} {
+		b = append(b, encodeRecord(fileRecord{User: userWithName(n)})...)
+	}
+	count := func(b []byte) (int, error) {
+		n := 0
+		err := scanRecords(bytes.NewReader(b), 0, Position(len(b)), func(Position, fileRecord) error {
+			n++
+			return nil
+		})
+		return n, err
+	}
+
+	if n, err := count(b); err != nil || n != 3 {
+		t.Errorf("intact: %d records, err %v, want 3 records", n, err)
+	}
+	for _, tc := range []struct {
+		name string
+		b    []byte
+	}{
+		{"torn tail", b[:len(b)-2]},
+		{"corrupted first record", flip(b, recHdrLen+3)},
+		{"corrupted last record", flip(b, len(b)-1)},
+		{"corrupted length", flip(b, len(b)-len(encodeRecord(fileRecord{User: userWithName("carol")}))+3)},
+	} {
+		if _, err := count(tc.b); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: %v, want %v", tc.name, err, ErrCorrupted)
+		}
+	}
+}
+
+// flip возвращает копию b с инвертированным байтом i
+func flip(b []byte, i int) []byte {
+	ret := append([]byte(nil), b...)
+	ret[i] ^= 0xff
+	return ret
+}
+
+func userWithName(name string) user.User {
+	return user.User{ID: uuid.New(), Name: name, Data: "data of " + name, Version: 1}
+}
@@ -1,9 +1,10 @@
 package usermemstore
 
 import (
+	"bytes"
 	"context"
-	"database/sql"
-	"strings"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,14 +15,21 @@ import (
 
 var _ user.UserStore = &Users{}
 
+// Users хранит пользователей в памяти. Удаление мягкое, как в остальных
+// хранилищах: удаленный уходит в deleted, и его ID остается занят.
+// Имена живых уникальны без учета регистра, names - их user.NameKey.
 type Users struct {
 	sync.Mutex
-	m map[uuid.UUID]user.User
+	m       map[uuid.UUID]user.User
+	deleted map[uuid.UUID]user.User
+	names   map[string]uuid.UUID
 }
 
 func NewUsers() *Users {
 	return &Users{
-		m: make(map[uuid.UUID]user.User),
+		m:       make(map[uuid.UUID]user.User),
+		deleted: make(map[uuid.UUID]user.User),
+		names:   make(map[string]uuid.UUID),
 	}
 }
 
@@ -35,10 +43,37 @@ func (us *Users) Create(ctx context.Context, u user.User) (*uuid.UUID, error) {
 	default:
 	}
 
-	uid := uuid.New()
-	u.ID = uid
+	if u.ID == uuid.Nil {
+		u.ID = uuid.New()
+	}
+	if _, ok := us.m[u.ID]; ok {
+		return nil, fmt.Errorf("%w: user duplicates", &user.ConflictError{Field: "id"})
+	}
+	if _, ok := us.deleted[u.ID]; ok {
+		return nil, fmt.Errorf("%w: user with this id was deleted", &user.ConflictError{Field: "id"})
+	}
+	if err := us.checkName(u); err != nil {
+		return nil, err
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = user.Now()
+	}
+	if u.UpdatedAt.IsZero() {
+		u.UpdatedAt = u.CreatedAt
+	}
+	u.DeletedAt = time.Time{}
+	u.Version = 1
 	us.m[u.ID] = u
-	return &uid, nil
+	us.names[user.NameKey(u.Name)] = u.ID
+	return &u.ID, nil
+}
+
+// checkName проверяет, что имя u не занято другим живым пользователем
+func (us *Users) checkName(u user.User) error {
+	if id, ok := us.names[user.NameKey(u.Name)]; ok && id != u.ID {
+		return &user.ConflictError{Field: "name"}
+	}
+	return nil
 }
 
 func (us *Users) Read(ctx context.Context, uid uuid.UUID) (*user.User, error) {
@@ -54,11 +89,60 @@ func (us *Users) Read(ctx context.Context, uid uuid.UUID) (*user.User, error) {
 	if ok {
 		return &u, nil
 	}
-	return nil, sql.ErrNoRows
+	return nil, user.ErrNotFound
+}
+
+func (us *Users) ReadByName(ctx context.Context, name string) (*user.User, error) {
+	us.Lock()
+	defer us.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	id, ok := us.names[user.NameKey(name)]
+	if !ok {
+		return nil, user.ErrNotFound
+	}
+	u := us.m[id]
+	return &u, nil
+}
+
+func (us *Users) Update(ctx context.Context, u user.User) error {
+	us.Lock()
+	defer us.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	ou, ok := us.m[u.ID]
+	if !ok {
+		return user.ErrNotFound
+	}
+	if u.Version != 0 && u.Version != ou.Version {
+		return user.ErrVersionMismatch
+	}
+	if err := us.checkName(u); err != nil {
+		return err
+	}
+	u.Version = ou.Version + 1
+	u.CreatedAt = ou.CreatedAt
+	if u.UpdatedAt.IsZero() {
+		u.UpdatedAt = user.Now()
+	}
+	u.DeletedAt = time.Time{}
+	us.m[u.ID] = u
+	delete(us.names, user.NameKey(ou.Name))
+	us.names[user.NameKey(u.Name)] = u.ID
+	return nil
 }
 
-// не возвращает ошибку если не нашли
-func (us *Users) Delete(ctx context.Context, uid uuid.UUID) error {
+// без version не возвращает ошибку если не нашли
+func (us *Users) Delete(ctx context.Context, uid uuid.UUID, version int64) error {
 	us.Lock()
 	defer us.Unlock()
 
@@ -68,11 +152,24 @@ func (us *Users) Delete(ctx context.Context, uid uuid.UUID) error {
 	default:
 	}
 
+	u, ok := us.m[uid]
+	switch {
+	case !ok && version != 0:
+		return user.ErrNotFound
+	case !ok:
+		return nil
+	case version != 0 && version != u.Version:
+		return user.ErrVersionMismatch
+	}
 	delete(us.m, uid)
+	delete(us.names, user.NameKey(u.Name))
+	u.Version++
+	u.DeletedAt = user.Now()
+	us.deleted[uid] = u
 	return nil
 }
 
-func (us *Users) SearchUsers(ctx context.Context, s string) (chan user.User, error) {
+func (us *Users) Restore(ctx context.Context, uid uuid.UUID, version int64) (*user.User, error) {
 	us.Lock()
 	defer us.Unlock()
 
@@ -82,24 +179,141 @@ func (us *Users) SearchUsers(ctx context.Context, s string) (chan user.User, err
 	default:
 	}
 
-	chout := make(chan user.User, 100)
-
-	go func() {
-		defer close(chout)
-		us.Lock()
-		defer us.Unlock()
-		for _, u := range us.m {
-			if strings.Contains(u.Name, s) {
-				select {
-				case <-ctx.Done():
-					return
-				case <-time.After(2 * time.Second):
-					return
-				case chout <- u:
-				}
-			}
+	if _, ok := us.m[uid]; ok {
+		return nil, fmt.Errorf("%w: user is not deleted", user.ErrConflict)
+	}
+	u, ok := us.deleted[uid]
+	if !ok {
+		return nil, user.ErrNotFound
+	}
+	if version != 0 && version != u.Version {
+		return nil, user.ErrVersionMismatch
+	}
+	if err := us.checkName(u); err != nil {
+		return nil, err
+	}
+	delete(us.deleted, uid)
+	u.Version++
+	u.UpdatedAt = user.Now()
+	u.DeletedAt = time.Time{}
+	us.m[uid] = u
+	us.names[user.NameKey(u.Name)] = uid
+	return &u, nil
+}
+
+func (us *Users) Purge(ctx context.Context, uid uuid.UUID, version int64) error {
+	us.Lock()
+	defer us.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	if _, ok := us.m[uid]; ok {
+		return fmt.Errorf("%w: user is not deleted", user.ErrConflict)
+	}
+	u, ok := us.deleted[uid]
+	if !ok {
+		return user.ErrNotFound
+	}
+	if version != 0 && version != u.Version {
+		return user.ErrVersionMismatch
+	}
+	delete(us.deleted, uid)
+	return nil
+}
+
+func (us *Users) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	us.Lock()
+	defer us.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	n := 0
+	for id, u := range us.deleted {
+		if u.DeletedAt.Before(before) {
+			delete(us.deleted, id)
+			n++
 		}
-	}()
+	}
+	return n, nil
+}
 
-	return chout, nil
+// SearchUsers отбирает пользователей по снимку, сделанному под блокировкой,
+// и отдает их уже без нее. Порядок задает Query.Filter, обход map на него не влияет.
+func (us *Users) SearchUsers(ctx context.Context, q user.Query, f func(user.User) error) error {
+	us.Lock()
+	select {
+	case <-ctx.Done():
+		us.Unlock()
+		return ctx.Err()
+	default:
+	}
+	uu := make([]user.User, 0, len(us.m))
+	for _, u := range us.m {
+		uu = append(uu, u)
+	}
+	if q.WithDeleted() {
+		for _, u := range us.deleted {
+			uu = append(uu, u)
+		}
+	}
+	us.Unlock()
+
+	for _, u := range q.Filter(uu) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List упорядочен по ID, курсор - последний отданный ID
+func (us *Users) List(ctx context.Context, cursor string, limit int) ([]user.User, string, error) {
+	us.Lock()
+	defer us.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	default:
+	}
+
+	var after uuid.UUID
+	if cursor != "" {
+		var err error
+		if after, err = uuid.Parse(cursor); err != nil {
+			return nil, "", user.ErrBadCursor
+		}
+	}
+
+	ids := make([]uuid.UUID, 0, len(us.m))
+	for id := range us.m {
+		if cursor == "" || bytes.Compare(id[:], after[:]) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+
+	next := ""
+	if len(ids) > limit {
+		ids = ids[:limit]
+		next = ids[limit-1].String()
+	}
+	ret := make([]user.User, 0, len(ids))
+	for _, id := range ids {
+		ret = append(ret, us.m[id])
+	}
+	return ret, next, nil
 }
@@ -0,0 +1,14 @@
+package usermemstore
+
+import (
+	"testing"
+
+	"github.com/larikhide/reguser/app/repos/user"
+	"github.com/larikhide/reguser/app/repos/user/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func() (user.UserStore, func(), error) {
+		return NewUsers(), func() {}, nil
+	})
+}
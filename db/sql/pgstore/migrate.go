@@ -0,0 +1,262 @@
+package pgstore
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Миграции лежат в migrations как NNNN_имя.up.sql и NNNN_имя.down.sql,
+// примененные версии записываются в schema_migrations.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// ключ pg_advisory_lock, под ним миграции идут из одного процесса
+const migrationLockID = 0x7265677573657231 // "reguser1"
+
+type migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus - состояние одной миграции, AppliedAt нулевое у не примененных
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+func (ms MigrationStatus) Applied() bool {
+	return !ms.AppliedAt.IsZero()
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		fname := e.Name()
+		base := strings.TrimSuffix(fname, ".sql")
+		dir := ""
+		switch {
+		case strings.HasSuffix(base, ".up"):
+			dir, base = "up", strings.TrimSuffix(base, ".up")
+		case strings.HasSuffix(base, ".down"):
+			dir, base = "down", strings.TrimSuffix(base, ".down")
+		default:
+			return nil, fmt.Errorf("migration %s: no .up or .down suffix", fname)
+		}
+		i := strings.IndexByte(base, '_')
+		if i < 0 {
+			return nil, fmt.Errorf("migration %s: no version", fname)
+		}
+		v, err := strconv.Atoi(base[:i])
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("migration %s: bad version", fname)
+		}
+		b, err := migrationFiles.ReadFile("migrations/" + fname)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[v]
+		if m == nil {
+			m = &migration{Version: v, Name: base[i+1:]}
+			byVersion[v] = m
+		}
+		if m.Name != base[i+1:] {
+			return nil, fmt.Errorf("migration %s: version %d is taken by %s", fname, v, m.Name)
+		}
+		if dir == "up" {
+			m.up = string(b)
+		} else {
+			m.down = string(b)
+		}
+	}
+
+	ret := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s: need both up and down", m.Version, m.Name)
+		}
+		ret = append(ret, *m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	return ret, nil
+}
+
+// Migrator применяет и откатывает встроенные миграции схемы
+type Migrator struct {
+	db *pgxpool.Pool
+	ms []migration
+}
+
+func NewMigrator(db *pgxpool.Pool) (*Migrator, error) {
+	ms, err := loadMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("load migrations error: %w", err)
+	}
+	return &Migrator{
+		db: db,
+		ms: ms,
+	}, nil
+}
+
+// locked выполняет fn на одном соединении под advisory lock,
+// чтобы одновременно запущенные экземпляры не применяли миграции наперегонки
+func (m *Migrator) locked(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, int64(migrationLockID)); err != nil {
+		return fmt.Errorf("migration lock error: %w", err)
+	}
+	defer func() {
+		// блокировка сессионная, снимаем даже если ctx уже отменен
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, int64(migrationLockID)); err != nil {
+			// соединение с невзятой назад блокировкой в пул не возвращаем
+			conn.Conn().Close(context.Background())
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS public.schema_migrations (
+		version int NOT NULL,
+		name varchar NOT NULL,
+		applied_at timestamptz NOT NULL,
+		CONSTRAINT schema_migrations_pk PRIMARY KEY (version)
+	)`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func applied(ctx context.Context, conn *pgxpool.Conn) (map[int]time.Time, error) {
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM public.schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make(map[int]time.Time)
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		ret[v] = at
+	}
+	return ret, rows.Err()
+}
+
+// run выполняет миграцию и отметку о ней в одной транзакции
+func run(ctx context.Context, conn *pgxpool.Conn, script, mark string, args ...interface{}) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// без аргументов pgx шлет скрипт простым протоколом, в нем может быть несколько команд
+	if _, err := tx.Exec(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, mark, args...); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Up применяет все еще не примененные миграции по порядку
+// и возвращает их номера
+func (m *Migrator) Up(ctx context.Context) ([]int, error) {
+	var done []int
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		ap, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.ms {
+			if _, ok := ap[mg.Version]; ok {
+				continue
+			}
+			if err := run(ctx, conn, mg.up,
+				`INSERT INTO public.schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+				mg.Version, mg.Name, time.Now(),
+			); err != nil {
+				return fmt.Errorf("migration %04d_%s up error: %w", mg.Version, mg.Name, err)
+			}
+			done = append(done, mg.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down откатывает последнюю примененную миграцию и возвращает ее номер,
+// 0 если откатывать нечего
+func (m *Migrator) Down(ctx context.Context) (int, error) {
+	version := 0
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		ap, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for v := range ap {
+			if v > version {
+				version = v
+			}
+		}
+		if version == 0 {
+			return nil
+		}
+		for _, mg := range m.ms {
+			if mg.Version != version {
+				continue
+			}
+			if err := run(ctx, conn, mg.down,
+				`DELETE FROM public.schema_migrations WHERE version = $1`, mg.Version,
+			); err != nil {
+				return fmt.Errorf("migration %04d_%s down error: %w", mg.Version, mg.Name, err)
+			}
+			return nil
+		}
+		return fmt.Errorf("migration %04d is applied but unknown to this build", version)
+	})
+	return version, err
+}
+
+// Status возвращает все известные миграции по порядку
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var ret []MigrationStatus
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		ap, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.ms {
+			ret = append(ret, MigrationStatus{
+				Version:   mg.Version,
+				Name:      mg.Name,
+				AppliedAt: ap[mg.Version],
+			})
+		}
+		return nil
+	})
+	return ret, err
+}
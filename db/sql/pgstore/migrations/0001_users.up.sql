@@ -0,0 +1,14 @@
+-- таблица могла быть создана до миграций, поэтому IF NOT EXISTS
+CREATE TABLE IF NOT EXISTS public.users (
+	id uuid NOT NULL,
+	created_at timestamptz NOT NULL,
+	updated_at timestamptz NOT NULL,
+	deleted_at timestamptz NULL,
+	name varchar NOT NULL,
+	"data" varchar NULL,
+	perms int2 NULL,
+	passhash varchar NULL,
+	CONSTRAINT users_pk PRIMARY KEY (id)
+);
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS passhash varchar NULL;
@@ -0,0 +1,3 @@
+-- поиск идет по name LIKE 'префикс%', обычный btree для него не годится вне локали C
+CREATE INDEX users_name_prefix_idx ON public.users (name varchar_pattern_ops)
+	WHERE deleted_at IS NULL;
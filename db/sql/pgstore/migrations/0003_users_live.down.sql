@@ -0,0 +1 @@
+DROP INDEX public.users_live_idx;
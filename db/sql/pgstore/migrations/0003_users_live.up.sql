@@ -0,0 +1,3 @@
+-- порядок List по живым пользователям
+CREATE INDEX users_live_idx ON public.users (created_at, id)
+	WHERE deleted_at IS NULL;
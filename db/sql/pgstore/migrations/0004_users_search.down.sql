@@ -0,0 +1,5 @@
+-- расширения могут быть нужны не только нам, их не удаляем
+DROP INDEX public.users_fulltext_idx;
+DROP INDEX public.users_data_trgm_idx;
+DROP INDEX public.users_name_trgm_idx;
+DROP FUNCTION public.reguser_unaccent(text);
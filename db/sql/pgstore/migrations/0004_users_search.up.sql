@@ -0,0 +1,21 @@
+-- режимы поиска substring, fuzzy и fulltext
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE EXTENSION IF NOT EXISTS unaccent;
+
+-- unaccent только STABLE, а в выражении индекса нужна IMMUTABLE функция,
+-- поэтому словарь задан явно
+CREATE OR REPLACE FUNCTION public.reguser_unaccent(text) RETURNS text
+	LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT
+	AS $$ SELECT public.unaccent('public.unaccent'::regdictionary, $1) $$;
+
+CREATE INDEX users_name_trgm_idx ON public.users
+	USING gin (public.reguser_unaccent(lower(name)) gin_trgm_ops)
+	WHERE deleted_at IS NULL;
+
+CREATE INDEX users_data_trgm_idx ON public.users
+	USING gin (public.reguser_unaccent(lower(coalesce("data", ''))) gin_trgm_ops)
+	WHERE deleted_at IS NULL;
+
+CREATE INDEX users_fulltext_idx ON public.users
+	USING gin (to_tsvector('simple', public.reguser_unaccent(name || ' ' || coalesce("data", ''))))
+	WHERE deleted_at IS NULL;
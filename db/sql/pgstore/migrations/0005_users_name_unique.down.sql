@@ -0,0 +1 @@
+DROP INDEX public.users_name_key_idx;
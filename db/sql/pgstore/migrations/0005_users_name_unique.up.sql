@@ -0,0 +1,5 @@
+-- имена живых пользователей уникальны без учета регистра, как user.NameKey.
+-- Если в таблице уже есть такие дубли, миграция не пройдет: их надо
+-- переименовать или удалить до обновления.
+CREATE UNIQUE INDEX users_name_key_idx ON public.users (lower(name))
+	WHERE deleted_at IS NULL;
@@ -0,0 +1,3 @@
+-- версия для оптимистичных блокировок, растет с каждым изменением строки;
+-- у уже существующих строк она 1, как у только что созданных
+ALTER TABLE public.users ADD COLUMN version bigint NOT NULL DEFAULT 1;
@@ -2,14 +2,19 @@ package pgstore
 
 import (
 	"context"
-	"database/sql"
-	"log"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/larikhide/reguser/app/repos/user"
 
 	"github.com/google/uuid"
-	_ "github.com/jackc/pgx/v4/stdlib" // Postgresql driver
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 var _ user.UserStore = &Users{}
@@ -22,62 +27,138 @@ type DBPgUser struct {
 	Name        string     `db:"name"`
 	Data        string     `db:"data"`
 	Permissions int        `db:"perms"`
+	PassHash    *string    `db:"passhash"`
+	Version     int64      `db:"version"`
+}
+
+func (dbu *DBPgUser) user() user.User {
+	u := user.User{
+		ID:          dbu.ID,
+		Name:        dbu.Name,
+		Data:        dbu.Data,
+		Permissions: dbu.Permissions,
+		Version:     dbu.Version,
+	}
+	if dbu.PassHash != nil {
+		u.PassHash = *dbu.PassHash
+	}
+	u.CreatedAt = dbu.CreatedAt.UTC()
+	u.UpdatedAt = dbu.UpdatedAt.UTC()
+	if dbu.DeletedAt != nil {
+		u.DeletedAt = dbu.DeletedAt.UTC()
+	}
+	return u
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
 }
 
 type Users struct {
-	db *sql.DB
+	db *pgxpool.Pool
 }
 
-func NewUsers(dsn string) (*Users, error) {
-	db, err := sql.Open("pgx", dsn)
+// NewUsers открывает пул соединений и доводит схему до текущей версии.
+// Пул настраивается параметрами dsn (pool_max_conns, pool_min_conns,
+// pool_health_check_period, statement_cache_capacity и т.д.) и опциями,
+// опции важнее параметров.
+func NewUsers(dsn string, opts ...Option) (*Users, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
 		return nil, err
 	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS public.users (
-		id uuid NOT NULL,
-		created_at timestamptz NOT NULL,
-		updated_at timestamptz NOT NULL,
-		deleted_at timestamptz NULL,
-		name varchar NOT NULL,
-		"data" varchar NULL,
-		perms int2 NULL,
-		CONSTRAINT users_pk PRIMARY KEY (id)
-	);`)
+	ctx := context.Background()
+	db, err := pgxpool.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
 
+	err = db.Ping(ctx)
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
 
-	err = db.Ping()
+	// схема доводится до текущей версии, параллельные экземпляры ждут друг друга
+	m, err := NewMigrator(db)
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
+	if _, err := m.Up(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate error: %w", err)
+	}
+
 	us := &Users{
 		db: db,
 	}
 	return us, nil
 }
 
+// storeError переводит ошибки ограничений postgres в ошибки user
+func storeError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch pgErr.Code {
+	case "23505": // unique_violation
+		field := "id"
+		if pgErr.ConstraintName == "users_name_key_idx" {
+			field = "name"
+		}
+		return fmt.Errorf("%w: %s", &user.ConflictError{Field: field}, pgErr.Message)
+	case "22001", "22003", "23502", "23514":
+		// string_data_right_truncation, numeric_value_out_of_range, not_null_violation, check_violation
+		return fmt.Errorf("%w: %s", user.ErrValidation, pgErr.Message)
+	}
+	return err
+}
+
+// checkPerms - права хранятся в int2. Больше pgx не отправит вовсе,
+// и до postgres с его 22003 дело не дойдет.
+func checkPerms(perms int) error {
+	if perms < math.MinInt16 || perms > math.MaxInt16 {
+		return fmt.Errorf("%w: perms %d out of int2 range", user.ErrValidation, perms)
+	}
+	return nil
+}
+
 func (us *Users) Close() {
 	us.db.Close()
 }
 
 func (us *Users) Create(ctx context.Context, u user.User) (*uuid.UUID, error) {
+	if err := checkPerms(u.Permissions); err != nil {
+		return nil, err
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = user.Now()
+	}
+	if u.UpdatedAt.IsZero() {
+		u.UpdatedAt = u.CreatedAt
+	}
 	dbu := &DBPgUser{
 		ID:          u.ID,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
 		Name:        u.Name,
 		Data:        u.Data,
 		Permissions: u.Permissions,
+		PassHash:    nullString(u.PassHash),
 	}
 
-	_, err := us.db.ExecContext(ctx, `INSERT INTO users 
-	(id, created_at, updated_at, deleted_at, name, data, perms)
-	values ($1, $2, $3, $4, $5, $6, $7)`,
+	_, err := us.db.Exec(ctx, `INSERT INTO users 
+	(id, created_at, updated_at, deleted_at, name, data, perms, passhash)
+	values ($1, $2, $3, $4, $5, $6, $7, $8)`,
 		dbu.ID,
 		dbu.CreatedAt,
 		dbu.UpdatedAt,
@@ -85,29 +166,344 @@ func (us *Users) Create(ctx context.Context, u user.User) (*uuid.UUID, error) {
 		dbu.Name,
 		dbu.Data,
 		dbu.Permissions,
+		dbu.PassHash,
 	)
 	if err != nil {
-		return nil, err
+		return nil, storeError(err)
 	}
 
 	return &u.ID, nil
 }
 
-func (us *Users) Delete(ctx context.Context, uid uuid.UUID) error {
-	_, err := us.db.ExecContext(ctx, `UPDATE users SET deleted_at = $2 WHERE id = $1`,
-		uid, time.Now(),
+// CreateMany вставляет пользователей одним COPY, для массовой загрузки.
+// Вставляются все или никто, занятый ID или имя - ErrConflict на всю пачку.
+func (us *Users) CreateMany(ctx context.Context, uu []user.User) (int, error) {
+	now := user.Now()
+	rows := make([][]interface{}, 0, len(uu))
+	for _, u := range uu {
+		if err := checkPerms(u.Permissions); err != nil {
+			return 0, err
+		}
+		createdAt, updatedAt := u.CreatedAt, u.UpdatedAt
+		if createdAt.IsZero() {
+			createdAt = now
+		}
+		if updatedAt.IsZero() {
+			updatedAt = createdAt
+		}
+		rows = append(rows, []interface{}{
+			u.ID,
+			createdAt,
+			updatedAt,
+			u.Name,
+			u.Data,
+			u.Permissions,
+			nullString(u.PassHash),
+		})
+	}
+
+	n, err := us.db.CopyFrom(ctx, pgx.Identifier{"users"},
+		[]string{"id", "created_at", "updated_at", "name", "data", "perms", "passhash"},
+		pgx.CopyFromRows(rows),
 	)
-	return err
+	if err != nil {
+		return 0, storeError(err)
+	}
+	return int(n), nil
+}
+
+func (us *Users) Update(ctx context.Context, u user.User) error {
+	if err := checkPerms(u.Permissions); err != nil {
+		return err
+	}
+	if u.UpdatedAt.IsZero() {
+		u.UpdatedAt = user.Now()
+	}
+	res, err := us.db.Exec(ctx, `UPDATE users
+	SET updated_at = $2, name = $3, data = $4, perms = $5, passhash = $6, version = version + 1
+	WHERE id = $1 AND deleted_at IS NULL AND ($7::bigint = 0 OR version = $7::bigint)`,
+		u.ID,
+		u.UpdatedAt,
+		u.Name,
+		u.Data,
+		u.Permissions,
+		nullString(u.PassHash),
+		u.Version,
+	)
+	if err != nil {
+		return storeError(err)
+	}
+	if res.RowsAffected() == 0 {
+		return us.versionError(ctx, u.ID)
+	}
+	return nil
+}
+
+// без version не возвращает ошибку если не нашли
+func (us *Users) Delete(ctx context.Context, uid uuid.UUID, version int64) error {
+	res, err := us.db.Exec(ctx, `UPDATE users SET deleted_at = $2, version = version + 1
+	WHERE id = $1 AND deleted_at IS NULL AND ($3::bigint = 0 OR version = $3::bigint)`,
+		uid, user.Now(), version,
+	)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 && version != 0 {
+		return us.versionError(ctx, uid)
+	}
+	return nil
+}
+
+// versionError объясняет, почему Update или Delete не нашли живого uid нужной версии
+func (us *Users) versionError(ctx context.Context, uid uuid.UUID) error {
+	var version int64
+	err := us.db.QueryRow(ctx, `SELECT version FROM users WHERE id = $1 AND deleted_at IS NULL`, uid).Scan(&version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.ErrNotFound
+		}
+		return err
+	}
+	return user.ErrVersionMismatch
+}
+
+// notDeletedError объясняет, почему Restore или Purge не нашли удаленного uid
+// версии version, нулевая - любой
+func (us *Users) notDeletedError(ctx context.Context, uid uuid.UUID, version int64) error {
+	var deletedAt *time.Time
+	var v int64
+	err := us.db.QueryRow(ctx, `SELECT deleted_at, version FROM users WHERE id = $1`, uid).Scan(&deletedAt, &v)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.ErrNotFound
+		}
+		return err
+	}
+	if deletedAt == nil {
+		return fmt.Errorf("%w: user is not deleted", user.ErrConflict)
+	}
+	if version != 0 && version != v {
+		return user.ErrVersionMismatch
+	}
+	// успели стереть или вернуть между запросами
+	return user.ErrNotFound
+}
+
+func (us *Users) Restore(ctx context.Context, uid uuid.UUID, version int64) (*user.User, error) {
+	dbu := &DBPgUser{}
+	err := us.db.QueryRow(ctx, `UPDATE users SET deleted_at = NULL, updated_at = $2, version = version + 1
+	WHERE id = $1 AND deleted_at IS NOT NULL AND ($3::bigint = 0 OR version = $3::bigint)
+	RETURNING id, created_at, updated_at, deleted_at, name, data, perms, passhash, version`,
+		uid, user.Now(), version,
+	).Scan(
+		&dbu.ID,
+		&dbu.CreatedAt,
+		&dbu.UpdatedAt,
+		&dbu.DeletedAt,
+		&dbu.Name,
+		&dbu.Data,
+		&dbu.Permissions,
+		&dbu.PassHash,
+		&dbu.Version,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, us.notDeletedError(ctx, uid, version)
+		}
+		return nil, storeError(err)
+	}
+	u := dbu.user()
+	return &u, nil
+}
+
+func (us *Users) Purge(ctx context.Context, uid uuid.UUID, version int64) error {
+	res, err := us.db.Exec(ctx, `DELETE FROM users
+	WHERE id = $1 AND deleted_at IS NOT NULL AND ($2::bigint = 0 OR version = $2::bigint)`, uid, version)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return us.notDeletedError(ctx, uid, version)
+	}
+	return nil
+}
+
+func (us *Users) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	res, err := us.db.Exec(ctx, `DELETE FROM users WHERE deleted_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.RowsAffected()), nil
 }
 
 func (us *Users) Read(ctx context.Context, uid uuid.UUID) (*user.User, error) {
 	dbu := &DBPgUser{}
-	rows, err := us.db.QueryContext(ctx, `SELECT id, created_at, updated_at, deleted_at, name, data, perms 
-	FROM users WHERE id = $1`, uid)
+	err := us.db.QueryRow(ctx, `SELECT id, created_at, updated_at, deleted_at, name, data, perms, passhash, version
+	FROM users WHERE id = $1 AND deleted_at IS NULL`, uid).Scan(
+		&dbu.ID,
+		&dbu.CreatedAt,
+		&dbu.UpdatedAt,
+		&dbu.DeletedAt,
+		&dbu.Name,
+		&dbu.Data,
+		&dbu.Permissions,
+		&dbu.PassHash,
+		&dbu.Version,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, user.ErrNotFound
+		}
+		return nil, err
+	}
+
+	u := dbu.user()
+	return &u, nil
+}
+
+// ReadByName ищет по уникальному индексу users_name_key_idx
+func (us *Users) ReadByName(ctx context.Context, name string) (*user.User, error) {
+	dbu := &DBPgUser{}
+	err := us.db.QueryRow(ctx, `SELECT id, created_at, updated_at, deleted_at, name, data, perms, passhash, version
+	FROM users WHERE lower(name) = lower($1) AND deleted_at IS NULL
+	ORDER BY name = $1 DESC LIMIT 1`, name).Scan(
+		&dbu.ID,
+		&dbu.CreatedAt,
+		&dbu.UpdatedAt,
+		&dbu.DeletedAt,
+		&dbu.Name,
+		&dbu.Data,
+		&dbu.Permissions,
+		&dbu.PassHash,
+		&dbu.Version,
+	)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, user.ErrNotFound
+		}
 		return nil, err
 	}
+
+	u := dbu.user()
+	return &u, nil
+}
+
+// likeEscape экранирует в s символы шаблона LIKE
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// sqlQuery собирает условия запроса, аргументы нумеруются по мере добавления
+type sqlQuery struct {
+	where []string
+	args  []interface{}
+}
+
+func (sq *sqlQuery) arg(v interface{}) string {
+	sq.args = append(sq.args, v)
+	return "$" + strconv.Itoa(len(sq.args))
+}
+
+func (sq *sqlQuery) and(cond string) {
+	sq.where = append(sq.where, cond)
+}
+
+func (sq *sqlQuery) timeRange(col string, tr user.TimeRange) {
+	if !tr.From.IsZero() {
+		sq.and(col + ` >= ` + sq.arg(tr.From))
+	}
+	if !tr.To.IsZero() {
+		sq.and(col + ` < ` + sq.arg(tr.To))
+	}
+}
+
+// searchQuery переводит user.Query в SELECT. Выражения поиска по имени
+// совпадают с индексами из миграции 0004_users_search. Порядок тот же, что
+// у user.Query.Filter: при равенстве по id, имена побайтово (COLLATE "C").
+func searchQuery(q user.Query) (string, []interface{}) {
+	sq := &sqlQuery{}
+	switch {
+	case !q.Deleted.IsZero():
+		sq.and(`deleted_at IS NOT NULL`)
+		sq.timeRange(`deleted_at`, q.Deleted)
+	case !q.IncludeDeleted:
+		sq.and(`deleted_at IS NULL`)
+	}
+
+	const (
+		normName = `reguser_unaccent(lower(name))`
+		normData = `reguser_unaccent(lower(coalesce(data, '')))`
+		document = `to_tsvector('simple', reguser_unaccent(name || ' ' || coalesce(data, '')))`
+	)
+	order := `created_at, id`
+	if q.Mode == user.SearchPrefix {
+		order = `name COLLATE "C", id`
+	}
+	switch {
+	case q.Name == "":
+	case q.Mode == user.SearchSubstring:
+		a := `reguser_unaccent(lower(` + sq.arg("%"+likeEscape(q.Name)+"%") + `))`
+		sq.and(`(` + normName + ` LIKE ` + a + ` OR ` + normData + ` LIKE ` + a + `)`)
+	case q.Mode == user.SearchFuzzy:
+		a := `reguser_unaccent(lower(` + sq.arg(q.Name) + `))`
+		sq.and(normName + ` % ` + a)
+		order = `similarity(` + normName + `, ` + a + `) DESC, ` + order
+	case q.Mode == user.SearchFulltext:
+		a := `plainto_tsquery('simple', reguser_unaccent(` + sq.arg(q.Name) + `))`
+		sq.and(document + ` @@ ` + a)
+		order = `ts_rank(` + document + `, ` + a + `) DESC, ` + order
+	default:
+		sq.and(`name LIKE ` + sq.arg(likeEscape(q.Name)+"%"))
+	}
+
+	if q.PermsAll != 0 {
+		a := sq.arg(q.PermsAll)
+		sq.and(`coalesce(perms, 0)::int & ` + a + `::int = ` + a + `::int`)
+	}
+	if q.PermsAny != 0 {
+		sq.and(`coalesce(perms, 0)::int & ` + sq.arg(q.PermsAny) + `::int <> 0`)
+	}
+	if q.PermsNone != 0 {
+		sq.and(`coalesce(perms, 0)::int & ` + sq.arg(q.PermsNone) + `::int = 0`)
+	}
+	sq.timeRange(`created_at`, q.Created)
+	sq.timeRange(`updated_at`, q.Updated)
+
+	switch q.Sort {
+	case user.SortName:
+		order = `name COLLATE "C", id`
+	case user.SortNameDesc:
+		order = `name COLLATE "C" DESC, id DESC`
+	case user.SortCreated:
+		order = `created_at, id`
+	case user.SortCreatedDesc:
+		order = `created_at DESC, id DESC`
+	case user.SortUpdated:
+		order = `updated_at, id`
+	case user.SortUpdatedDesc:
+		order = `updated_at DESC, id DESC`
+	}
+
+	sql := `SELECT id, created_at, updated_at, deleted_at, name, data, perms, passhash, version FROM users`
+	if len(sq.where) > 0 {
+		sql += ` WHERE ` + strings.Join(sq.where, ` AND `)
+	}
+	sql += ` ORDER BY ` + order
+	if q.Limit > 0 {
+		sql += ` LIMIT ` + sq.arg(q.Limit)
+	}
+	return sql, sq.args
+}
+
+func (us *Users) SearchUsers(ctx context.Context, q user.Query, f func(user.User) error) error {
+	query, args := searchQuery(q)
+	rows, err := us.db.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
+
+	dbu := &DBPgUser{}
 	for rows.Next() {
 		if err := rows.Scan(
 			&dbu.ID,
@@ -117,57 +513,72 @@ func (us *Users) Read(ctx context.Context, uid uuid.UUID) (*user.User, error) {
 			&dbu.Name,
 			&dbu.Data,
 			&dbu.Permissions,
+			&dbu.PassHash,
+			&dbu.Version,
 		); err != nil {
-			return nil, err
+			return err
+		}
+		if err := f(dbu.user()); err != nil {
+			return err
 		}
 	}
+	return rows.Err()
+}
 
-	return &user.User{
-		ID:          dbu.ID,
-		Name:        dbu.Name,
-		Data:        dbu.Data,
-		Permissions: dbu.Permissions,
-	}, nil
-}
-
-func (us *Users) SearchUsers(ctx context.Context, s string) (chan user.User, error) {
-	chout := make(chan user.User, 100)
-
-	go func() {
-		defer close(chout)
-		dbu := &DBPgUser{}
-
-		rows, err := us.db.QueryContext(ctx, `
-		SELECT id, created_at, updated_at, deleted_at, name, data, perms 
-		FROM users WHERE name LIKE $1`, s+"%")
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			if err := rows.Scan(
-				&dbu.ID,
-				&dbu.CreatedAt,
-				&dbu.UpdatedAt,
-				&dbu.DeletedAt,
-				&dbu.Name,
-				&dbu.Data,
-				&dbu.Permissions,
-			); err != nil {
-				log.Println(err)
-				return
-			}
-
-			chout <- user.User{
-				ID:          dbu.ID,
-				Name:        dbu.Name,
-				Data:        dbu.Data,
-				Permissions: dbu.Permissions,
-			}
-		}
-	}()
-
-	return chout, nil
+// List упорядочен по created_at и id, курсор - эта пара у последней отданной записи
+func (us *Users) List(ctx context.Context, cursor string, limit int) ([]user.User, string, error) {
+	after := time.Time{}
+	afterID := uuid.Nil
+	if cursor != "" {
+		i := strings.IndexByte(cursor, ',')
+		if i < 0 {
+			return nil, "", user.ErrBadCursor
+		}
+		var err error
+		if after, err = time.Parse(time.RFC3339Nano, cursor[:i]); err != nil {
+			return nil, "", user.ErrBadCursor
+		}
+		if afterID, err = uuid.Parse(cursor[i+1:]); err != nil {
+			return nil, "", user.ErrBadCursor
+		}
+	}
+
+	rows, err := us.db.Query(ctx, `
+	SELECT id, created_at, updated_at, deleted_at, name, data, perms, passhash, version
+	FROM users WHERE deleted_at IS NULL AND (created_at, id) > ($1, $2)
+	ORDER BY created_at, id LIMIT $3`, after, afterID, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	ret := make([]user.User, 0, limit)
+	next := ""
+	var last DBPgUser
+	for rows.Next() {
+		dbu := DBPgUser{}
+		if err := rows.Scan(
+			&dbu.ID,
+			&dbu.CreatedAt,
+			&dbu.UpdatedAt,
+			&dbu.DeletedAt,
+			&dbu.Name,
+			&dbu.Data,
+			&dbu.Permissions,
+			&dbu.PassHash,
+			&dbu.Version,
+		); err != nil {
+			return nil, "", err
+		}
+		if len(ret) == limit {
+			next = last.CreatedAt.UTC().Format(time.RFC3339Nano) + "," + last.ID.String()
+			break
+		}
+		ret = append(ret, dbu.user())
+		last = dbu
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return ret, next, nil
 }
@@ -0,0 +1,105 @@
+package pgstore_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/larikhide/reguser/app/repos/user"
+	"github.com/larikhide/reguser/app/repos/user/storetest"
+	"github.com/larikhide/reguser/db/mem/usermemstore"
+	"github.com/larikhide/reguser/db/sql/pgstore/pgtest"
+
+	"github.com/google/uuid"
+)
+
+// dsn - база для проверок из STORECHECK_DATABASE_URL или временный кластер,
+// пустая, если postgres нет
+var dsn string
+
+func TestMain(m *testing.M) {
+	stop := func() {}
+	dsn = os.Getenv("STORECHECK_DATABASE_URL")
+	if dsn == "" {
+		d, s, err := pgtest.Start()
+		switch {
+		case errors.Is(err, pgtest.ErrNoPostgres):
+			log.Println("postgres tests skipped: ", err)
+		case err != nil:
+			log.Fatal(err)
+		default:
+			dsn, stop = d, s
+		}
+	}
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+func TestStore(t *testing.T) {
+	if dsn == "" {
+		t.Skip("postgres is not available")
+	}
+	storetest.Run(t, pgtest.Factory(dsn))
+}
+
+func TestCreateMany(t *testing.T) {
+	if dsn == "" {
+		t.Skip("postgres is not available")
+	}
+	ctx := context.Background()
+	st, closeStore, err := pgtest.Factory(dsn)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeStore()
+	bc, ok := st.(user.BulkCreator)
+	if !ok {
+		t.Fatal("pgstore is not a BulkCreator")
+	}
+
+	src := usermemstore.NewUsers()
+	for _, n := range []string{"ann", "bob", "cid", "dan", "eve"} {
+		if _, err := src.Create(ctx, user.User{Name: n, Data: n + " data", Permissions: user.PermReadUsers, PassHash: "hash"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := user.Copy(ctx, st, src, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("copied %d, want 5", n)
+	}
+	uu, _, err := src.List(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range uu {
+		got, err := st.Read(ctx, w.ID)
+		if err != nil {
+			t.Fatalf("read %s: %v", w.Name, err)
+		}
+		if got.Name != w.Name || got.Data != w.Data || got.Permissions != w.Permissions ||
+			got.PassHash != w.PassHash || !got.CreatedAt.Equal(w.CreatedAt) || got.Version != 1 {
+			t.Errorf("copied %+v, want %+v", *got, w)
+		}
+	}
+
+	// пачка вставляется целиком или никак
+	fresh := user.User{ID: uuid.New(), Name: "fay"}
+	if _, err := bc.CreateMany(ctx, []user.User{fresh, {ID: uuid.New(), Name: "ANN"}}); !errors.Is(err, user.ErrConflict) {
+		t.Errorf("batch with taken name returned %v, want %v", err, user.ErrConflict)
+	}
+	if _, err := bc.CreateMany(ctx, []user.User{fresh, {ID: uu[0].ID, Name: "gus"}}); !errors.Is(err, user.ErrConflict) {
+		t.Errorf("batch with taken id returned %v, want %v", err, user.ErrConflict)
+	}
+	if _, err := bc.CreateMany(ctx, []user.User{fresh, {ID: uuid.New(), Name: "hal", Permissions: 1 << 15}}); !errors.Is(err, user.ErrValidation) {
+		t.Errorf("batch with perms out of int2 returned %v, want %v", err, user.ErrValidation)
+	}
+	if _, err := st.Read(ctx, fresh.ID); !errors.Is(err, user.ErrNotFound) {
+		t.Errorf("user from a failed batch was inserted: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Package pgtest поднимает временный postgres для проверок pgstore.
+package pgtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/larikhide/reguser/app/repos/user"
+	"github.com/larikhide/reguser/app/repos/user/storetest"
+	"github.com/larikhide/reguser/db/sql/pgstore"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ErrNoPostgres - initdb или pg_ctl нет в PATH, проверки postgres пропускаются
+var ErrNoPostgres = errors.New("postgres is not installed")
+
+// Start поднимает временный кластер на свободном порту,
+// доступный только через unix-сокет в его каталоге
+func Start() (string, func(), error) {
+	for _, bin := range []string{"initdb", "pg_ctl"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			return "", nil, fmt.Errorf("%w: %v", ErrNoPostgres, err)
+		}
+	}
+	dir, err := os.MkdirTemp("", "reguser-pg")
+	if err != nil {
+		return "", nil, err
+	}
+	data := filepath.Join(dir, "data")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	run := func(name string, args ...string) error {
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %w: %s", name, err, out)
+		}
+		return nil
+	}
+	if err := run("initdb", "-D", data, "-U", "postgres", "--auth=trust"); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	opts := fmt.Sprintf("-p %d -k %s -c listen_addresses=''", port, dir)
+	if err := run("pg_ctl", "-D", data, "-o", opts, "-l", filepath.Join(dir, "log"), "-w", "start"); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	stop := func() {
+		if err := run("pg_ctl", "-D", data, "-m", "fast", "-w", "stop"); err != nil {
+			log.Println(err)
+		}
+		os.RemoveAll(dir)
+	}
+	dsn := fmt.Sprintf("host=%s port=%d user=postgres dbname=postgres sslmode=disable", dir, port)
+	return dsn, stop, nil
+}
+
+// Factory открывает pgstore на базе dsn, таблица users очищается
+// перед каждой проверкой
+func Factory(dsn string) storetest.Factory {
+	return func() (user.UserStore, func(), error) {
+		st, err := pgstore.NewUsers(dsn)
+		if err != nil {
+			return nil, nil, err
+		}
+		db, err := pgxpool.Connect(context.Background(), dsn)
+		if err != nil {
+			st.Close()
+			return nil, nil, err
+		}
+		defer db.Close()
+		if _, err := db.Exec(context.Background(), `TRUNCATE users`); err != nil {
+			st.Close()
+			return nil, nil, err
+		}
+		return st, st.Close, nil
+	}
+}
@@ -0,0 +1,112 @@
+package pgstore
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Option меняет настройки пула поверх параметров из dsn
+type Option func(*pgxpool.Config)
+
+// WithMaxConns ограничивает размер пула, 0 оставляет значение из dsn
+func WithMaxConns(n int32) Option {
+	return func(cfg *pgxpool.Config) {
+		if n > 0 {
+			cfg.MaxConns = n
+		}
+	}
+}
+
+func WithMinConns(n int32) Option {
+	return func(cfg *pgxpool.Config) {
+		cfg.MinConns = n
+	}
+}
+
+// WithHealthCheckPeriod - как часто пул проверяет простаивающие соединения
+// и закрывает битые и отжившие свое
+func WithHealthCheckPeriod(d time.Duration) Option {
+	return func(cfg *pgxpool.Config) {
+		cfg.HealthCheckPeriod = d
+	}
+}
+
+// WithStatementCache задает размер кеша подготовленных запросов на соединение,
+// 0 выключает кеш, это нужно за pgbouncer в режиме транзакций
+func WithStatementCache(capacity int) Option {
+	return func(cfg *pgxpool.Config) {
+		if capacity <= 0 {
+			cfg.ConnConfig.BuildStatementCache = nil
+			return
+		}
+		cfg.ConnConfig.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+			return stmtcache.New(conn, stmtcache.ModePrepare, capacity)
+		}
+	}
+}
+
+// QueryTrace - выполненный запрос к базе
+type QueryTrace struct {
+	Op       string // Query, Exec, CopyFrom
+	SQL      string // у CopyFrom - имя таблицы
+	Args     []interface{}
+	Duration time.Duration // у запросов с ошибкой 0
+	Rows     int64
+	Err      error
+}
+
+// QueryTracer вызывается после каждого запроса хранилища
+type QueryTracer func(ctx context.Context, qt QueryTrace)
+
+// WithTracer подключает tracer через логгер pgx
+func WithTracer(t QueryTracer) Option {
+	return func(cfg *pgxpool.Config) {
+		cfg.ConnConfig.Logger = traceLogger(t)
+		cfg.ConnConfig.LogLevel = pgx.LogLevelInfo
+	}
+}
+
+// LogTracer пишет запросы в лог, без аргументов - там бывают хеши паролей
+func LogTracer(ctx context.Context, qt QueryTrace) {
+	if qt.Err != nil {
+		log.Printf("pg %s error: %v: %s", qt.Op, qt.Err, qt.SQL)
+		return
+	}
+	log.Printf("pg %s %v rows %d: %s", qt.Op, qt.Duration, qt.Rows, qt.SQL)
+}
+
+// traceLogger переводит записи лога pgx о запросах в QueryTrace
+type traceLogger QueryTracer
+
+func (t traceLogger) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	qt := QueryTrace{Op: msg}
+	switch msg {
+	case "Query", "Exec":
+		qt.SQL, _ = data["sql"].(string)
+		qt.Args, _ = data["args"].([]interface{})
+	case "CopyFrom":
+		if tn, ok := data["tableName"].(pgx.Identifier); ok {
+			qt.SQL = tn.Sanitize()
+		}
+	default:
+		return
+	}
+	qt.Duration, _ = data["time"].(time.Duration)
+	switch n := data["rowCount"].(type) {
+	case int:
+		qt.Rows = int64(n)
+	case int64:
+		qt.Rows = n
+	}
+	if ct, ok := data["commandTag"].(pgconn.CommandTag); ok {
+		qt.Rows = ct.RowsAffected()
+	}
+	qt.Err, _ = data["err"].(error)
+	t(ctx, qt)
+}
@@ -0,0 +1,43 @@
+package pgstore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/larikhide/reguser/app/repos/user"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestStoreError(t *testing.T) {
+	for _, c := range []struct {
+		code string
+		want error
+	}{
+		{"23505", user.ErrConflict},
+		{"22001", user.ErrValidation},
+		{"22003", user.ErrValidation},
+		{"23502", user.ErrValidation},
+		{"23514", user.ErrValidation},
+	} {
+		if err := storeError(&pgconn.PgError{Code: c.code}); !errors.Is(err, c.want) {
+			t.Errorf("sqlstate %s: %v, want %v", c.code, err, c.want)
+		}
+	}
+	if err := storeError(&pgconn.PgError{Code: "40001"}); errors.Is(err, user.ErrValidation) || errors.Is(err, user.ErrConflict) {
+		t.Errorf("sqlstate 40001: %v", err)
+	}
+}
+
+func TestCheckPerms(t *testing.T) {
+	for _, perms := range []int{0, user.PermAdmin, 32767} {
+		if err := checkPerms(perms); err != nil {
+			t.Errorf("perms %d: %v", perms, err)
+		}
+	}
+	for _, perms := range []int{32768, 40000, 65535} {
+		if err := checkPerms(perms); !errors.Is(err, user.ErrValidation) {
+			t.Errorf("perms %d: %v, want %v", perms, err, user.ErrValidation)
+		}
+	}
+}